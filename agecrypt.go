@@ -0,0 +1,221 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+// Per-device encryption
+//
+// With --encryption=age, each device has its own X25519 identity (stored in
+// the identity file, created automatically) and messages are encrypted with
+// age to every device in the recipients file, plus the sending device. Only
+// devices in the recipients file of the sender can read its messages, so
+// removing a device from the recipients file stops it from reading new
+// messages sent by this device. The recipients file holds one device per
+// line:
+//
+//	<name> <age recipient (public key)>
+//
+// Age only provides confidentiality: anyone knowing the public key of a
+// device can encrypt messages to it. Per-device encryption therefore requires
+// signed messages (--sign) and a list of trusted signers, and unsigned
+// messages are always rejected. The topic is sealed with the message, which
+// has the format (before age encryption):
+//
+//	magic      4 bytes, "CSAT"
+//	length     2 bytes, length of the topic (big endian)
+//	topic      topic the message was published to
+//	message    the message
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+)
+
+const (
+	// Encryption modes.
+	encryptionShared = "shared"
+	encryptionAge    = "age"
+
+	// Default identity and recipients files, under configDir.
+	identityFile   = "identity"
+	recipientsFile = "recipients"
+
+	// Maximum size of a decrypted message.
+	maxDecryptedSize = 64 * 1024 * 1024
+
+	// Magic of the sealed cleartext, holding the topic.
+	ageTopicMagic = "CSAT"
+)
+
+// device holds one entry of the recipients file.
+type device struct {
+	name      string
+	recipient *age.X25519Recipient
+}
+
+// ageCrypter encrypts messages to the devices in the recipients file and
+// decrypts them with the local identity.
+type ageCrypter struct {
+	identity       *age.X25519Identity
+	recipientsFile string
+}
+
+// newAgeCrypter returns an ageCrypter using the identity in identityFile
+// (created if it does not exist) and the devices in recipientsFile.
+func newAgeCrypter(identityFile, recipientsFile string) (*ageCrypter, error) {
+	identity, err := loadIdentity(identityFile)
+	if err != nil {
+		return nil, err
+	}
+	return &ageCrypter{identity: identity, recipientsFile: recipientsFile}, nil
+}
+
+// encrypt encrypts the cleartext and topic to all devices in the recipients
+// file (and ourselves). The recipients file is read every time, so changes
+// take effect immediately.
+func (a *ageCrypter) encrypt(cleartext, topic string) (string, error) {
+	if len(topic) > 0xffff {
+		return "", fmt.Errorf("topic too long: %d bytes", len(topic))
+	}
+	devices, err := readRecipients(a.recipientsFile)
+	if err != nil {
+		return "", err
+	}
+	recipients := []age.Recipient{a.identity.Recipient()}
+	for _, d := range devices {
+		recipients = append(recipients, d.recipient)
+	}
+
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, recipients...)
+	if err != nil {
+		return "", fmt.Errorf("error encrypting message: %v", err)
+	}
+	header := binary.BigEndian.AppendUint16([]byte(ageTopicMagic), uint16(len(topic)))
+	if _, err := io.WriteString(w, string(header)+topic+cleartext); err != nil {
+		return "", fmt.Errorf("error encrypting message: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return "", fmt.Errorf("error encrypting message: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// decrypt decrypts the ciphertext with our identity. Messages sealed for
+// another topic are rejected.
+func (a *ageCrypter) decrypt(ciphertext, topic string) (string, error) {
+	c, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("error decoding base64 encrypted text: %v", err)
+	}
+	r, err := age.Decrypt(bytes.NewReader(c), a.identity)
+	if err != nil {
+		var noMatch *age.NoIdentityMatchError
+		if errors.As(err, &noMatch) {
+			return "", errors.New("message not encrypted to this device (add this device to the sender's recipients)")
+		}
+		return "", fmt.Errorf("error decrypting message: %v", err)
+	}
+	cleartext, err := io.ReadAll(io.LimitReader(r, maxDecryptedSize+1))
+	if err != nil {
+		return "", fmt.Errorf("error decrypting message: %v", err)
+	}
+	if len(cleartext) > maxDecryptedSize {
+		return "", fmt.Errorf("decrypted message larger than %d bytes", maxDecryptedSize)
+	}
+	return openAgeTopic(cleartext, topic)
+}
+
+// openAgeTopic checks the topic sealed with the cleartext and returns the
+// message.
+func openAgeTopic(cleartext []byte, topic string) (string, error) {
+	headerLen := len(ageTopicMagic) + 2
+	if len(cleartext) < headerLen || !bytes.HasPrefix(cleartext, []byte(ageTopicMagic)) {
+		return "", errors.New("decrypted message has no topic")
+	}
+	n := int(binary.BigEndian.Uint16(cleartext[len(ageTopicMagic):]))
+	if len(cleartext) < headerLen+n {
+		return "", errors.New("decrypted message too short")
+	}
+	if sealed := string(cleartext[headerLen : headerLen+n]); sealed != topic {
+		return "", fmt.Errorf("message sealed for topic %q, received on %q", sealed, topic)
+	}
+	return string(cleartext[headerLen+n:]), nil
+}
+
+// loadIdentity reads the identity from the file, creating a new identity if
+// the file does not exist.
+func loadIdentity(fname string) (*age.X25519Identity, error) {
+	fname = tildeExpand(fname)
+	if !fileExists(fname) {
+		identity, err := age.GenerateX25519Identity()
+		if err != nil {
+			return nil, fmt.Errorf("error creating identity: %v", err)
+		}
+		if err := os.WriteFile(fname, []byte(identity.String()+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		log.Infof("Created a new device identity at %s", fname)
+		return identity, nil
+	}
+
+	p, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	identity, err := age.ParseX25519Identity(strings.TrimSpace(string(p)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fname, err)
+	}
+	return identity, nil
+}
+
+// readRecipients returns the devices in the recipients file. A missing file
+// is the same as an empty file.
+func readRecipients(fname string) ([]device, error) {
+	f, err := os.Open(tildeExpand(fname))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ret []device
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s, line %d: expected <name> <recipient>", fname, n)
+		}
+		r, err := age.ParseX25519Recipient(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s, line %d: %v", fname, n, err)
+		}
+		ret = append(ret, device{name: fields[0], recipient: r})
+	}
+	return ret, scanner.Err()
+}
+
+// writeRecipients writes the devices to the recipients file.
+func writeRecipients(fname string, devices []device) error {
+	var buf bytes.Buffer
+	for _, d := range devices {
+		fmt.Fprintf(&buf, "%s %s\n", d.name, d.recipient)
+	}
+	return os.WriteFile(tildeExpand(fname), buf.Bytes(), 0600)
+}
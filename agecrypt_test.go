@@ -0,0 +1,76 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// testAgeCrypter returns an ageCrypter with a new identity and the given
+// recipients, in a temporary directory.
+func testAgeCrypter(t *testing.T, recipients ...*ageCrypter) *ageCrypter {
+	t.Helper()
+	dir := t.TempDir()
+	a, err := newAgeCrypter(filepath.Join(dir, identityFile), filepath.Join(dir, recipientsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var devices []device
+	for _, r := range recipients {
+		devices = append(devices, device{name: "peer", recipient: r.identity.Recipient()})
+	}
+	if err := writeRecipients(a.recipientsFile, devices); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestAgeCrypter(t *testing.T) {
+	receiver := testAgeCrypter(t)
+	sender := testAgeCrypter(t, receiver)
+	other := testAgeCrypter(t)
+
+	c, err := sender.encrypt("hello", "topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		crypt *ageCrypter
+		topic string
+		ok    bool
+	}{
+		{"recipient", receiver, "topic", true},
+		{"sender", sender, "topic", true},
+		{"not a recipient", other, "topic", false},
+		{"other topic", receiver, "other", false},
+		{"topic prefix", receiver, "top", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.crypt.decrypt(c, tt.topic)
+			if !tt.ok {
+				if err == nil {
+					t.Errorf("decrypt succeeded: %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decrypt: %v", err)
+			}
+			if got != "hello" {
+				t.Errorf("got %q, want %q", got, "hello")
+			}
+		})
+	}
+}
+
+func TestOpenAgeTopicInvalid(t *testing.T) {
+	for _, s := range []string{"", "CSAT", "CSAT\x00", "CSAT\x00\x06topic", "XXXX\x00\x05topic"} {
+		if got, err := openAgeTopic([]byte(s), "topic"); err == nil {
+			t.Errorf("openAgeTopic(%q) = %q", s, got)
+		}
+	}
+}
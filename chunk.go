@@ -0,0 +1,339 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+// Chunked transfers
+//
+// Messages larger than --max-chunk-size (after compression, before
+// encryption) are split into chunks. Each chunk is encrypted and published
+// (retained) to "<topic>/chunks/<index>", with the format:
+//
+//	magic     4 bytes, "CSYK"
+//	transfer  16 bytes, random transfer ID
+//	index     4 bytes, big-endian chunk index (starting at 0)
+//	count     4 bytes, big-endian number of chunks in the transfer
+//	data      chunk data
+//
+// Once all chunks are sent, a manifest is encrypted and published (retained)
+// to the main topic, with the format:
+//
+//	magic     4 bytes, "CSYM"
+//	transfer  16 bytes, transfer ID
+//	count     4 bytes, big-endian number of chunks in the transfer
+//	length    4 bytes, big-endian length of the reassembled message
+//	hash      32 bytes, SHA-256 of the reassembled message
+//
+// Receivers only use a message once the manifest and all chunks arrived and
+// the hash matches. Incomplete transfers are discarded after chunkTimeout.
+//
+// Chunks are retained so new subscribers (E.g. paste) can reassemble the
+// current message. Publishers keep track of the retained chunk topics (see
+// chunkTracker) and, after sending a message, clear (publish an empty retained
+// message to) the chunk topics not used by it, so chunks of older transfers
+// are not redelivered.
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	chunkMagic    = "CSYK"
+	manifestMagic = "CSYM"
+
+	transferIDLen     = 16
+	chunkHeaderLen    = len(chunkMagic) + transferIDLen + 4 + 4
+	manifestHeaderLen = len(manifestMagic) + transferIDLen + 4 + 4 + sha256.Size
+
+	// Default maximum chunk size, in bytes.
+	defaultMaxChunkSize = 128 * 1024
+
+	// Maximum size of a reassembled message and number of chunks.
+	maxChunkedMessageSize = 64 * 1024 * 1024
+	maxChunks             = 65536
+
+	// Incomplete transfers are discarded after this time.
+	chunkTimeout = 60 * time.Second
+
+	// Retained chunks sent by the server after subscribing are expected
+	// until none arrives for chunkSettleTime, for at most chunkSettleTimeout.
+	chunkSettleTime    = 500 * time.Millisecond
+	chunkSettleTimeout = 5 * time.Second
+)
+
+// errChunkPending indicates that a chunked transfer is not yet complete.
+var errChunkPending = errors.New("waiting for more chunks")
+
+// chunkTopic returns the topic used to publish a given chunk.
+func chunkTopic(topic string, index int) string {
+	return fmt.Sprintf("%s/chunks/%d", topic, index)
+}
+
+// chunkSubscription returns the topic filter matching all chunk topics.
+func chunkSubscription(topic string) string {
+	return topic + "/chunks/#"
+}
+
+// chunkIndex returns the chunk index of a chunk topic, or false if the topic
+// is not a chunk topic for the main topic.
+func chunkIndex(topic, msgtopic string) (int, bool) {
+	s, ok := strings.CutPrefix(msgtopic, topic+"/chunks/")
+	if !ok {
+		return 0, false
+	}
+	index, err := strconv.Atoi(s)
+	if err != nil || index < 0 {
+		return 0, false
+	}
+	return index, true
+}
+
+// chunkTracker keeps track of the chunk topics holding retained chunks, as
+// seen in the subscription to the chunk topics and in our own publications.
+type chunkTracker struct {
+	sync.Mutex
+	topic    string
+	retained map[int]bool
+
+	// Signaled for every chunk topic message observed.
+	seen chan struct{}
+}
+
+// newChunkTracker returns a new chunkTracker for the main topic.
+func newChunkTracker(topic string) *chunkTracker {
+	return &chunkTracker{topic: topic, retained: map[int]bool{}, seen: make(chan struct{}, 1)}
+}
+
+// observe records a message received from the server. Returns true if the
+// message is an empty chunk (a cleared chunk topic), to be ignored.
+func (t *chunkTracker) observe(msg message) bool {
+	index, ok := chunkIndex(t.topic, msg.topic)
+	if !ok {
+		return false
+	}
+	defer func() {
+		select {
+		case t.seen <- struct{}{}:
+		default:
+		}
+	}()
+	t.Lock()
+	defer t.Unlock()
+	if len(msg.payload) == 0 {
+		delete(t.retained, index)
+		return true
+	}
+	t.retained[index] = true
+	return false
+}
+
+// settle waits for the retained chunks delivered after subscribing to the
+// chunk topics: until no chunk arrives for quiet, for at most max. Callers
+// that publish right after subscribing (like copy) must wait, or the old
+// retained chunks won't be known when clearing them.
+func (t *chunkTracker) settle(quiet, max time.Duration) {
+	timeout := time.After(max)
+	for {
+		select {
+		case <-t.seen:
+		case <-time.After(quiet):
+			return
+		case <-timeout:
+			return
+		}
+	}
+}
+
+// clear records that the latest message uses count chunks and clears the
+// retained chunks above those from the server. A nil tracker does nothing.
+func (t *chunkTracker) clear(broker transport, count int) error {
+	if t == nil {
+		return nil
+	}
+	t.Lock()
+	defer t.Unlock()
+	for i := 0; i < count; i++ {
+		t.retained[i] = true
+	}
+	for index := range t.retained {
+		if index < count {
+			continue
+		}
+		if err := broker.publish(chunkTopic(t.topic, index), 1, true, nil); err != nil {
+			return fmt.Errorf("error clearing chunk %d: %v", index, err)
+		}
+		delete(t.retained, index)
+	}
+	return nil
+}
+
+// splitMessage splits the data into chunks of at most maxSize bytes. Returns
+// the chunk frames and the manifest frame.
+func splitMessage(data []byte, maxSize int) ([][]byte, []byte, error) {
+	id := make([]byte, transferIDLen)
+	if _, err := rand.Read(id); err != nil {
+		return nil, nil, fmt.Errorf("error creating transfer ID: %v", err)
+	}
+	count := (len(data) + maxSize - 1) / maxSize
+	if count > maxChunks {
+		return nil, nil, fmt.Errorf("message too large (%d bytes) for chunk size %d", len(data), maxSize)
+	}
+
+	var chunks [][]byte
+	for i := 0; i < count; i++ {
+		end := (i + 1) * maxSize
+		if end > len(data) {
+			end = len(data)
+		}
+		frame := make([]byte, chunkHeaderLen, chunkHeaderLen+end-i*maxSize)
+		copy(frame, chunkMagic)
+		copy(frame[len(chunkMagic):], id)
+		binary.BigEndian.PutUint32(frame[len(chunkMagic)+transferIDLen:], uint32(i))
+		binary.BigEndian.PutUint32(frame[len(chunkMagic)+transferIDLen+4:], uint32(count))
+		chunks = append(chunks, append(frame, data[i*maxSize:end]...))
+	}
+
+	hash := sha256.Sum256(data)
+	manifest := make([]byte, manifestHeaderLen)
+	copy(manifest, manifestMagic)
+	copy(manifest[len(manifestMagic):], id)
+	binary.BigEndian.PutUint32(manifest[len(manifestMagic)+transferIDLen:], uint32(count))
+	binary.BigEndian.PutUint32(manifest[len(manifestMagic)+transferIDLen+4:], uint32(len(data)))
+	copy(manifest[len(manifestMagic)+transferIDLen+8:], hash[:])
+
+	return chunks, manifest, nil
+}
+
+// isChunkFrame returns true if the data is a chunk or a manifest.
+func isChunkFrame(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(chunkMagic)) || bytes.HasPrefix(data, []byte(manifestMagic))
+}
+
+// chunkTransfer holds the state of one incoming chunked transfer.
+type chunkTransfer struct {
+	started time.Time
+	count   uint32
+	chunks  map[uint32][]byte
+	size    int
+
+	// Filled in when the manifest arrives.
+	manifest bool
+	length   uint32
+	hash     []byte
+}
+
+// reassembler collects chunks from incoming transfers and returns the
+// complete messages.
+type reassembler struct {
+	sync.Mutex
+	transfers map[string]*chunkTransfer
+}
+
+// newReassembler returns a new (empty) reassembler.
+func newReassembler() *reassembler {
+	return &reassembler{transfers: map[string]*chunkTransfer{}}
+}
+
+// add adds a chunk or manifest frame to its transfer. Returns the complete
+// message once all chunks and the manifest arrived, or errChunkPending if the
+// transfer is still incomplete.
+func (r *reassembler) add(frame []byte) ([]byte, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.expire()
+
+	isManifest := bytes.HasPrefix(frame, []byte(manifestMagic))
+	headerLen := chunkHeaderLen
+	if isManifest {
+		headerLen = manifestHeaderLen
+	}
+	if len(frame) < headerLen {
+		return nil, errors.New("chunk too short")
+	}
+	id := hex.EncodeToString(frame[4 : 4+transferIDLen])
+	fields := frame[4+transferIDLen:]
+	count := binary.BigEndian.Uint32(fields)
+	if !isManifest {
+		count = binary.BigEndian.Uint32(fields[4:])
+	}
+	if count == 0 || count > maxChunks {
+		return nil, fmt.Errorf("invalid chunk count in transfer %s: %d", id, count)
+	}
+
+	t, ok := r.transfers[id]
+	if !ok {
+		t = &chunkTransfer{started: time.Now(), count: count, chunks: map[uint32][]byte{}}
+		r.transfers[id] = t
+	}
+	if t.count != count {
+		delete(r.transfers, id)
+		return nil, fmt.Errorf("inconsistent chunk count in transfer %s", id)
+	}
+
+	if isManifest {
+		t.manifest = true
+		t.length = binary.BigEndian.Uint32(fields[4:])
+		t.hash = fields[8 : 8+sha256.Size]
+		if t.length > maxChunkedMessageSize {
+			delete(r.transfers, id)
+			return nil, fmt.Errorf("chunked message too large (%d bytes, max %d)", t.length, maxChunkedMessageSize)
+		}
+		log.Debugf("Received manifest for transfer %s: %d chunks, %d bytes", id, t.count, t.length)
+	} else {
+		index := binary.BigEndian.Uint32(fields)
+		if index >= count {
+			return nil, fmt.Errorf("invalid chunk index in transfer %s: %d/%d", id, index, count)
+		}
+		if _, dup := t.chunks[index]; !dup {
+			t.chunks[index] = frame[chunkHeaderLen:]
+			t.size += len(frame) - chunkHeaderLen
+		}
+		if t.size > maxChunkedMessageSize {
+			delete(r.transfers, id)
+			return nil, fmt.Errorf("chunked message too large (more than %d bytes)", maxChunkedMessageSize)
+		}
+		log.Tracef("Received chunk %d/%d of transfer %s", index+1, t.count, id)
+	}
+
+	if !t.manifest || uint32(len(t.chunks)) < t.count {
+		return nil, errChunkPending
+	}
+
+	// Transfer complete: reassemble and verify.
+	delete(r.transfers, id)
+	ret := make([]byte, 0, t.size)
+	for i := uint32(0); i < t.count; i++ {
+		ret = append(ret, t.chunks[i]...)
+	}
+	if uint32(len(ret)) != t.length {
+		return nil, fmt.Errorf("reassembled length mismatch in transfer %s: manifest says %d bytes, got %d", id, t.length, len(ret))
+	}
+	hash := sha256.Sum256(ret)
+	if !bytes.Equal(hash[:], t.hash) {
+		return nil, fmt.Errorf("reassembled message in transfer %s does not match manifest hash", id)
+	}
+	log.Debugf("Transfer %s complete: %d chunks, %d bytes", id, t.count, len(ret))
+	return ret, nil
+}
+
+// expire discards transfers older than chunkTimeout. Must be called with the
+// lock held.
+func (r *reassembler) expire() {
+	for id, t := range r.transfers {
+		if time.Since(t.started) > chunkTimeout {
+			log.Debugf("Discarding incomplete transfer %s (%d/%d chunks received)", id, len(t.chunks), t.count)
+			delete(r.transfers, id)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"testing"
+	"time"
+)
+
+// testMessage returns n bytes of test data.
+func testMessage(n int) []byte {
+	ret := make([]byte, n)
+	for i := range ret {
+		ret[i] = byte(i * 7)
+	}
+	return ret
+}
+
+// feed adds the frames to a reassembler in the given order, returning the
+// reassembled message. The message must complete on the last frame.
+func feed(t *testing.T, r *reassembler, frames [][]byte) []byte {
+	t.Helper()
+	for i, f := range frames {
+		msg, err := r.add(f)
+		if i < len(frames)-1 {
+			if !errors.Is(err, errChunkPending) {
+				t.Fatalf("frame %d: got %v, want errChunkPending", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("last frame: %v", err)
+		}
+		return msg
+	}
+	return nil
+}
+
+func TestSplitMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		maxSize int
+		chunks  int
+	}{
+		{"one byte", 1, 10, 1},
+		{"exact fit", 100, 10, 10},
+		{"partial last chunk", 101, 10, 11},
+		{"single chunk", 10, 100, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := testMessage(tt.size)
+			chunks, manifest, err := splitMessage(data, tt.maxSize)
+			if err != nil {
+				t.Fatalf("splitMessage: %v", err)
+			}
+			if len(chunks) != tt.chunks {
+				t.Errorf("got %d chunks, want %d", len(chunks), tt.chunks)
+			}
+			for i, c := range chunks {
+				if !isChunkFrame(c) || len(c)-chunkHeaderLen > tt.maxSize {
+					t.Errorf("chunk %d: invalid frame (%d bytes)", i, len(c))
+				}
+			}
+			if !isChunkFrame(manifest) || len(manifest) != manifestHeaderLen {
+				t.Errorf("invalid manifest (%d bytes)", len(manifest))
+			}
+		})
+	}
+
+	if _, _, err := splitMessage(testMessage(maxChunks+1), 1); err == nil {
+		t.Error("splitMessage accepted more than maxChunks chunks")
+	}
+}
+
+func TestReassemble(t *testing.T) {
+	data := testMessage(1000)
+	chunks, manifest, err := splitMessage(data, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 4 {
+		t.Fatalf("got %d chunks, want 4", len(chunks))
+	}
+
+	tests := []struct {
+		name   string
+		frames [][]byte
+	}{
+		{"in order", [][]byte{chunks[0], chunks[1], chunks[2], chunks[3], manifest}},
+		{"manifest first", [][]byte{manifest, chunks[0], chunks[1], chunks[2], chunks[3]}},
+		{"out of order", [][]byte{chunks[3], chunks[1], manifest, chunks[0], chunks[2]}},
+		{"duplicates", [][]byte{chunks[0], chunks[0], chunks[2], chunks[1], chunks[2], manifest, chunks[3]}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := feed(t, newReassembler(), tt.frames)
+			if !bytes.Equal(got, data) {
+				t.Errorf("reassembled %d bytes, want %d", len(got), len(data))
+			}
+		})
+	}
+}
+
+func TestReassembleInterleaved(t *testing.T) {
+	a, b := testMessage(500), bytes.Repeat([]byte("b"), 500)
+	achunks, amanifest, err := splitMessage(a, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bchunks, bmanifest, err := splitMessage(b, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := newReassembler()
+	if got := feed(t, r, [][]byte{achunks[0], bchunks[0], achunks[1], bchunks[1], bmanifest, achunks[2], amanifest}); !bytes.Equal(got, a) {
+		t.Error("first transfer mismatch")
+	}
+	if got := feed(t, r, [][]byte{bchunks[2]}); !bytes.Equal(got, b) {
+		t.Error("second transfer mismatch")
+	}
+}
+
+func TestReassembleInvalid(t *testing.T) {
+	data := testMessage(1000)
+	chunks, manifest, err := splitMessage(data, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// tampered returns a copy of frame with the byte at offset flipped.
+	tampered := func(frame []byte, offset int) []byte {
+		ret := append([]byte{}, frame...)
+		ret[offset] ^= 0xff
+		return ret
+	}
+	_, otherManifest, err := splitMessage(testMessage(900), 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Same transfer ID, different hash.
+	wrongHash := append([]byte{}, otherManifest...)
+	copy(wrongHash[len(manifestMagic):], manifest[len(manifestMagic):len(manifestMagic)+transferIDLen])
+
+	tests := []struct {
+		name   string
+		frames [][]byte
+	}{
+		{"tampered chunk data", [][]byte{chunks[0], tampered(chunks[1], chunkHeaderLen), chunks[2], chunks[3], manifest}},
+		{"tampered manifest hash", [][]byte{chunks[0], chunks[1], chunks[2], chunks[3], tampered(manifest, manifestHeaderLen-1)}},
+		{"wrong hash", [][]byte{chunks[0], chunks[1], chunks[2], chunks[3], wrongHash}},
+		{"truncated chunk", [][]byte{chunks[0], chunks[1], chunks[2][:len(chunks[2])-1], chunks[3], manifest}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newReassembler()
+			var err error
+			for _, f := range tt.frames {
+				if _, err = r.add(f); err != nil && !errors.Is(err, errChunkPending) {
+					break
+				}
+			}
+			if err == nil || errors.Is(err, errChunkPending) {
+				t.Errorf("got %v, want an error", err)
+			}
+		})
+	}
+
+	// Frames rejected as soon as they arrive.
+	badIndex := append([]byte{}, chunks[0]...)
+	badIndex[len(chunkMagic)+transferIDLen+3] = 4
+	zeroCount := append([]byte{}, chunks[0]...)
+	zeroCount[len(chunkMagic)+transferIDLen+7] = 0
+	frames := []struct {
+		name  string
+		frame []byte
+	}{
+		{"short chunk", chunks[0][:chunkHeaderLen-1]},
+		{"short manifest", manifest[:manifestHeaderLen-1]},
+		{"index out of range", badIndex},
+		{"zero count", zeroCount},
+	}
+	for _, tt := range frames {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newReassembler().add(tt.frame); err == nil || errors.Is(err, errChunkPending) {
+				t.Errorf("got %v, want an error", err)
+			}
+		})
+	}
+}
+
+func TestChunkTracker(t *testing.T) {
+	tests := []struct {
+		name     string
+		retained []int
+		cleared  []int
+		count    int
+		want     []int
+	}{
+		{"no chunks", nil, nil, 0, nil},
+		{"fewer chunks", []int{0, 1, 2, 3}, nil, 2, []int{2, 3}},
+		{"unchunked message", []int{0, 1}, nil, 0, []int{0, 1}},
+		{"more chunks", []int{0, 1}, nil, 3, nil},
+		{"already cleared", []int{0, 1, 2}, []int{2}, 1, []int{1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := newChunkTracker("topic")
+			for _, i := range tt.retained {
+				if tr.observe(message{topic: chunkTopic("topic", i), payload: []byte("x")}) {
+					t.Errorf("chunk %d reported as cleared", i)
+				}
+			}
+			for _, i := range tt.cleared {
+				if !tr.observe(message{topic: chunkTopic("topic", i)}) {
+					t.Errorf("cleared chunk %d not reported", i)
+				}
+			}
+			if tr.observe(message{topic: "topic", payload: []byte("x")}) {
+				t.Error("main topic reported as cleared chunk")
+			}
+
+			broker := &recordingTransport{}
+			if err := tr.clear(broker, tt.count); err != nil {
+				t.Fatalf("clear: %v", err)
+			}
+			var got []int
+			for _, p := range broker.published {
+				index, ok := chunkIndex("topic", p.topic)
+				if !ok || len(p.payload) != 0 || !p.retained {
+					t.Errorf("unexpected publication: %+v", p)
+				}
+				got = append(got, index)
+			}
+			sort.Ints(got)
+			if !equalInts(got, tt.want) {
+				t.Errorf("cleared %v, want %v", got, tt.want)
+			}
+			for i := 0; i < tt.count; i++ {
+				if !tr.retained[i] {
+					t.Errorf("chunk %d of the new message not tracked", i)
+				}
+			}
+		})
+	}
+}
+
+func TestChunkTrackerSettle(t *testing.T) {
+	tr := newChunkTracker("topic")
+	// Retained chunks arrive some time after subscribing.
+	go func() {
+		for i := 0; i < 5; i++ {
+			time.Sleep(20 * time.Millisecond)
+			tr.observe(message{topic: chunkTopic("topic", i), payload: []byte("x")})
+		}
+	}()
+	tr.settle(200*time.Millisecond, 5*time.Second)
+
+	broker := &recordingTransport{}
+	if err := tr.clear(broker, 1); err != nil {
+		t.Fatalf("clear: %v", err)
+	}
+	if len(broker.published) != 4 {
+		t.Errorf("cleared %d chunks, want 4", len(broker.published))
+	}
+
+	// settle gives up after max, even if chunks keep arriving.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+				tr.observe(message{topic: chunkTopic("topic", i), payload: []byte("x")})
+			}
+		}
+	}()
+	start := time.Now()
+	tr.settle(100*time.Millisecond, 300*time.Millisecond)
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("settle took %v", d)
+	}
+}
+
+// recordingTransport is a transport recording the messages published.
+type recordingTransport struct {
+	published []message
+}
+
+func (t *recordingTransport) publish(topic string, _ byte, retained bool, payload []byte) error {
+	t.published = append(t.published, message{topic: topic, payload: payload, retained: retained})
+	return nil
+}
+
+func (t *recordingTransport) subscribe([]string, byte, func(message)) error { return nil }
+func (t *recordingTransport) connected() bool                               { return true }
+func (t *recordingTransport) close()                                        {}
+
+// equalInts returns true if both slices hold the same numbers.
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -3,38 +3,31 @@
 package main
 
 import (
-	"bytes"
-	"crypto/md5"
-	"encoding/gob"
 	"errors"
 	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/patrickmn/go-cache"
-	log "github.com/romana/rlog"
 )
 
-type delayedPublishChan struct {
-	broker        mqtt.Client
-	topic         string
-	content       string
-	instanceID    string
-	cryptPassword []byte
-}
+// Time to wait for more selection events after the first one, in ms.
+const selectionSettleTime = 100
 
-// Lineformat contains the line format for mqtt messages. All attributes must
-// be exported since this will be serialized into something else before transmission.
-type Lineformat struct {
-	InstanceID string
-	Message    string
-}
-
-// mqttCallback represents the elements from a mqtt.newBroker callback.
-type mqttCallback struct {
-	client mqtt.Client
-	msg    mqtt.Message
+type delayedPublishChan struct {
+	broker     transport
+	cfg        globalConfig
+	content    clipContents
+	instanceID string
+	crypt      crypter
+	sig        *signer
+	state      *clientState
+	retained   *chunkTracker
 }
 
 // Global mutex used across client functions before they access the clipboard.
@@ -43,65 +36,148 @@ var globalMutex sync.Mutex
 
 // clientcmd activates "client" mode, syncing the local clipboard to the server
 // and vice-versa. This function will only return in case of error.
-func clientcmd(cfg globalConfig, clientcfg clientConfig, instanceID string, cryptPassword []byte) error {
-	incoming := make(chan mqttCallback, 10)
+func clientcmd(cfg globalConfig, clientcfg clientConfig, instanceID string, crypt crypter, sig *signer) error {
+	incoming := make(chan message, 10)
 
-	log.Infof("Starting client, server: %s", *cfg.server)
+	log.Infof("Starting client, server: %s, clipboard backend: %s", *cfg.server, *clientcfg.backend)
 
-	xsel := &xselection{}
+	backend, err := newClipboardBackend(*clientcfg.backend)
+	if err != nil {
+		return fmt.Errorf("unable to initialize clipboard backend: %v", err)
+	}
+	xsel := newXSelection(backend, *clientcfg.mimetypes)
 	hashcache := cache.New(24*time.Hour, 24*time.Hour)
+	guard, err := newReplayGuard(filepath.Join(tildeExpand(configDir), replayStateFile), *cfg.replaywindow, *cfg.legacymsgs, localDeviceID)
+	if err != nil {
+		return fmt.Errorf("unable to read replay state: %v", err)
+	}
+	defer guard.flush()
+	go guard.persist()
+
+	broker, err := newTransport(cfg)
+	if err != nil {
+		return fmt.Errorf("unable to connect to broker: %v", err)
+	}
 
-	// subHandler blocks on a buffered channel and newBroker feeds the channel with the
-	// relevant information from the callback. The function called by newBroker cannot
-	// block, or it will deadlock the receipt of messages from MQTT.
-	go subHandler(incoming, xsel, hashcache, *clientcfg.syncsel, instanceID, cryptPassword)
-	broker, err := newBroker(cfg, func(client mqtt.Client, msg mqtt.Message) {
-		incoming <- mqttCallback{
-			client: client,
-			msg:    msg}
+	state := &clientState{}
+	retained := newChunkTracker(*cfg.topic)
+
+	// subHandler blocks on a buffered channel and the subscription feeds the
+	// channel with the messages received. The subscription handler cannot
+	// block, or it will deadlock the receipt of messages from the server.
+	go subHandler(incoming, xsel, hashcache, guard, state, *clientcfg.syncsel, instanceID, crypt, sig)
+	err = broker.subscribe(clientFilters(*cfg.topic), 1, func(msg message) {
+		if retained.observe(msg) {
+			return
+		}
+		incoming <- msg
 	})
+	if err != nil {
+		return fmt.Errorf("unable to subscribe to topic %s: %v", *cfg.topic, err)
+	}
+
+	if *clientcfg.metricslisten != "" {
+		go serveMetrics(*clientcfg.metricslisten, broker)
+	}
 
+	// Control socket, used by copy, paste, pause and resume.
+	display, err := displayName(*clientcfg.backend)
 	if err != nil {
-		return fmt.Errorf("unable to connect to broker: %v", err)
+		return err
+	}
+	socket := controlSocketPath(display)
+	l, err := listenControl(socket)
+	if err != nil {
+		return fmt.Errorf("unable to create control socket: %v", err)
+	}
+	defer os.Remove(socket)
+	defer l.Close()
+
+	// Save the replay state and remove the socket when killed.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		s := <-sigs
+		log.Infof("Received %v, exiting.", s)
+		guard.flush()
+		os.Remove(socket)
+		os.Exit(0)
+	}()
+	log.Debugf("Listening for commands on %s", socket)
+	ctl := &controlServer{
+		broker:     broker,
+		xsel:       xsel,
+		cfg:        cfg,
+		clientcfg:  clientcfg,
+		instanceID: instanceID,
+		crypt:      crypt,
+		sig:        sig,
+		state:      state,
+		retained:   retained,
 	}
+	go ctl.serve(l)
 
 	// Loops forever sending any local clipboard changes to broker.
-	clientloop(broker, xsel, clientcfg, *cfg.topic, instanceID, cryptPassword)
-
-	// This should never happen.
-	return nil
+	return clientloop(broker, xsel, state, retained, cfg, clientcfg, instanceID, crypt, sig)
 }
 
 // subHandler runs as a goroutine and blocks reading on the main channel. Once
 // information is available, it processes the incoming request.
-func subHandler(incoming chan mqttCallback, xsel *xselection, hashcache *cache.Cache, syncsel bool, instanceID string, cryptPassword []byte) {
+func subHandler(incoming chan message, xsel *xselection, hashcache *cache.Cache, guard *replayGuard, state *clientState, syncsel bool, instanceID string, crypt crypter, sig *signer) {
+	chunks := newReassembler()
 	for {
 		log.Debug("subHandler waiting for data")
-		ch := <-incoming
+		msg := <-incoming
+		metricReceived.Inc()
 		log.Debug("==> Received request from server. Waiting to acquire mutex lock.")
 		globalMutex.Lock()
 		log.Debug("Acquired mutex lock.")
 
-		payload := ch.msg.Payload()
-		broker := ch.client
-
+		payload := msg.payload
 		data := string(payload)
+		log.Debug("Received message", "event", "receive", "topic", msg.topic, "size", len(payload), "retained", msg.retained)
 
 		var hash string
 
-		if len(cryptPassword) > 0 {
+		if crypt != nil {
 			// Ignore duplicate encrypted messages as they should never happen.
-			hash = fmt.Sprintf("%x", md5.Sum(payload))
+			hash = dedupeHash(crypt, payload)
 			if _, found := hashcache.Get(hash); found {
-				log.Debugf("Ignoring duplicate encrypted message: %s", data)
+				log.Debug("Ignoring duplicate encrypted message", "event", "drop", "reason", dropDuplicate, "topic", msg.topic)
+				metricDropped.WithLabelValues(dropDuplicate).Inc()
 				globalMutex.Unlock()
 				continue
 			}
 		}
 
-		mqttmsg, err := decodeMQTT(data, cryptPassword)
+		env, err := decodeMQTT(data, msg.topic, crypt, sig, chunks)
 		if err != nil {
-			log.Debug(err)
+			reason := decodeDropReason(err)
+			switch {
+			case reason == "":
+				log.Debug("Waiting for more chunks", "event", "chunk", "topic", msg.topic)
+			case errors.Is(err, errUnknownKey) || errors.Is(err, errUntrusted):
+				log.Warn("Ignoring message", "event", "drop", "reason", reason, "error", err)
+			default:
+				log.Debug("Ignoring message", "event", "drop", "reason", reason, "error", err)
+			}
+			if reason != "" {
+				metricDropped.WithLabelValues(reason).Inc()
+			}
+			globalMutex.Unlock()
+			continue
+		}
+		reportPeerVersion(env)
+
+		// Retained messages we already saw (or that are too old) are
+		// expected on every start, so only warn about live messages.
+		if err := guard.check(env); err != nil {
+			if msg.retained {
+				log.Debug("Ignoring message", "event", "drop", "reason", dropReplay, "sender", env.sender(), "error", err)
+			} else {
+				log.Warn("Ignoring message", "event", "drop", "reason", dropReplay, "sender", env.sender(), "error", err)
+			}
+			metricDropped.WithLabelValues(dropReplay).Inc()
 			globalMutex.Unlock()
 			continue
 		}
@@ -109,43 +185,68 @@ func subHandler(incoming chan mqttCallback, xsel *xselection, hashcache *cache.C
 		// At this point, we know we have a good message, If encryption was
 		// used, save the hash in the cache so we can check for duplicated
 		// encrypted messages later.
-		if len(cryptPassword) > 0 {
+		if crypt != nil {
 			hashcache.Set(hash, true, cache.DefaultExpiration)
 		}
+		if env.InstanceID != instanceID {
+			state.seen(env)
+		}
+
+		if env.isKeyRotation() {
+			log.Debug("Received key rotation", "event", "key_rotation", "sender", env.sender())
+			if keys, ok := crypt.(*keyring); ok {
+				topic := strings.TrimSuffix(msg.topic, "/keys")
+				if err := adoptRotation(env, keys, sig, ciphertextKeyID(data), topic); err != nil {
+					log.Error("Unable to adopt key rotation", "event", "key_rotation", "sender", env.sender(), "error", err)
+				}
+			}
+			globalMutex.Unlock()
+			continue
+		}
+
+		if state.isPaused() {
+			log.Debug("Syncing paused. Ignoring message", "event", "drop", "reason", dropPaused, "sender", env.sender())
+			metricDropped.WithLabelValues(dropPaused).Inc()
+			globalMutex.Unlock()
+			continue
+		}
 
-		xprimary := mqttmsg.Message
-		xclipboard := xsel.getXClipboard("text/plain")
+		xprimary := env.contents()
 		memPrimary := xsel.getMemPrimary()
+		memClipboard := xsel.getMemClipboard()
 
-		if xprimary == "" {
-			log.Debugf("Received zero-length data from server. Ignoring.")
+		if xprimary.empty() {
+			log.Debug("Received zero-length data from server. Ignoring", "event", "drop", "reason", dropEmpty, "sender", env.sender())
+			metricDropped.WithLabelValues(dropEmpty).Inc()
 			globalMutex.Unlock()
 			continue
 		}
 
-		log.Debugf("Received from server [%s]: %s", mqttmsg.InstanceID, redact.redact(xprimary))
-		log.Debugf("Current X primary: %s", redact.redact(xprimary))
-		log.Debugf("Current X mem primary selection: %s", redact.redact(memPrimary))
+		log.Debug("Received clipboard", "event", "receive", "sender", env.sender(), "version", env.version, "seq", env.Sequence, "size", xprimary.size(), "contents", redact.redactContents(xprimary))
+		log.Debugf("Current X mem primary selection: %s", redact.redactContents(memPrimary))
 
 		// Ignore this message if it's an echo from the mqtt server.
-		if mqttmsg.InstanceID == instanceID || xprimary == memPrimary {
-			log.Debugf("Ignoring our own message from mqtt server.")
+		if env.InstanceID == instanceID || xprimary.equal(memPrimary) {
+			log.Debug("Ignoring our own message from server", "event", "drop", "reason", dropOwnEcho, "sender", env.sender())
+			metricDropped.WithLabelValues(dropOwnEcho).Inc()
 			globalMutex.Unlock()
 			continue
 		}
 
 		if err := xsel.setXPrimary(xprimary); err != nil {
-			log.Errorf("Unable to set X Primary selection: %v", err)
+			log.Error("Unable to set selection", "event", "error", "selection", selPrimary, "error", err)
 		}
 		xsel.setMemPrimary(xprimary)
+		state.received(env, xprimary.size())
+		log.Debug("Applied clipboard", "event", "apply", "selection", selPrimary, "sender", env.sender(), "size", xprimary.size(), "contents", redact.redactContents(xprimary))
+		metricPayloadBytes.WithLabelValues("received").Observe(float64(xprimary.size()))
 
 		// Value received from the server is always primary, so we attempt to
 		// sync primary to clipboard, if requested.
-		log.Debugf("New primary value: %s", xprimary)
-		log.Debugf("Current clipboard value: %s", xclipboard)
-		if syncsel && xprimary != xclipboard {
-			if err := syncPrimaryToClip(broker, xsel, xprimary); err != nil {
-				log.Debug(err)
+		log.Debugf("Current mem clipboard value: %s", redact.redactContents(memClipboard))
+		if syncsel && !xprimary.equal(memClipboard) {
+			if err := syncPrimaryToClip(xsel, xprimary); err != nil {
+				log.Debug("Unable to sync selections", "event", "error", "selection", selClipboard, "error", err)
 				globalMutex.Unlock()
 				continue
 			}
@@ -155,36 +256,102 @@ func subHandler(incoming chan mqttCallback, xsel *xselection, hashcache *cache.C
 	}
 }
 
-// decodeMQTT decodes a gob encoded Lineformat object (read from MQTT) and
-// attempts to decrypt it if a cryptPassword was specified. Returns the
-// (unencrypted) Lineformat object.
-func decodeMQTT(data string, cryptPassword []byte) (Lineformat, error) {
+// errEmptyMessage indicates a zero-length message (E.g. a cleared retained
+// message).
+var errEmptyMessage = errors.New("ignoring zero-length message received from broker")
+
+// decryptError indicates that a message could not be decrypted.
+type decryptError struct {
+	err error
+}
+
+func (e *decryptError) Error() string {
+	return "unable to decrypt message: " + e.err.Error()
+}
+
+func (e *decryptError) Unwrap() error {
+	return e.err
+}
+
+// decodeDropReason returns the reason (for metrics) why a message that
+// decodeMQTT failed to decode was dropped, or blank if it was not dropped.
+func decodeDropReason(err error) string {
+	var derr *decryptError
+	switch {
+	case errors.Is(err, errChunkPending):
+		return ""
+	case errors.Is(err, errEmptyMessage):
+		return dropEmpty
+	case errors.As(err, &derr):
+		return dropDecrypt
+	case errors.Is(err, errUntrusted):
+		return dropUntrusted
+	}
+	return dropInvalid
+}
+
+// decodeMQTT decrypts a message (read from MQTT on topic) if a keyring was
+// specified, reassembles chunked messages, decompresses it if needed, and
+// decodes the resulting envelope. Returns errChunkPending if the message is
+// part of a chunked transfer that is not yet complete. Messages in the legacy
+// gob format are also accepted, as are JSON messages when not encrypting.
+func decodeMQTT(data, topic string, crypt crypter, sig *signer, chunks *reassembler) (*Envelope, error) {
 	var err error
 
 	plain := data
-	if len(cryptPassword) > 0 {
-		plain, err = decrypt64(data, cryptPassword)
+	if crypt != nil {
+		plain, err = crypt.decrypt(data, topic)
 		if err != nil {
-			return Lineformat{}, err
+			return nil, &decryptError{err}
 		}
 	}
 	if plain == "" {
-		return Lineformat{}, errors.New("ignoring zero-length message received from broker")
+		return nil, errEmptyMessage
 	}
 
-	// At this point plain contains a gob encoded Lineformat structure.
-	buf := bytes.NewBufferString(plain)
-	dec := gob.NewDecoder(buf)
-	var mqttmsg Lineformat
-	if err = dec.Decode(&mqttmsg); err != nil {
-		return Lineformat{}, fmt.Errorf("error decoding MQTT message: %v", err)
+	msg := []byte(plain)
+	if crypt == nil && isJSON(msg) {
+		// JSON messages are never signed.
+		if _, _, err := sig.verify(msg); err != nil {
+			return nil, err
+		}
+		return unmarshalJSON(msg)
+	}
+	if isChunkFrame(msg) {
+		if msg, err = chunks.add(msg); err != nil {
+			return nil, err
+		}
 	}
-	return mqttmsg, nil
+
+	msg, err = decompress(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, signerName, err := sig.verify(msg)
+	if errors.Is(err, errUntrusted) {
+		// Log the sender claimed by the (untrusted) message.
+		if env, uerr := unmarshalEnvelope(msg); uerr == nil {
+			return nil, fmt.Errorf("%v (claimed sender: %s)", err, env.sender())
+		}
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := unmarshalEnvelope(msg)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding MQTT message: %v", err)
+	}
+	env.signer = signerName
+	return env, nil
 }
 
-// clientloop waits for changes to this X server's primary selection or
+// clientloop waits for changes to this display's primary selection or
 // clipboard and and updates the MQTT server when changes happen. This function
-// never returns.
+// only returns when the stream of selection events from the clipboard backend
+// ends (E.g. the connection to the display server was lost).
 //
 // If chromeQuirk is set, the function restores the primary selection when it
 // contains one of the strings used by chrome to override the clipboard (see
@@ -196,162 +363,261 @@ func decodeMQTT(data string, cryptPassword []byte) (Lineformat, error) {
 // if syncSelections is set, keep both primary and clipboard selections in
 // sync (i.e. setting one will also set the other). Note that the server
 // only handles one version of the clipboard.
-//
-// Note: For now, reading and writing to the clipboard is somewhat of an
-// expensive operation as it requires calling xclip. This will be changed in a
-// future version, which should allow us to simplify this function.
-func clientloop(broker mqtt.Client, xsel *xselection, clientcfg clientConfig, topic, instanceID string, cryptPassword []byte) {
+func clientloop(broker transport, xsel *xselection, state *clientState, retained *chunkTracker, cfg globalConfig, clientcfg clientConfig, instanceID string, crypt crypter, sig *signer) error {
 	dpchan := make(chan delayedPublishChan, 1)
 	go delayedPublish(dpchan)
 
+	events := xsel.events()
+
 	for {
 		// Wait for primary or clipboard change.
 		log.Debug("clientloop waiting for clipboard changes")
-		if cnotify() != 0 {
-			log.Errorf("ClipNotify returned error. Will wait and retry.")
-			time.Sleep(time.Duration(2) * time.Second)
-			globalMutex.Unlock()
-			continue
+		changed, ok := collectEvents(events)
+		if !ok {
+			return errors.New("clipboard backend stopped sending selection events")
+		}
+		for sel, ev := range changed {
+			log.Debug("Selection changed", "event", "selection_change", "selection", sel, "local", ev.local)
+			if !ev.local {
+				metricSelectionChanges.WithLabelValues(sel).Inc()
+			}
 		}
-		// Definitive primary and clipboard values must be taken after the lock.
-		log.Debugf("==> Clipboard event: preliminary primary=%s, clipboard=%s",
-			redact.redact(xsel.getXPrimary("")),
-			redact.redact(xsel.getXClipboard("text/plain")))
 
 		globalMutex.Lock()
+		pub := handleEvents(xsel, clientcfg, changed)
+		switch {
+		case pub.empty():
+		case state.isPaused():
+			log.Debug("Syncing paused. Not publishing", "event", "skip", "reason", dropPaused, "size", pub.size())
+		default:
+			log.Debug("Queueing clipboard for publication", "event", "queue", "size", pub.size(), "contents", redact.redactContents(pub))
+			// Delay publication until clipboard settles since large
+			// selections would cause an excessive number of publications.
+			dpchan <- delayedPublishChan{
+				broker:     broker,
+				cfg:        cfg,
+				content:    pub,
+				instanceID: instanceID,
+				crypt:      crypt,
+				sig:        sig,
+				state:      state,
+				retained:   retained,
+			}
+		}
+		log.Debug("clientloop finished work")
+		globalMutex.Unlock()
+	}
+}
 
-		xprimary := xsel.getXPrimary("")
-		xclipboard := xsel.getXClipboard("text/plain")
-		memPrimary := xsel.getMemPrimary()
-		memClipboard := xsel.getMemClipboard()
+// collectEvents blocks until a selection event arrives and then gathers any
+// other events arriving within selectionSettleTime. Programs usually set
+// both selections at once, and we want to see them as a single change.
+// Returns the latest event for each selection that changed and false if the
+// events channel was closed.
+func collectEvents(events <-chan selectionEvent) (map[string]selectionEvent, bool) {
+	changed := map[string]selectionEvent{}
+
+	ev, ok := <-events
+	if !ok {
+		return nil, false
+	}
+	changed[ev.selection] = ev
 
-		primaryChanged := (xprimary != memPrimary)
-		clipboardChanged := (xclipboard != memClipboard)
+	timeout := time.After(selectionSettleTime * time.Millisecond)
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return nil, false
+			}
+			changed[ev.selection] = ev
+		case <-timeout:
+			return changed, true
+		}
+	}
+}
 
-		log.Debugf("Acquired mutex lock: primary=%s, clipboard=%s", redact.redact(xprimary), redact.redact(xclipboard))
+// handleEvents processes one batch of selection changes, syncing primary and
+// clipboard if requested. Only the selections that changed are read. Returns
+// the string to be published (or blank if nothing should be published). Must
+// be called with globalMutex held.
+func handleEvents(xsel *xselection, clientcfg clientConfig, changed map[string]selectionEvent) clipContents {
+	memPrimary := xsel.getMemPrimary()
+	memClipboard := xsel.getMemClipboard()
 
-		// Do nothing on xclip error/empty clipboard.
-		if xprimary == "" {
-			log.Debug("Received event, but primary is empty. Doing nothing")
-			globalMutex.Unlock()
-			continue
-		}
+	var xprimary, xclipboard clipContents
 
-		// Don't try to sync the clipboard if both the primary and clipboard
-		// changed. This means we have a program that changed both, sometimes
-		// with different mime-types on the clipboard. E.g: Google sheets on
-		// chrome. In this case, just set memPrimary and memClipboard and
-		// set primary for publication.
-		if primaryChanged && clipboardChanged {
-			log.Debug("Both primary and clipboard changed. Will not attempt to sync.")
-			xsel.setMemPrimary(xprimary)
-			xsel.setMemClipboard(xclipboard)
+	// Changes made by ourselves (from the server or syncing selections)
+	// don't need to be read back.
+	prim, primaryChanged := changed[selPrimary]
+	if primaryChanged && !prim.local {
+		xprimary = xsel.getXPrimary()
+		log.Debug("Read selection", "event", "selection_read", "selection", selPrimary, "owner", fmt.Sprintf("0x%x", prim.owner), "timestamp", prim.timestamp, "size", xprimary.size(), "contents", redact.redactContents(xprimary))
+	}
+	clip, clipboardChanged := changed[selClipboard]
+	if clipboardChanged && !clip.local {
+		xclipboard = xsel.getXClipboard()
+		log.Debug("Read selection", "event", "selection_read", "selection", selClipboard, "owner", fmt.Sprintf("0x%x", clip.owner), "timestamp", clip.timestamp, "size", xclipboard.size(), "contents", redact.redactContents(xclipboard))
+	}
 
-			dpchan <- delayedPublishChan{
-				broker:        broker,
-				topic:         topic,
-				content:       xprimary,
-				instanceID:    instanceID,
-				cryptPassword: cryptPassword,
-			}
-			globalMutex.Unlock()
-			continue
-		}
+	// Do nothing on read error, empty, or unchanged selections.
+	primaryChanged = !xprimary.empty() && !xprimary.equal(memPrimary)
+	clipboardChanged = !xclipboard.empty() && !xclipboard.equal(memClipboard)
+
+	if !primaryChanged && !clipboardChanged {
+		log.Debug("Received event, but no selections changed. Doing nothing", "event", "skip", "reason", "unchanged")
+		return nil
+	}
 
-		// Restore the memory clipboard if:
+	// Don't try to sync the clipboard if both the primary and clipboard were
+	// set by the same owner. This means we have a program that changed both,
+	// sometimes with different mime-types on the clipboard. E.g: Google
+	// sheets on chrome. In this case, just set memPrimary and memClipboard
+	// and set primary for publication.
+	if primaryChanged && clipboardChanged && prim.owner == clip.owner {
+		log.Debug("Primary and clipboard set by the same owner. Will not attempt to sync", "event", "skip_sync", "reason", "same_owner")
+		xsel.setMemPrimary(xprimary)
+		xsel.setMemClipboard(xclipboard)
+		return xprimary
+	}
+
+	var pub clipContents
+
+	if primaryChanged {
+		// Restore the memory primary if:
 		// 1) chromeQuirk is set and...
-		// 2) The X clipboard contains a single character in a list of characters and...
-		// 3) memClipboard does NOT contain a single unicode character (avoid loops).
-		if *clientcfg.chromequirk && isQuirk(xprimary) && !isQuirk(memPrimary) {
-			log.Debugf("Chrome quirk detected. Restoring primary to %s", redact.redact(memPrimary))
-			xprimary = memPrimary
+		// 2) The X primary contains a single character in a list of characters and...
+		// 3) memPrimary does NOT contain a single unicode character (avoid loops).
+		if *clientcfg.chromequirk && isQuirk(xprimary.text()) && !isQuirk(memPrimary.text()) {
+			log.Debug("Chrome quirk detected. Restoring primary", "event", "skip", "reason", "chrome_quirk", "selection", selPrimary, "contents", redact.redactContents(memPrimary))
 			if err := xsel.setXPrimary(memPrimary); err != nil {
 				log.Errorf("Cannot write to primary selection: %v", err)
 			}
+			return nil
 		}
 
-		// Only attempt to publish if xprimary changed and is not blank (initially).
-		// There's logic below to see if xprimary was set to the clipboard, if
-		// clipboard sync was requested.
-		var pub string
-		if xprimary != "" && primaryChanged {
-			log.Debugf("X Primary changed: New=%s, old=%s", redact.redact(xprimary), redact.redact(memPrimary))
-			pub = xprimary
-		}
-
-		// xprimary <--> clipboard synchronization.
-		if *clientcfg.syncsel {
-			// Conditions for syncing primary to clipboard and vice-versa.
-			// Only consider clipboard -> primary if primary -> clipboard is
-			// not happening.
-			needPrimarySync := primaryChanged && xprimary != "" && xprimary != memClipboard
-			needClipboardSync := !needPrimarySync && clipboardChanged && xclipboard != "" && xclipboard != memPrimary
-
-			if needPrimarySync {
-				err := syncPrimaryToClip(broker, xsel, xprimary)
-				if err != nil {
-					log.Errorf("Error syncing primary to clipboard: %v", err)
-				}
-			}
+		log.Debug("Selection changed", "event", "selection_update", "selection", selPrimary, "size", xprimary.size(), "contents", redact.redactContents(xprimary), "old", redact.redactContents(memPrimary))
+		xsel.setMemPrimary(xprimary)
+		pub = xprimary
 
-			if needClipboardSync {
-				err := syncClipToPrimary(broker, xsel, xclipboard)
-				if err != nil {
-					log.Errorf("Error syncing clipboard to primary: %v", err)
-				}
-				// We synced clipboard to primary, so we have a new primary to publish.
-				pub = xclipboard
+		if *clientcfg.syncsel && !xprimary.equal(memClipboard) {
+			if err := syncPrimaryToClip(xsel, xprimary); err != nil {
+				log.Errorf("Error syncing primary to clipboard: %v", err)
 			}
 		}
+	}
 
-		// Publish if needed. Delay publication until clipboard settles since
-		// large selections would cause an excessive number of publications.
-		if pub != "" {
-			dpchan <- delayedPublishChan{
-				broker:        broker,
-				topic:         topic,
-				content:       pub,
-				instanceID:    instanceID,
-				cryptPassword: cryptPassword,
+	// Only consider clipboard -> primary if primary -> clipboard is not
+	// happening.
+	if clipboardChanged && pub == nil {
+		log.Debug("Selection changed", "event", "selection_update", "selection", selClipboard, "size", xclipboard.size(), "contents", redact.redactContents(xclipboard), "old", redact.redactContents(memClipboard))
+		xsel.setMemClipboard(xclipboard)
+
+		if *clientcfg.syncsel && !xclipboard.equal(memPrimary) {
+			if err := syncClipToPrimary(xsel, xclipboard); err != nil {
+				log.Errorf("Error syncing clipboard to primary: %v", err)
 			}
+			// We synced clipboard to primary, so we have a new primary to publish.
+			pub = xclipboard
 		}
-		log.Debug("clientloop finished work")
-		globalMutex.Unlock()
 	}
+	return pub
 }
 
-// publish forms a Lineformat message using the instanceID and string, and
-// publishes it to the desired topic. This message does not return errors,
-// but logs them using log.Debugf().
-func publish(broker mqtt.Client, topic, s, instanceID string, cryptPassword []byte) {
+// publish wraps the contents in an envelope identifying this instance and
+// device, and publishes it to the configured topic. Messages larger than the
+// maximum chunk size are split into chunks (see chunk.go), and chunks of older
+// transfers known to retained (if not nil) are cleared. If progress is not
+// nil, it is called after each chunk is sent.
+func publish(broker transport, cfg globalConfig, c clipContents, instanceID string, crypt crypter, sig *signer, retained *chunkTracker, progress func(sent, total int)) error {
 	// Set in-memory primary selection and publish to server.
-	log.Debugf("Publishing primary selection [%s]: %s", instanceID, redact.redact(s))
+	log.Debug("Publishing clipboard", "event", "publish", "sender", instanceID, "size", c.size(), "contents", redact.redactContents(c))
+
+	if err := publishContents(broker, cfg, c, instanceID, crypt, sig, retained, progress); err != nil {
+		metricPublishErrors.Inc()
+		return err
+	}
+	metricPublished.Inc()
+	metricPayloadBytes.WithLabelValues("sent").Observe(float64(c.size()))
+	return nil
+}
+
+// publishContents encodes the clipboard contents and publishes them, split in
+// chunks if needed.
+func publishContents(broker transport, cfg globalConfig, c clipContents, instanceID string, crypt crypter, sig *signer, retained *chunkTracker, progress func(sent, total int)) error {
+
+	// Unencrypted messages are sent as plain JSON (never chunked).
+	if crypt == nil {
+		data, err := newEnvelope(instanceID, *cfg.device, c).marshalJSON()
+		if err != nil {
+			return err
+		}
+		if err := publishMessage(broker, *cfg.topic, 0, data, nil); err != nil {
+			return err
+		}
+		return retained.clear(broker, 0)
+	}
+
+	data, err := newEnvelope(instanceID, *cfg.device, c).marshal()
+	if err != nil {
+		return err
+	}
+	data = sig.sign(data)
+
+	if *cfg.compress {
+		if data, err = compress(data); err != nil {
+			return err
+		}
+		if isCompressed(data) {
+			log.Debugf("Compressed message from %d to %d bytes", c.size(), len(data))
+		}
+	}
 
-	// Encode message and instance ID.
-	var buf bytes.Buffer
-	mqttmsg := Lineformat{
-		InstanceID: instanceID,
-		Message:    s,
+	if *cfg.maxchunk <= 0 || len(data) <= *cfg.maxchunk {
+		if err := publishMessage(broker, *cfg.topic, 0, data, crypt); err != nil {
+			return err
+		}
+		return retained.clear(broker, 0)
 	}
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(mqttmsg)
+
+	chunks, manifest, err := splitMessage(data, *cfg.maxchunk)
 	if err != nil {
-		log.Error(err)
-		return
+		return err
 	}
+	log.Debugf("Sending %d bytes in %d chunks", len(data), len(chunks))
+	sent := 0
+	for i, chunk := range chunks {
+		if err := publishMessage(broker, chunkTopic(*cfg.topic, i), 1, chunk, crypt); err != nil {
+			return fmt.Errorf("error sending chunk %d/%d: %v", i+1, len(chunks), err)
+		}
+		sent += len(chunk) - chunkHeaderLen
+		if progress != nil {
+			progress(sent, len(data))
+		}
+	}
+	if err := publishMessage(broker, *cfg.topic, 1, manifest, crypt); err != nil {
+		return err
+	}
+	return retained.clear(broker, len(chunks))
+}
 
-	var cryptdata string
-	if len(cryptPassword) > 0 {
-		cryptdata, err = encrypt64(buf.String(), cryptPassword)
+// publishMessage encrypts the data (unless crypt is nil) and publishes it
+// (retained) to the topic.
+func publishMessage(broker transport, topic string, qos byte, data []byte, crypt crypter) error {
+	var err error
+
+	cryptdata := string(data)
+	if crypt != nil {
+		cryptdata, err = crypt.encrypt(string(data), topic)
 		if err != nil {
-			log.Error(err)
-			return
+			return err
 		}
 	}
 
-	if token := broker.Publish(topic, 0, true, cryptdata); token.Wait() && token.Error() != nil {
-		log.Errorf("Error publishing to server: %v", token.Error())
+	if err := broker.publish(topic, qos, true, []byte(cryptdata)); err != nil {
+		return fmt.Errorf("error publishing to server: %v", err)
 	}
+	return nil
 }
 
 // delayedPublish runs as a goroutine and takes a channel of type
@@ -367,18 +633,25 @@ func delayedPublish(ch chan delayedPublishChan) {
 		// Save information locally when receiving from channel.
 		case c := <-ch:
 			dp = delayedPublishChan{
-				broker:        c.broker,
-				topic:         c.topic,
-				content:       c.content,
-				instanceID:    c.instanceID,
-				cryptPassword: c.cryptPassword,
+				broker:     c.broker,
+				cfg:        c.cfg,
+				content:    c.content,
+				instanceID: c.instanceID,
+				crypt:      c.crypt,
+				sig:        c.sig,
+				state:      c.state,
+				retained:   c.retained,
 			}
 			continue
 
 		case <-time.After(1 * time.Second):
 			// Safeguard: Only publish if some content is available.
-			if dp.content != "" {
-				publish(dp.broker, dp.topic, dp.content, dp.instanceID, dp.cryptPassword)
+			if !dp.content.empty() {
+				if err := publish(dp.broker, dp.cfg, dp.content, dp.instanceID, dp.crypt, dp.sig, dp.retained, nil); err != nil {
+					log.Error("Unable to publish clipboard", "event", "publish_error", "size", dp.content.size(), "error", err)
+				} else {
+					dp.state.sent(dp.content.size())
+				}
 				dp = delayedPublishChan{}
 			}
 		}
@@ -386,21 +659,21 @@ func delayedPublish(ch chan delayedPublishChan) {
 }
 
 // syncPrimaryToClip synchronizes the primary selection to the clipboard.
-func syncPrimaryToClip(pbroker mqtt.Client, xsel *xselection, xprimary string) error {
+func syncPrimaryToClip(xsel *xselection, xprimary clipContents) error {
 	memPrimary := xsel.getMemPrimary()
 	memClipboard := xsel.getMemClipboard()
 
-	log.Tracef(1, "X primary: %s", redact.redact(xprimary))
-	log.Tracef(1, "Memory primary: %s", redact.redact(memPrimary))
-	log.Tracef(1, "Memory clipboard: %s", redact.redact(memClipboard))
+	log.Tracef("X primary: %s", redact.redactContents(xprimary))
+	log.Tracef("Memory primary: %s", redact.redactContents(memPrimary))
+	log.Tracef("Memory clipboard: %s", redact.redactContents(memClipboard))
 
-	log.Debugf("Setting X clipboard = X primary: %s", redact.redact(xprimary))
+	log.Debugf("Setting X clipboard = X primary: %s", redact.redactContents(xprimary))
 	if err := xsel.setXClipboard(xprimary); err != nil {
 		return err
 	}
 
-	log.Tracef(1, "Setting mem clipboard = X primary: %s", redact.redact(xprimary))
-	log.Tracef(1, "Setting mem primary = X primary: %s", redact.redact(xprimary))
+	log.Tracef("Setting mem clipboard = X primary: %s", redact.redactContents(xprimary))
+	log.Tracef("Setting mem primary = X primary: %s", redact.redactContents(xprimary))
 	xsel.setMemClipboard(xprimary)
 	xsel.setMemPrimary(xprimary)
 
@@ -408,21 +681,21 @@ func syncPrimaryToClip(pbroker mqtt.Client, xsel *xselection, xprimary string) e
 }
 
 // syncClipToPrimary synchronizes the clipboard to the primary selection.
-func syncClipToPrimary(pbroker mqtt.Client, xsel *xselection, xclipboard string) error {
+func syncClipToPrimary(xsel *xselection, xclipboard clipContents) error {
 	memPrimary := xsel.getMemPrimary()
 	memClipboard := xsel.getMemClipboard()
 
-	log.Tracef(1, "X clipboard: %s", redact.redact(xclipboard))
-	log.Tracef(1, "Memory primary: %s", redact.redact(memPrimary))
-	log.Tracef(1, "Memory clipboard: %s", redact.redact(memClipboard))
+	log.Tracef("X clipboard: %s", redact.redactContents(xclipboard))
+	log.Tracef("Memory primary: %s", redact.redactContents(memPrimary))
+	log.Tracef("Memory clipboard: %s", redact.redactContents(memClipboard))
 
-	log.Debugf("Setting X primary = X clipboard: %s", redact.redact(xclipboard))
+	log.Debugf("Setting X primary = X clipboard: %s", redact.redactContents(xclipboard))
 	if err := xsel.setXPrimary(xclipboard); err != nil {
 		return err
 	}
 
-	log.Tracef(1, "Setting mem primary = X clipboard: %s", redact.redact(xclipboard))
-	log.Tracef(1, "Setting mem clipboard = X clipboard: %s", redact.redact(xclipboard))
+	log.Tracef("Setting mem primary = X clipboard: %s", redact.redactContents(xclipboard))
+	log.Tracef("Setting mem clipboard = X clipboard: %s", redact.redactContents(xclipboard))
 	xsel.setMemPrimary(xclipboard)
 	xsel.setMemClipboard(xclipboard)
 
@@ -0,0 +1,134 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+const (
+	// Clipboard backend names.
+	backendAuto    = "auto"
+	backendX11     = "x11"
+	backendWayland = "wayland"
+
+	// Number of selection events buffered by the backends.
+	selectionEventBuffer = 32
+)
+
+// errNoSelection is returned by getSelection when the selection is empty or
+// cannot be converted to the requested type.
+var errNoSelection = errors.New("selection is empty or unavailable in the requested format")
+
+// clipboardBackend is the interface implemented by all clipboard backends.
+// Selections are identified by selPrimary and selClipboard.
+type clipboardBackend interface {
+	// getSelection returns the contents of the chosen selection in the
+	// requested mime type. A blank mimetype or mimeTextPlain accept any of
+	// the plain text types. Returns errNoSelection if the selection is empty
+	// or not available in the requested mime type.
+	getSelection(sel, mimetype string) ([]byte, error)
+
+	// targets returns the list of mime types (or X11 targets) offered by the
+	// owner of the chosen selection.
+	targets(sel string) ([]string, error)
+
+	// setSelection sets the contents of the chosen selection, offering all
+	// the mime types in contents.
+	setSelection(sel string, contents clipContents) error
+
+	// events returns a channel that receives one selectionEvent every time
+	// the primary selection or the clipboard change. The channel is closed
+	// if the backend loses its connection to the display server.
+	events() <-chan selectionEvent
+}
+
+// selectionEvent describes a change of owner of one of the selections.
+type selectionEvent struct {
+	// Selection that changed (selPrimary or selClipboard).
+	selection string
+	// Window owning the selection (X11), or zero if unknown.
+	owner uint32
+	// Time when the owner acquired the selection, in X server time (X11),
+	// or zero if unknown.
+	timestamp uint32
+	// True if the change was caused by this program setting the selection.
+	local bool
+}
+
+// detectBackend returns the name of the clipboard backend to use. If name is
+// backendAuto, the backend is chosen based on the WAYLAND_DISPLAY and DISPLAY
+// environment variables (in this order).
+func detectBackend(name string) (string, error) {
+	if name != backendAuto && name != "" {
+		return name, nil
+	}
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		return backendWayland, nil
+	}
+	if os.Getenv("DISPLAY") != "" {
+		return backendX11, nil
+	}
+	return "", errors.New("client mode requires the WAYLAND_DISPLAY or DISPLAY variable to be set")
+}
+
+// newClipboardBackend returns a new clipboard backend of the given type.
+func newClipboardBackend(name string) (clipboardBackend, error) {
+	switch name {
+	case backendX11:
+		x, err := newX11Backend()
+		if err != nil {
+			return nil, err
+		}
+		return x, nil
+	case backendWayland:
+		w, err := newWaylandBackend()
+		if err != nil {
+			return nil, err
+		}
+		return w, nil
+	}
+	return nil, fmt.Errorf("unknown clipboard backend: %s", name)
+}
+
+// displayName returns a short name for the display used by the chosen
+// backend, suitable for use in lockfile names. For X11 this is the display
+// number (E.g. "0" for DISPLAY=":0.0") and for Wayland the basename of the
+// socket (E.g. "wayland-0").
+func displayName(backend string) (string, error) {
+	switch backend {
+	case backendX11:
+		display := os.Getenv("DISPLAY")
+		if display == "" {
+			return "", errors.New("X11 backend requires the DISPLAY variable to be set")
+		}
+		re := regexp.MustCompile(`:[0-9]+`)
+		match := re.FindString(display)
+		if match == "" {
+			return "", fmt.Errorf("unable to parse display number from DISPLAY environment var: %s", display)
+		}
+		return match[1:], nil
+
+	case backendWayland:
+		// Sanitize the name since it could be a full path to the socket.
+		re := regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+		return re.ReplaceAllString(filepath.Base(waylandSocket()), "_"), nil
+	}
+	return "", fmt.Errorf("unknown clipboard backend: %s", backend)
+}
+
+// sendSelectionEvent sends a selection event to the channel without blocking.
+// The backends call this from their event loops, which must never block
+// waiting for the client (the client may be waiting on them.)
+func sendSelectionEvent(ch chan selectionEvent, ev selectionEvent) {
+	select {
+	case ch <- ev:
+	default:
+		log.Debugf("Selection event buffer full. Dropping event for %s", ev.selection)
+	}
+}
@@ -0,0 +1,108 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+// Compressed messages
+//
+// Compression is applied to the encoded envelope (before encryption). A
+// compressed message has the format:
+//
+//	magic      4 bytes, "CSYZ"
+//	algorithm  1 byte, compression algorithm (1 = gzip)
+//	length     4 bytes, big-endian length of the uncompressed data
+//	data       compressed data
+//
+// Receivers always accept compressed messages, regardless of --compress.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	compressMagic = "CSYZ"
+
+	// Compression algorithms.
+	compressGzip = 1
+
+	// Size of the compressed message header (magic + algorithm + length).
+	compressHeaderLen = len(compressMagic) + 1 + 4
+
+	// Messages smaller than this are not worth compressing.
+	compressThreshold = 1024
+
+	// Maximum size of decompressed data. Protects against decompression bombs.
+	maxDecompressedSize = 64 * 1024 * 1024
+)
+
+// compress returns a compressed message with the given data. The data is
+// returned unchanged if it's smaller than compressThreshold or compression
+// doesn't make it any smaller (E.g. PNG images.)
+func compress(data []byte) ([]byte, error) {
+	if len(data) < compressThreshold {
+		return data, nil
+	}
+
+	buf := bytes.NewBuffer(make([]byte, compressHeaderLen))
+	w := gzip.NewWriter(buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, fmt.Errorf("error compressing message: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("error compressing message: %v", err)
+	}
+	if buf.Len() >= len(data) {
+		return data, nil
+	}
+
+	ret := buf.Bytes()
+	copy(ret, compressMagic)
+	ret[len(compressMagic)] = compressGzip
+	binary.BigEndian.PutUint32(ret[len(compressMagic)+1:], uint32(len(data)))
+	return ret, nil
+}
+
+// isCompressed returns true if the data is a compressed message.
+func isCompressed(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(compressMagic))
+}
+
+// decompress returns the uncompressed contents of a compressed message. Data
+// that is not compressed is returned unchanged.
+func decompress(data []byte) ([]byte, error) {
+	if !isCompressed(data) {
+		return data, nil
+	}
+	if len(data) < compressHeaderLen {
+		return nil, errors.New("compressed message too short")
+	}
+	algorithm := data[len(compressMagic)]
+	if algorithm != compressGzip {
+		return nil, fmt.Errorf("unknown compression algorithm %d. Please upgrade clipsync", algorithm)
+	}
+	length := binary.BigEndian.Uint32(data[len(compressMagic)+1:])
+	if length > maxDecompressedSize {
+		return nil, fmt.Errorf("decompressed message would be too large (%d bytes, max %d)", length, maxDecompressedSize)
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(data[compressHeaderLen:]))
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing message: %v", err)
+	}
+	defer r.Close()
+
+	// Don't trust the length in the header: read at most one byte past it.
+	ret, err := io.ReadAll(io.LimitReader(r, int64(length)+1))
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing message: %v", err)
+	}
+	if uint32(len(ret)) != length {
+		return nil, fmt.Errorf("decompressed length mismatch: header says %d bytes, got %d", length, len(ret))
+	}
+	return ret, nil
+}
@@ -0,0 +1,99 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	random := make([]byte, 4096)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		data       []byte
+		compressed bool
+	}{
+		{"empty", nil, false},
+		{"below threshold", bytes.Repeat([]byte("a"), compressThreshold-1), false},
+		{"at threshold", bytes.Repeat([]byte("a"), compressThreshold), true},
+		{"large text", bytes.Repeat([]byte("hello, world "), 10000), true},
+		{"incompressible", random, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := compress(tt.data)
+			if err != nil {
+				t.Fatalf("compress: %v", err)
+			}
+			if isCompressed(c) != tt.compressed {
+				t.Errorf("isCompressed = %v, want %v", isCompressed(c), tt.compressed)
+			}
+			if tt.compressed {
+				if c[len(compressMagic)] != compressGzip {
+					t.Errorf("algorithm = %d, want %d", c[len(compressMagic)], compressGzip)
+				}
+				if n := binary.BigEndian.Uint32(c[len(compressMagic)+1:]); n != uint32(len(tt.data)) {
+					t.Errorf("header length = %d, want %d", n, len(tt.data))
+				}
+				if len(c) >= len(tt.data) {
+					t.Errorf("compressed to %d bytes, from %d", len(c), len(tt.data))
+				}
+			}
+			got, err := decompress(c)
+			if err != nil {
+				t.Fatalf("decompress: %v", err)
+			}
+			if !bytes.Equal(got, tt.data) {
+				t.Errorf("round trip mismatch: got %d bytes, want %d", len(got), len(tt.data))
+			}
+		})
+	}
+}
+
+func TestDecompressInvalid(t *testing.T) {
+	c, err := compress(bytes.Repeat([]byte("hello, world "), 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// withByte returns a copy of c with the byte at offset changed.
+	withByte := func(offset int, b byte) []byte {
+		ret := append([]byte{}, c...)
+		ret[offset] = b
+		return ret
+	}
+	// withLength returns a copy of c with a different length in the header.
+	withLength := func(n uint32) []byte {
+		ret := append([]byte{}, c...)
+		binary.BigEndian.PutUint32(ret[len(compressMagic)+1:], n)
+		return ret
+	}
+	length := binary.BigEndian.Uint32(c[len(compressMagic)+1:])
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"header only", c[:compressHeaderLen-1]},
+		{"truncated", c[:len(c)/2]},
+		{"unknown algorithm", withByte(len(compressMagic), 2)},
+		{"corrupted data", withByte(compressHeaderLen+len(c[compressHeaderLen:])/2, 0xff)},
+		{"length too short", withLength(length - 1)},
+		{"length too long", withLength(length + 1)},
+		{"too large", withLength(maxDecompressedSize + 1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decompress(tt.data); err == nil {
+				t.Error("decompress succeeded")
+			}
+		})
+	}
+}
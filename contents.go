@@ -0,0 +1,100 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+import (
+	"bytes"
+	"sort"
+)
+
+// Canonical mime type for text contents.
+const mimeTextPlain = "text/plain"
+
+// Mime types synchronized by default, in order of preference.
+var defaultMimeTypes = []string{mimeTextPlain, "text/html", "text/uri-list", "image/png"}
+
+// Mime types (and X11 targets) used for plain text, in order of preference.
+// Text contents are always stored as mimeTextPlain internally.
+var textMimeTypes = []string{
+	"text/plain;charset=utf-8",
+	"text/plain",
+	"UTF8_STRING",
+	"STRING",
+	"TEXT",
+}
+
+// clipContents holds the contents of a selection in one or more mime types,
+// indexed by mime type.
+type clipContents map[string][]byte
+
+// textContents returns a clipContents holding only the given text. Returns
+// nil for an empty string.
+func textContents(s string) clipContents {
+	if s == "" {
+		return nil
+	}
+	return clipContents{mimeTextPlain: []byte(s)}
+}
+
+// isTextMimeType returns true if the mime type is one of the plain text types.
+func isTextMimeType(mimetype string) bool {
+	return stringInSlice(mimetype, textMimeTypes)
+}
+
+// canonicalMimeType returns mimeTextPlain for any of the plain text types, or
+// the mime type unchanged.
+func canonicalMimeType(mimetype string) string {
+	if isTextMimeType(mimetype) {
+		return mimeTextPlain
+	}
+	return mimetype
+}
+
+// text returns the plain text contents, if any.
+func (c clipContents) text() string {
+	return string(c[mimeTextPlain])
+}
+
+// empty returns true if there is no data for any mime type.
+func (c clipContents) empty() bool {
+	for _, v := range c {
+		if len(v) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// size returns the total size of the contents in all mime types.
+func (c clipContents) size() int {
+	n := 0
+	for _, v := range c {
+		n += len(v)
+	}
+	return n
+}
+
+// types returns a sorted list of the mime types in the contents.
+func (c clipContents) types() []string {
+	var ret []string
+	for k := range c {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// equal returns true if both contents hold the same data for the same types.
+func (c clipContents) equal(o clipContents) bool {
+	if len(c) != len(o) {
+		return false
+	}
+	for k, v := range c {
+		ov, ok := o[k]
+		if !ok || !bytes.Equal(v, ov) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,445 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+// Control socket
+//
+// The client listens on a Unix socket (see controlSocketPath) for requests
+// from other clipsync commands, so "copy" and "paste" can reuse its
+// connection to the server (and its keys). The socket can also be forwarded
+// to remote hosts with ssh, so they need no keys at all (see sshconfigcmd).
+// Each connection carries a single request and response, as one line of JSON
+// each:
+//
+//	{"op": "copy", "type": "text/plain", "data": "<base64>"}
+//	{"ok": true, "error": "...", "type": "...", "data": "<base64>", "status": {...}}
+//
+// Operations:
+//
+//	copy    publish data (and set the local clipboard), fails while paused
+//	paste   return the current clipboard in the requested type, fails while paused
+//	status  return the client status
+//	pause   stop syncing (key rotations are still adopted)
+//	resume  resume syncing
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Control operations.
+const (
+	controlCopy   = "copy"
+	controlPaste  = "paste"
+	controlStatus = "status"
+	controlPause  = "pause"
+	controlResume = "resume"
+)
+
+const (
+	// Environment variable with the control socket to use (E.g. forwarded
+	// with ssh -R).
+	controlSocketEnv = "CLIPSYNC_SOCK"
+
+	// Maximum request size, in bytes.
+	controlMaxRequest = 64 * 1024 * 1024
+
+	// Time limit for a request (including publishing large messages).
+	controlTimeout = chunkTimeout
+
+	// Peers are reported in the status for this long after their last
+	// message.
+	peerExpiration = 24 * time.Hour
+)
+
+// errNoClient indicates there's no client listening on the control socket.
+var errNoClient = errors.New("no clipsync client running")
+
+// errPaused is returned for copy and paste requests while syncing is paused.
+var errPaused = errors.New("syncing is paused (use \"clipsync resume\" to resume)")
+
+// controlRequest is a request sent to the control socket.
+type controlRequest struct {
+	Op   string `json:"op"`
+	Type string `json:"type,omitempty"`
+	Data []byte `json:"data,omitempty"`
+}
+
+// messageInfo describes a message sent or received by the client.
+type messageInfo struct {
+	Time   time.Time `json:"time"`
+	Size   int       `json:"size"`
+	Sender string    `json:"sender,omitempty"`
+}
+
+// peerInfo describes a peer the client received messages from.
+type peerInfo struct {
+	Name     string    `json:"name"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// clientStatus holds the status of the running client.
+type clientStatus struct {
+	Version        string       `json:"version"`
+	Server         string       `json:"server"`
+	Connected      bool         `json:"connected"`
+	Paused         bool         `json:"paused"`
+	Device         string       `json:"device"`
+	InstanceID     string       `json:"instance_id"`
+	Topic          string       `json:"topic"`
+	KeyFingerprint string       `json:"key_fingerprint"`
+	LastSent       *messageInfo `json:"last_sent,omitempty"`
+	LastReceived   *messageInfo `json:"last_received,omitempty"`
+	Peers          []peerInfo   `json:"peers"`
+}
+
+// controlResponse is the response to a control request.
+type controlResponse struct {
+	OK     bool          `json:"ok"`
+	Error  string        `json:"error,omitempty"`
+	Type   string        `json:"type,omitempty"`
+	Data   []byte        `json:"data,omitempty"`
+	Status *clientStatus `json:"status,omitempty"`
+}
+
+// clientState holds the state of the running client that can be changed
+// through the control socket.
+type clientState struct {
+	sync.Mutex
+	paused       bool
+	lastSent     *messageInfo
+	lastReceived *messageInfo
+	peers        map[string]time.Time
+}
+
+// isPaused returns true if syncing is paused.
+func (s *clientState) isPaused() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.paused
+}
+
+// setPaused pauses or resumes syncing.
+func (s *clientState) setPaused(paused bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.paused = paused
+}
+
+// sent records a message sent with size bytes of clipboard contents.
+func (s *clientState) sent(size int) {
+	s.Lock()
+	defer s.Unlock()
+	s.lastSent = &messageInfo{Time: time.Now(), Size: size}
+}
+
+// received records a message received (and applied) from a peer, with size
+// bytes of clipboard contents.
+func (s *clientState) received(env *Envelope, size int) {
+	s.Lock()
+	defer s.Unlock()
+	s.lastReceived = &messageInfo{Time: time.Now(), Size: size, Sender: env.sender()}
+}
+
+// seen records a valid message from a peer.
+func (s *clientState) seen(env *Envelope) {
+	name := env.Device
+	if name == "" {
+		name = env.InstanceID
+	}
+	now := time.Now()
+
+	s.Lock()
+	defer s.Unlock()
+	if s.peers == nil {
+		s.peers = map[string]time.Time{}
+	}
+	s.peers[name] = now
+	for peer, t := range s.peers {
+		if now.Sub(t) > peerExpiration {
+			delete(s.peers, peer)
+		}
+	}
+}
+
+// fill copies the state to the status.
+func (s *clientState) fill(st *clientStatus) {
+	s.Lock()
+	defer s.Unlock()
+	st.Paused = s.paused
+	st.LastSent = s.lastSent
+	st.LastReceived = s.lastReceived
+	st.Peers = []peerInfo{}
+	for name, t := range s.peers {
+		if time.Since(t) <= peerExpiration {
+			st.Peers = append(st.Peers, peerInfo{Name: name, LastSeen: t})
+		}
+	}
+	sort.Slice(st.Peers, func(i, j int) bool {
+		return st.Peers[i].LastSeen.After(st.Peers[j].LastSeen)
+	})
+}
+
+// controlServer answers requests on the control socket.
+type controlServer struct {
+	broker     transport
+	xsel       *xselection
+	cfg        globalConfig
+	clientcfg  clientConfig
+	instanceID string
+	crypt      crypter
+	sig        *signer
+	state      *clientState
+	retained   *chunkTracker
+}
+
+// controlSocketPath returns the control socket of the client for the
+// display, under $XDG_RUNTIME_DIR (or a private directory under /tmp).
+func controlSocketPath(display string) string {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), fmt.Sprintf("clipsync-%d", os.Getuid()))
+	}
+	return filepath.Join(dir, "clipsync-"+display+".sock")
+}
+
+// checkOwner returns an error unless fname (not following symlinks) has the
+// given type, is owned by the current user and, for directories, is not
+// accessible by other users.
+func checkOwner(fname string, mode os.FileMode) error {
+	fi, err := os.Lstat(fname)
+	if err != nil {
+		return err
+	}
+	if fi.Mode().Type() != mode {
+		return fmt.Errorf("%s has an unexpected file type", fname)
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || int(st.Uid) != os.Getuid() {
+		return fmt.Errorf("%s is not owned by the current user", fname)
+	}
+	if mode == os.ModeDir && fi.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("%s is accessible by other users (mode %v)", fname, fi.Mode().Perm())
+	}
+	return nil
+}
+
+// listenControl creates the control socket, replacing a stale one. The
+// directory must belong to the current user (E.g. not created by someone
+// else under /tmp). Must be called with the client lock held.
+func listenControl(fname string) (net.Listener, error) {
+	dir := filepath.Dir(fname)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := checkOwner(dir, os.ModeDir); err != nil {
+		return nil, err
+	}
+	os.Remove(fname)
+	l, err := net.Listen("unix", fname)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(fname, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// serve answers requests on the control socket until the listener is closed.
+func (c *controlServer) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go c.handle(conn)
+	}
+}
+
+// handle answers one request.
+func (c *controlServer) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	var req controlRequest
+	if err := json.NewDecoder(io.LimitReader(conn, controlMaxRequest)).Decode(&req); err != nil {
+		log.Debugf("Invalid control request: %v", err)
+		return
+	}
+	log.Debugf("Control request: %s", req.Op)
+
+	resp := c.answer(req)
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		log.Debugf("Unable to send control response: %v", err)
+	}
+}
+
+// answer runs a request and returns the response.
+func (c *controlServer) answer(req controlRequest) controlResponse {
+	switch req.Op {
+	case controlCopy:
+		// Nothing is published while paused (E.g. passwords copied over ssh).
+		if c.state.isPaused() {
+			return controlResponse{Error: errPaused.Error()}
+		}
+		contents := clipContents{canonicalMimeType(req.Type): req.Data}
+		globalMutex.Lock()
+		if err := c.xsel.setXPrimary(contents); err != nil {
+			log.Errorf("Unable to set X Primary selection: %v", err)
+		}
+		c.xsel.setMemPrimary(contents)
+		if *c.clientcfg.syncsel {
+			if err := syncPrimaryToClip(c.xsel, contents); err != nil {
+				log.Debug("Unable to sync selections", "event", "error", "selection", selClipboard, "error", err)
+			}
+		}
+		globalMutex.Unlock()
+		if err := publish(c.broker, c.cfg, contents, c.instanceID, c.crypt, c.sig, c.retained, nil); err != nil {
+			return controlResponse{Error: err.Error()}
+		}
+		c.state.sent(contents.size())
+		return controlResponse{OK: true}
+
+	case controlPaste:
+		// Nor is the clipboard handed out to remote hosts.
+		if c.state.isPaused() {
+			return controlResponse{Error: errPaused.Error()}
+		}
+		globalMutex.Lock()
+		contents := c.xsel.getMemPrimary()
+		globalMutex.Unlock()
+		data, ok := contents[canonicalMimeType(req.Type)]
+		if !ok && !contents.empty() {
+			return controlResponse{Error: fmt.Sprintf("clipboard has no data of type %s (available: %v)", req.Type, contents.types())}
+		}
+		return controlResponse{OK: true, Type: canonicalMimeType(req.Type), Data: data}
+
+	case controlStatus:
+		return controlResponse{OK: true, Status: c.status()}
+
+	case controlPause, controlResume:
+		c.state.setPaused(req.Op == controlPause)
+		log.Infof("Syncing %sd through the control socket", req.Op)
+		return controlResponse{OK: true, Status: c.status()}
+	}
+	return controlResponse{Error: fmt.Sprintf("unknown operation %q", req.Op)}
+}
+
+// status returns the status of the client.
+func (c *controlServer) status() *clientStatus {
+	st := &clientStatus{
+		Version:        BuildVersion,
+		Server:         *c.cfg.server,
+		Connected:      c.broker.connected(),
+		Device:         *c.cfg.device,
+		InstanceID:     c.instanceID,
+		Topic:          *c.cfg.topic,
+		KeyFingerprint: keyFingerprint(c.crypt),
+	}
+	c.state.fill(st)
+	return st
+}
+
+// controlCall sends a request to the client listening on the control
+// socket. Returns errNoClient if there's no client.
+func controlCall(fname string, req controlRequest) (*controlResponse, error) {
+	if fname == "" {
+		return nil, errNoClient
+	}
+	conn, err := net.Dial("unix", fname)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, errNoClient
+		}
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, fmt.Errorf("error sending request to the client: %v", err)
+	}
+	var resp controlResponse
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("error reading response from the client: %v", err)
+	}
+	if !resp.OK {
+		return nil, errors.New(resp.Error)
+	}
+	return &resp, nil
+}
+
+// controlpausecmd pauses (or resumes) syncing in the client listening on the
+// control socket.
+func controlpausecmd(socket string, pause bool) error {
+	op := controlResume
+	if pause {
+		op = controlPause
+	}
+	if _, err := controlCall(socket, controlRequest{Op: op}); err != nil {
+		return err
+	}
+	fmt.Printf("Syncing %sd.\n", op)
+	return nil
+}
+
+// localControlSocket returns the control socket to use: $CLIPSYNC_SOCK, the
+// socket forwarded by ssh in SSH sessions (see sshconfigcmd), or the socket
+// of the client for the current display. Sockets in shared directories are
+// only used if owned by the current user. Returns blank if there's none.
+func localControlSocket() string {
+	if fname := os.Getenv(controlSocketEnv); fname != "" {
+		return fname
+	}
+	if os.Getenv("SSH_CONNECTION") != "" {
+		if u, err := user.Current(); err == nil {
+			fname := sshRemoteSocket(u.Username)
+			err := checkOwner(fname, os.ModeSocket)
+			if err == nil {
+				return fname
+			}
+			if !os.IsNotExist(err) {
+				log.Warnf("Ignoring forwarded control socket: %v", err)
+			}
+		}
+	}
+	fname, err := displayControlSocket()
+	if err != nil {
+		return ""
+	}
+	if err := checkOwner(filepath.Dir(fname), os.ModeDir); err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("Ignoring control socket: %v", err)
+		}
+		return ""
+	}
+	return fname
+}
+
+// displayControlSocket returns the control socket of the client for the
+// current display.
+func displayControlSocket() (string, error) {
+	backend, err := detectBackend(backendAuto)
+	if err != nil {
+		return "", err
+	}
+	display, err := displayName(backend)
+	if err != nil {
+		return "", err
+	}
+	return controlSocketPath(display), nil
+}
@@ -5,26 +5,57 @@ package main
 
 import (
 	"fmt"
-	"io"
 	"os"
 )
 
-// copycmd reads the stdin and sends it to the broker (server).
-func copycmd(cfg globalConfig, instanceID string, cryptPassword []byte, filter bool) error {
-	broker, err := newBroker(cfg, nil)
+// copycmd sends the data (read from stdin) to the broker (server) as the
+// given mime type.
+func copycmd(cfg globalConfig, instanceID string, crypt crypter, sig *signer, pub []byte, filter bool, mimetype string) error {
+	broker, err := newTransport(cfg)
 	if err != nil {
 		return fmt.Errorf("unable to connect to broker: %v", err)
 	}
-	pub, err := io.ReadAll(os.Stdin)
-	if err != nil {
-		return fmt.Errorf("unable to read data from stdin: %v", err)
+	defer broker.close()
+
+	// Learn about the retained chunks, to clear those of older transfers.
+	retained := newChunkTracker(*cfg.topic)
+	if err := broker.subscribe([]string{chunkSubscription(*cfg.topic)}, 1, func(msg message) { retained.observe(msg) }); err != nil {
+		return fmt.Errorf("unable to subscribe to topic %s: %v", *cfg.topic, err)
 	}
-	defer broker.Disconnect(1)
-	spub := string(pub)
+	retained.settle(chunkSettleTime, chunkSettleTimeout)
 
-	publish(broker, *cfg.topic, spub, instanceID, cryptPassword)
+	if err := publish(broker, cfg, clipContents{canonicalMimeType(mimetype): pub}, instanceID, crypt, sig, retained, copyProgress()); err != nil {
+		return err
+	}
 	if filter {
-		fmt.Print(spub)
+		os.Stdout.Write(pub)
 	}
 	return nil
 }
+
+// controlcopycmd sends the data (read from stdin) to the client listening on
+// the control socket. Returns errNoClient if there's no client.
+func controlcopycmd(socket string, pub []byte, filter bool, mimetype string) error {
+	if _, err := controlCall(socket, controlRequest{Op: controlCopy, Type: mimetype, Data: pub}); err != nil {
+		return err
+	}
+	if filter {
+		os.Stdout.Write(pub)
+	}
+	return nil
+}
+
+// copyProgress returns a function that shows the progress of chunked
+// transfers on stderr, or nil if stderr is not a terminal.
+func copyProgress() func(sent, total int) {
+	fi, err := os.Stderr.Stat()
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return nil
+	}
+	return func(sent, total int) {
+		fmt.Fprintf(os.Stderr, "\rSent %d/%d KiB (%d%%)", sent/1024, total/1024, sent*100/total)
+		if sent == total {
+			fmt.Fprintln(os.Stderr)
+		}
+	}
+}
@@ -4,18 +4,65 @@
 package main
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	mrand "math/rand"
-	"time"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
 )
 
 const cryptKeyLen = 32
 
+// Purposes of the subkeys derived from the master key (see subkey).
+const (
+	subkeyTopic      = "topic"
+	subkeyEncryption = "encryption"
+	subkeyDedupe     = "dedupe"
+	subkeyP2P        = "p2p"
+)
+
+// crypter encrypts and decrypts messages sent to the broker. Ciphertexts are
+// base64 encoded. The topic the message is published to is bound to the
+// ciphertext where supported, so a message replayed to another topic fails to
+// decrypt.
+type crypter interface {
+	encrypt(cleartext, topic string) (string, error)
+	decrypt(ciphertext, topic string) (string, error)
+}
+
+// subkey derives a subkey for the given purpose from the master key, using
+// HKDF-SHA256. The master key itself is never used directly.
+func subkey(key []byte, purpose string) []byte {
+	ret := make([]byte, cryptKeyLen)
+	// Reading less than 255 blocks from HKDF never fails.
+	io.ReadFull(hkdf.New(sha256.New, key, nil, []byte("clipsync "+purpose)), ret)
+	return ret
+}
+
+// dedupeHash returns the hash used to detect duplicate messages. Keyrings
+// use a keyed hash, so hashes reveal nothing about the contents.
+func dedupeHash(crypt crypter, payload []byte) string {
+	keys, ok := crypt.(*keyring)
+	if !ok {
+		return fmt.Sprintf("%x", md5.Sum(payload))
+	}
+	key, _ := keys.current()
+	m := hmac.New(sha256.New, subkey(key, subkeyDedupe))
+	m.Write(payload)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
 // newGCM creates a new cipher and GCM with the given key, returning the
 // gcm object returned by cipher.NewGCM.
 func newGCM(key []byte) (cipher.AEAD, error) {
@@ -33,70 +80,267 @@ func newGCM(key []byte) (cipher.AEAD, error) {
 	return gcm, nil
 }
 
+// newAEAD returns the AEAD for the cipher, using a key derived from the
+// master key. AES-256-GCM uses the encryption subkey, other ciphers use their
+// own subkey.
+func newAEAD(id byte, key []byte) (cipher.AEAD, error) {
+	switch id {
+	case cipherIDAESGCM:
+		return newGCM(subkey(key, subkeyEncryption))
+	case cipherIDXChaCha:
+		aead, err := chacha20poly1305.NewX(subkey(key, subkeyEncryption+" "+cipherXChaCha))
+		if err != nil {
+			return nil, fmt.Errorf("error creating XChaCha20-Poly1305: %v", err)
+		}
+		return aead, nil
+	}
+	return nil, fmt.Errorf("unknown cipher ID %d", id)
+}
+
+// Encrypted messages have the format (before base64 encoding):
+//
+//	magic       4 bytes, "CSK3"
+//	cipher      1 byte, cipher ID (1 = AES-256-GCM, 2 = XChaCha20-Poly1305)
+//	key ID      8 bytes, ID of the key used to encrypt (see keyID)
+//	nonce       12 or 24 bytes, depending on the cipher
+//	ciphertext  encrypted padded cleartext
+//
+// The ciphertext is encrypted with a subkey of the key, using the header and
+// topic as additional data. The cleartext is padded with a 0x80 byte followed
+// by zero or more zero bytes (see pad).
+//
+// Messages encrypted with AES-256-GCM without padding (the default) use the
+// "CSK2" format, understood by older clients: magic, key ID, nonce and
+// ciphertext (not padded), encrypted with the same subkey and additional data.
+// Messages from older clients contain
+// only the nonce and ciphertext (without additional data). These are
+// decrypted by trying all known keys.
+
+const (
+	cryptMagic   = "CSK3"
+	cryptMagicV2 = "CSK2"
+)
+
+// Ciphers.
+const (
+	cipherAESGCM  = "aes-256-gcm"
+	cipherXChaCha = "xchacha20-poly1305"
+
+	cipherIDAESGCM  = 1
+	cipherIDXChaCha = 2
+)
+
+// Padding modes.
+const (
+	paddingNone   = "none"
+	paddingPow2   = "pow2"
+	paddingBucket = "bucket"
+
+	// Minimum padded size with pow2 padding.
+	minPow2Padding = 256
+)
+
+// cryptOptions holds the cipher and padding used to encrypt messages.
+type cryptOptions struct {
+	cipher     string
+	padding    string
+	bucketSize int
+}
+
+// errUnknownKey indicates a message encrypted with a key we don't have.
+var errUnknownKey = errors.New("message encrypted with an unknown key (rotated or revoked?)")
+
+// Size of the encrypted message headers (magic + [cipher ID] + key ID).
+const (
+	cryptHeaderLen   = len(cryptMagic) + 1 + keyIDLen
+	cryptHeaderLenV2 = len(cryptMagicV2) + keyIDLen
+)
+
 // encrypt returns a copy of the cleartext string encrypted with AES256.
-func encrypt(cleartext string, key []byte) (string, error) {
+func encrypt(cleartext string, key, aad []byte) (string, error) {
 	gcm, err := newGCM(key)
 	if err != nil {
 		return "", err
 	}
-	// Create a new random nonce.
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
-		return "", fmt.Errorf("error creating nonce: %v", err)
-	}
-	return string(gcm.Seal(nonce, nonce, []byte(cleartext), nil)), nil
+	return seal(gcm, cleartext, aad)
 }
 
 // decrypt returns a copy of the decrypted ciphertext.
-func decrypt(ciphertext string, key []byte) (string, error) {
+func decrypt(ciphertext string, key, aad []byte) (string, error) {
 	gcm, err := newGCM(key)
 	if err != nil {
 		return "", err
 	}
-	nonceSize := gcm.NonceSize()
+	return open(gcm, ciphertext, aad)
+}
+
+// seal encrypts the cleartext with a new random nonce, and returns the nonce
+// followed by the ciphertext.
+func seal(aead cipher.AEAD, cleartext string, aad []byte) (string, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", fmt.Errorf("error creating nonce: %v", err)
+	}
+	return string(aead.Seal(nonce, nonce, []byte(cleartext), aad)), nil
+}
+
+// open decrypts a ciphertext created by seal.
+func open(aead cipher.AEAD, ciphertext string, aad []byte) (string, error) {
+	nonceSize := aead.NonceSize()
 	if nonceSize > len(ciphertext) {
 		return "", fmt.Errorf("nonce is longer than encrypted text")
 	}
 	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
-	cleartext, err := gcm.Open(nil, []byte(nonce), []byte(ciphertext), nil)
+	cleartext, err := aead.Open(nil, []byte(nonce), []byte(ciphertext), aad)
 	if err != nil {
 		return "", fmt.Errorf("error decrypting text: %v", err)
 	}
 	return string(cleartext), nil
 }
 
-// encrypt64 encrypts a copy of cleartext and returns a base64 encoded ciphertext.
-func encrypt64(cleartext string, key []byte) (string, error) {
-	ciphertext, err := encrypt(cleartext, key)
+// pad pads the cleartext with a 0x80 byte followed by enough zero bytes to
+// reach the size required by the padding mode, hiding the exact length of
+// the cleartext.
+func pad(cleartext string, opts cryptOptions) string {
+	size := len(cleartext) + 1
+	switch opts.padding {
+	case paddingPow2:
+		n := minPow2Padding
+		for n < size {
+			n *= 2
+		}
+		size = n
+	case paddingBucket:
+		if opts.bucketSize > 0 {
+			size = (size + opts.bucketSize - 1) / opts.bucketSize * opts.bucketSize
+		}
+	}
+	return cleartext + "\x80" + strings.Repeat("\x00", size-len(cleartext)-1)
+}
+
+// unpad removes the padding added by pad.
+func unpad(cleartext string) (string, error) {
+	s := strings.TrimRight(cleartext, "\x00")
+	if !strings.HasSuffix(s, "\x80") {
+		return "", errors.New("invalid padding")
+	}
+	return s[:len(s)-1], nil
+}
+
+// encrypt64 encrypts a copy of cleartext with the current key, bound to the
+// topic, and returns a base64 encoded ciphertext.
+func encrypt64(cleartext, topic string, keys *keyring) (string, error) {
+	key, id := keys.current()
+	opts := keys.opts
+
+	// Compatible format.
+	if (opts.cipher == "" || opts.cipher == cipherAESGCM) && (opts.padding == "" || opts.padding == paddingNone) {
+		header := append([]byte(cryptMagicV2), id...)
+		aad := append(append([]byte{}, header...), topic...)
+		ciphertext, err := encrypt(cleartext, subkey(key, subkeyEncryption), aad)
+		if err != nil {
+			return "", err
+		}
+		return base64.StdEncoding.EncodeToString(append(header, ciphertext...)), nil
+	}
+
+	var cipherID byte = cipherIDAESGCM
+	if opts.cipher == cipherXChaCha {
+		cipherID = cipherIDXChaCha
+	}
+	aead, err := newAEAD(cipherID, key)
+	if err != nil {
+		return "", err
+	}
+	header := append(append([]byte(cryptMagic), cipherID), id...)
+	aad := append(append([]byte{}, header...), topic...)
+	ciphertext, err := seal(aead, pad(cleartext, opts), aad)
 	if err != nil {
 		return "", err
 	}
-	return base64.StdEncoding.EncodeToString([]byte(ciphertext)), nil
+	return base64.StdEncoding.EncodeToString(append(header, ciphertext...)), nil
 }
 
-// decrypt decrypts a base64 encoded ciphertext and returns the plain cleartext.
-func decrypt64(ciphertext string, key []byte) (string, error) {
+// decrypt decrypts a base64 encoded ciphertext received on the topic with the
+// key it was encrypted with and returns the plain cleartext.
+func decrypt64(ciphertext, topic string, keys *keyring) (string, error) {
 	c, err := base64.StdEncoding.DecodeString(ciphertext)
 	if err != nil {
 		return "", fmt.Errorf("error decoding base64 encrypted text: %v", err)
 	}
-	cleartext, err := decrypt(string(c), key)
-	if err != nil {
-		return "", err
+
+	if len(c) > cryptHeaderLen && bytes.HasPrefix(c, []byte(cryptMagic)) {
+		header := c[:cryptHeaderLen]
+		cipherID := header[len(cryptMagic)]
+		id := header[len(cryptMagic)+1:]
+		key := keys.lookup(id)
+		if key == nil {
+			return "", fmt.Errorf("%w: key ID %x", errUnknownKey, id)
+		}
+		aead, err := newAEAD(cipherID, key)
+		if err != nil {
+			return "", err
+		}
+		aad := append(append([]byte{}, header...), topic...)
+		cleartext, err := open(aead, string(c[cryptHeaderLen:]), aad)
+		if err != nil {
+			return "", err
+		}
+		return unpad(cleartext)
+	}
+
+	if len(c) > cryptHeaderLenV2 && bytes.HasPrefix(c, []byte(cryptMagicV2)) {
+		header := c[:cryptHeaderLenV2]
+		id := header[len(cryptMagicV2):]
+		key := keys.lookup(id)
+		if key == nil {
+			return "", fmt.Errorf("%w: key ID %x", errUnknownKey, id)
+		}
+		aad := append(append([]byte{}, header...), topic...)
+		return decrypt(string(c[cryptHeaderLenV2:]), subkey(key, subkeyEncryption), aad)
 	}
-	return cleartext, nil
+
+	// Legacy message.
+	return keys.decryptAny(string(c), nil)
 }
 
-// createPassword creates a 32-byte random password.
-func createPassword() []byte {
-	charset := "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789~!@#$%^&*()-_+="
-	ret := [cryptKeyLen]byte{}
+// ciphertextKeyID returns the ID of the key a base64 encoded ciphertext was
+// encrypted with, or nil if the ciphertext carries no key ID (legacy format).
+func ciphertextKeyID(ciphertext string) []byte {
+	c, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return nil
+	}
+	switch {
+	case len(c) > cryptHeaderLen && bytes.HasPrefix(c, []byte(cryptMagic)):
+		return c[len(cryptMagic)+1 : cryptHeaderLen]
+	case len(c) > cryptHeaderLenV2 && bytes.HasPrefix(c, []byte(cryptMagicV2)):
+		return c[len(cryptMagicV2):cryptHeaderLenV2]
+	}
+	return nil
+}
 
-	mrand.Seed(time.Now().UnixNano())
+// createKey creates a new random 256-bit key, returned hex encoded.
+func createKey() ([]byte, error) {
+	key := make([]byte, cryptKeyLen)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("error creating random key: %v", err)
+	}
+	return []byte(hex.EncodeToString(key)), nil
+}
 
-	clen := len(charset)
-	for i := 0; i < cryptKeyLen; i++ {
-		ret[i] = charset[mrand.Intn(clen)]
+// decodeKey decodes a key read from a crypt file. Keys are hex encoded, but
+// legacy files contain a 32 character password used directly as the key.
+func decodeKey(s string) ([]byte, error) {
+	switch len(s) {
+	case hex.EncodedLen(cryptKeyLen):
+		key, err := hex.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key: %v", err)
+		}
+		return key, nil
+	case cryptKeyLen:
+		return []byte(s), nil
 	}
-	return ret[0:cryptKeyLen]
+	return nil, fmt.Errorf("crypt password must be a %d character hex key or exactly %d characters", hex.EncodedLen(cryptKeyLen), cryptKeyLen)
 }
@@ -0,0 +1,318 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"testing"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// testKey returns a key filled with the given byte.
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, cryptKeyLen)
+}
+
+func TestSubkey(t *testing.T) {
+	key := testKey(1)
+	purposes := []string{subkeyTopic, subkeyEncryption, subkeyDedupe, subkeyP2P, subkeyEncryption + " " + cipherXChaCha}
+
+	seen := map[string]string{}
+	for _, purpose := range purposes {
+		t.Run(purpose, func(t *testing.T) {
+			sk := subkey(key, purpose)
+			if len(sk) != cryptKeyLen {
+				t.Fatalf("subkey has %d bytes, want %d", len(sk), cryptKeyLen)
+			}
+			if bytes.Equal(sk, key) {
+				t.Error("subkey equals the master key")
+			}
+			if !bytes.Equal(sk, subkey(key, purpose)) {
+				t.Error("subkey is not deterministic")
+			}
+			if bytes.Equal(sk, subkey(testKey(2), purpose)) {
+				t.Error("different master keys produce the same subkey")
+			}
+			if other, ok := seen[string(sk)]; ok {
+				t.Errorf("same subkey as purpose %q", other)
+			}
+			seen[string(sk)] = purpose
+
+			// Subkeys are part of the wire format: HKDF-SHA256 with no salt
+			// and "clipsync <purpose>" as info.
+			want := make([]byte, cryptKeyLen)
+			if _, err := io.ReadFull(hkdf.New(sha256.New, key, nil, []byte("clipsync "+purpose)), want); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(sk, want) {
+				t.Errorf("subkey = %x, want %x", sk, want)
+			}
+		})
+	}
+}
+
+func TestDedupeHash(t *testing.T) {
+	payload := []byte("payload")
+	a := dedupeHash(newKeyring(testKey(1)), payload)
+	b := dedupeHash(newKeyring(testKey(2)), payload)
+	if a == b {
+		t.Error("dedupe hash does not depend on the key")
+	}
+	if a != dedupeHash(newKeyring(testKey(1)), payload) {
+		t.Error("dedupe hash is not deterministic")
+	}
+	if a == dedupeHash(nil, payload) {
+		t.Error("keyed dedupe hash equals the unkeyed hash")
+	}
+}
+
+// encryptV2 encrypts in the CSK2 format, as sent by older clients (and by
+// default).
+func encryptV2(t *testing.T, cleartext, topic string, key []byte) string {
+	t.Helper()
+	header := append([]byte(cryptMagicV2), keyID(key)...)
+	aad := append(append([]byte{}, header...), topic...)
+	c, err := encrypt(cleartext, subkey(key, subkeyEncryption), aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(append(header, c...))
+}
+
+// encryptLegacy encrypts in the original format (nonce and ciphertext only).
+func encryptLegacy(t *testing.T, cleartext string, key []byte) string {
+	t.Helper()
+	c, err := encrypt(cleartext, key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString([]byte(c))
+}
+
+func TestDecryptFormats(t *testing.T) {
+	key := testKey(1)
+	keys := newKeyring(key)
+	current, err := keys.encrypt("hello", "topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		ciphertext string
+	}{
+		{"current", current},
+		{"CSK2", encryptV2(t, "hello", "topic", key)},
+		{"legacy", encryptLegacy(t, "hello", key)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := keys.decrypt(tt.ciphertext, "topic")
+			if err != nil {
+				t.Fatalf("decrypt: %v", err)
+			}
+			if got != "hello" {
+				t.Errorf("got %q, want %q", got, "hello")
+			}
+		})
+	}
+}
+
+func TestDecryptRotatedKey(t *testing.T) {
+	old, cur := testKey(1), testKey(2)
+	keys := &keyring{keys: []ringKey{{key: cur, id: keyID(cur)}, {key: old, id: keyID(old)}}}
+	for _, c := range []string{encryptV2(t, "hello", "topic", old), encryptLegacy(t, "hello", old)} {
+		if got, err := keys.decrypt(c, "topic"); err != nil || got != "hello" {
+			t.Errorf("got %q, %v; want %q", got, err, "hello")
+		}
+	}
+}
+
+func TestDecryptInvalid(t *testing.T) {
+	keys := newKeyring(testKey(1))
+	good, err := keys.encrypt("hello", "topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// modified returns good with the byte at offset flipped.
+	modified := func(offset int) string {
+		c := append([]byte{}, raw...)
+		c[offset] ^= 0x01
+		return base64.StdEncoding.EncodeToString(c)
+	}
+	other, err := newKeyring(testKey(2)).encrypt("hello", "topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		ciphertext string
+		topic      string
+		want       error
+	}{
+		{"wrong topic", good, "other", nil},
+		{"unknown key", other, "topic", errUnknownKey},
+		{"tampered key ID", modified(len(cryptMagicV2)), "topic", errUnknownKey},
+		{"tampered nonce", modified(cryptHeaderLenV2), "topic", nil},
+		{"tampered ciphertext", modified(len(raw) - 1), "topic", nil},
+		{"truncated", base64.StdEncoding.EncodeToString(raw[:len(raw)-1]), "topic", nil},
+		{"header only", base64.StdEncoding.EncodeToString(raw[:cryptHeaderLenV2]), "topic", nil},
+		{"not base64", "not base64!", "topic", nil},
+		{"empty", "", "topic", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := keys.decrypt(tt.ciphertext, tt.topic)
+			if err == nil {
+				t.Fatalf("decrypt succeeded: %q", got)
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPad(t *testing.T) {
+	tests := []struct {
+		name      string
+		cleartext string
+		opts      cryptOptions
+		size      int
+	}{
+		{"none", "hello", cryptOptions{padding: paddingNone}, 6},
+		{"none empty", "", cryptOptions{padding: paddingNone}, 1},
+		{"pow2 small", "hello", cryptOptions{padding: paddingPow2}, minPow2Padding},
+		{"pow2 exact", string(make([]byte, minPow2Padding-1)), cryptOptions{padding: paddingPow2}, minPow2Padding},
+		{"pow2 next", string(make([]byte, minPow2Padding)), cryptOptions{padding: paddingPow2}, minPow2Padding * 2},
+		{"bucket", "hello", cryptOptions{padding: paddingBucket, bucketSize: 100}, 100},
+		{"bucket exact", string(make([]byte, 99)), cryptOptions{padding: paddingBucket, bucketSize: 100}, 100},
+		{"bucket next", string(make([]byte, 100)), cryptOptions{padding: paddingBucket, bucketSize: 100}, 200},
+		{"trailing zeros", "hello\x00\x00", cryptOptions{padding: paddingPow2}, minPow2Padding},
+		{"trailing marker", "hello\x80", cryptOptions{padding: paddingNone}, 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			padded := pad(tt.cleartext, tt.opts)
+			if len(padded) != tt.size {
+				t.Errorf("padded to %d bytes, want %d", len(padded), tt.size)
+			}
+			got, err := unpad(padded)
+			if err != nil {
+				t.Fatalf("unpad: %v", err)
+			}
+			if got != tt.cleartext {
+				t.Errorf("got %q, want %q", got, tt.cleartext)
+			}
+		})
+	}
+}
+
+func TestUnpadInvalid(t *testing.T) {
+	for _, s := range []string{"", "hello", "hello\x00", "\x00\x00"} {
+		if _, err := unpad(s); err == nil {
+			t.Errorf("unpad(%q) succeeded", s)
+		}
+	}
+}
+
+func TestEncryptOptions(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  cryptOptions
+		magic string
+		size  int
+	}{
+		{"default", cryptOptions{}, cryptMagicV2, 0},
+		{"aes-gcm", cryptOptions{cipher: cipherAESGCM, padding: paddingNone}, cryptMagicV2, 0},
+		{"xchacha", cryptOptions{cipher: cipherXChaCha}, cryptMagic, 0},
+		{"aes-gcm pow2", cryptOptions{cipher: cipherAESGCM, padding: paddingPow2}, cryptMagic, minPow2Padding},
+		{"xchacha bucket", cryptOptions{cipher: cipherXChaCha, padding: paddingBucket, bucketSize: 1000}, cryptMagic, 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := newKeyring(testKey(1))
+			keys.opts = tt.opts
+			c, err := keys.encrypt("hello", "topic")
+			if err != nil {
+				t.Fatalf("encrypt: %v", err)
+			}
+			raw, err := base64.StdEncoding.DecodeString(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasPrefix(raw, []byte(tt.magic)) {
+				t.Errorf("magic = %q, want %q", raw[:4], tt.magic)
+			}
+			if tt.size > 0 {
+				aead, err := newAEAD(raw[len(cryptMagic)], testKey(1))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n := len(raw) - cryptHeaderLen - aead.NonceSize() - aead.Overhead(); n != tt.size {
+					t.Errorf("padded cleartext has %d bytes, want %d", n, tt.size)
+				}
+			}
+
+			// Any keyring decrypts, regardless of its own options.
+			got, err := newKeyring(testKey(1)).decrypt(c, "topic")
+			if err != nil {
+				t.Fatalf("decrypt: %v", err)
+			}
+			if got != "hello" {
+				t.Errorf("got %q, want %q", got, "hello")
+			}
+			if _, err := keys.decrypt(c, "other"); err == nil {
+				t.Error("decrypted with the wrong topic")
+			}
+		})
+	}
+}
+
+func TestDecryptInvalidV3(t *testing.T) {
+	keys := newKeyring(testKey(1))
+	keys.opts = cryptOptions{cipher: cipherXChaCha, padding: paddingPow2}
+	good, err := keys.encrypt("hello", "topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// modified returns good with the byte at offset set to b.
+	modified := func(offset int, b byte) string {
+		c := append([]byte{}, raw...)
+		c[offset] = b
+		return base64.StdEncoding.EncodeToString(c)
+	}
+
+	tests := []struct {
+		name       string
+		ciphertext string
+	}{
+		{"unknown cipher", modified(len(cryptMagic), 9)},
+		{"wrong cipher", modified(len(cryptMagic), cipherIDAESGCM)},
+		{"tampered nonce", modified(cryptHeaderLen, raw[cryptHeaderLen]^1)},
+		{"tampered ciphertext", modified(len(raw)-1, raw[len(raw)-1]^1)},
+		{"truncated", base64.StdEncoding.EncodeToString(raw[:len(raw)-1])},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := keys.decrypt(tt.ciphertext, "topic"); err == nil {
+				t.Errorf("decrypt succeeded: %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// deviceidcmd prints the recipient (public key) of this device.
+func deviceidcmd(identityFile string) error {
+	identity, err := loadIdentity(identityFile)
+	if err != nil {
+		return err
+	}
+	fmt.Println(identity.Recipient())
+	return nil
+}
+
+// devicelistcmd prints the devices in the recipients file.
+func devicelistcmd(recipientsFile string) error {
+	devices, err := readRecipients(recipientsFile)
+	if err != nil {
+		return err
+	}
+	for _, d := range devices {
+		fmt.Printf("%s %s\n", d.name, d.recipient)
+	}
+	return nil
+}
+
+// deviceaddcmd adds a device to the recipients file, or replaces the
+// recipient of an existing device with the same name.
+func deviceaddcmd(recipientsFile, name, recipient string) error {
+	if name == "" || strings.ContainsAny(name, " \t#") {
+		return fmt.Errorf("invalid device name: %q", name)
+	}
+	r, err := age.ParseX25519Recipient(recipient)
+	if err != nil {
+		return err
+	}
+	devices, err := readRecipients(recipientsFile)
+	if err != nil {
+		return err
+	}
+
+	var ret []device
+	for _, d := range devices {
+		if d.name != name {
+			ret = append(ret, d)
+		}
+	}
+	ret = append(ret, device{name: name, recipient: r})
+	if err := writeRecipients(recipientsFile, ret); err != nil {
+		return err
+	}
+	log.Infof("Device %s added. Messages sent by this device can now be read by %s.", name, name)
+	return nil
+}
+
+// deviceremovecmd removes a device from the recipients file.
+func deviceremovecmd(recipientsFile, name string) error {
+	devices, err := readRecipients(recipientsFile)
+	if err != nil {
+		return err
+	}
+
+	var ret []device
+	for _, d := range devices {
+		if d.name != name {
+			ret = append(ret, d)
+		}
+	}
+	if len(ret) == len(devices) {
+		return fmt.Errorf("device %s not found in %s", name, recipientsFile)
+	}
+	if err := writeRecipients(recipientsFile, ret); err != nil {
+		return err
+	}
+	log.Infof("Device %s removed. It can no longer read new messages sent by this device.", name)
+	return nil
+}
+
+// signeridcmd prints the signing public key of this device.
+func signeridcmd(keyFile string) error {
+	key, err := loadSigningKey(keyFile)
+	if err != nil {
+		return err
+	}
+	s := &signer{key: key}
+	fmt.Println(s.publicKey())
+	return nil
+}
+
+// signerlistcmd prints the trusted signers.
+func signerlistcmd(trustedFile string) error {
+	signers, err := readTrustedSigners(trustedFile)
+	if err != nil {
+		return err
+	}
+	for _, t := range signers {
+		fmt.Printf("%s %s\n", t.name, base64.StdEncoding.EncodeToString(t.key))
+	}
+	return nil
+}
+
+// signertrustcmd adds a signer to the trusted signers file, or replaces the
+// key of an existing signer with the same name.
+func signertrustcmd(trustedFile, name, pubkey string) error {
+	if name == "" || strings.ContainsAny(name, " \t#") {
+		return fmt.Errorf("invalid signer name: %q", name)
+	}
+	key, err := parseSigningPublicKey(pubkey)
+	if err != nil {
+		return err
+	}
+	signers, err := readTrustedSigners(trustedFile)
+	if err != nil {
+		return err
+	}
+
+	var ret []trustedSigner
+	for _, t := range signers {
+		if t.name != name {
+			ret = append(ret, t)
+		}
+	}
+	ret = append(ret, trustedSigner{name: name, key: key})
+	if err := writeTrustedSigners(trustedFile, ret); err != nil {
+		return err
+	}
+	log.Infof("Signer %s trusted. Only messages signed by trusted signers will be accepted.", name)
+	return nil
+}
+
+// signeruntrustcmd removes a signer from the trusted signers file.
+func signeruntrustcmd(trustedFile, name string) error {
+	signers, err := readTrustedSigners(trustedFile)
+	if err != nil {
+		return err
+	}
+
+	var ret []trustedSigner
+	for _, t := range signers {
+		if t.name != name {
+			ret = append(ret, t)
+		}
+	}
+	if len(ret) == len(signers) {
+		return fmt.Errorf("signer %s not found in %s", name, trustedFile)
+	}
+	if err := writeTrustedSigners(trustedFile, ret); err != nil {
+		return err
+	}
+	log.Infof("Signer %s removed. Messages signed by %s will be rejected.", name, name)
+	if len(ret) == 0 {
+		log.Infof("No trusted signers left: unsigned messages will be accepted again.")
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+// Wire format
+//
+// Every message sent to the broker (before encryption) has the format:
+//
+//	magic    4 bytes, "CSYN"
+//	version  1 byte, protocol version (currently 2)
+//	length   4 bytes, big-endian length of the body
+//	body     CBOR (RFC 8949) encoded Envelope
+//
+// Envelope fields use integer keys, so field names can change without
+// breaking compatibility. New fields must use new keys, and receivers ignore
+// keys they don't know about. Fields must never be removed or have their
+// meaning changed; doing that requires a new protocol version.
+//
+// Protocol version 1 is the original gob encoded Lineformat structure, which
+// is still accepted (but not sent) for compatibility with older clients.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+const (
+	envelopeMagic = "CSYN"
+
+	// Protocol version we speak, and the version of the legacy gob format.
+	protocolVersion       = 2
+	legacyProtocolVersion = 1
+
+	// Size of the envelope header (magic + version + length).
+	envelopeHeaderLen = len(envelopeMagic) + 1 + 4
+)
+
+// Envelope is the message exchanged between clients. All attributes must be
+// exported since this will be serialized into something else before
+// transmission.
+type Envelope struct {
+	// Unique ID of the sending instance.
+	InstanceID string `cbor:"1,keyasint"`
+	// Human readable name of the sending device (usually the hostname).
+	Device string `cbor:"2,keyasint,omitempty"`
+	// Time the message was created, in milliseconds since the epoch.
+	Timestamp int64 `cbor:"3,keyasint"`
+	// Sequence number, incremented for every message sent by this instance.
+	Sequence uint64 `cbor:"4,keyasint"`
+	// Contents of the selection, one part per mime type, in order of
+	// preference.
+	Parts []EnvelopePart `cbor:"5,keyasint"`
+	// Extensible metadata.
+	Metadata map[string]string `cbor:"6,keyasint,omitempty"`
+	// Random ID of the sending device, shared by all its instances and
+	// kept across restarts (see loadDeviceID).
+	DeviceID string `cbor:"7,keyasint,omitempty"`
+
+	// Protocol version this envelope was decoded from (not transmitted).
+	version int
+	// Name of the trusted signer, or the signer's public key (not transmitted).
+	signer string
+	// Decoded from a JSON message (not transmitted).
+	plain bool
+}
+
+// EnvelopePart holds the contents of the selection in one mime type.
+type EnvelopePart struct {
+	ContentType string `cbor:"1,keyasint"`
+	Data        []byte `cbor:"2,keyasint"`
+}
+
+// Lineformat contains the legacy (protocol version 1) line format for mqtt
+// messages. It is only used to decode messages from older clients.
+type Lineformat struct {
+	InstanceID string
+	Message    string
+	Contents   map[string][]byte
+}
+
+// Sequence number of the last message sent by this instance.
+var sendSequence uint64
+
+// ID of this device, sent in every envelope (see loadDeviceID).
+var localDeviceID string
+
+// Peers (instance IDs) already reported as speaking a different protocol.
+var reportedPeers sync.Map
+
+// nextSequence returns the sequence number of a new message: the current time
+// in microseconds, or the last sequence number plus one if higher. Sequence
+// numbers keep increasing across restarts and across the instances running on
+// a device (E.g. the client and the copy command), which share the sequence
+// checked by the replay guard.
+func nextSequence() uint64 {
+	for {
+		last := atomic.LoadUint64(&sendSequence)
+		next := uint64(time.Now().UnixMicro())
+		if next <= last {
+			next = last + 1
+		}
+		if atomic.CompareAndSwapUint64(&sendSequence, last, next) {
+			return next
+		}
+	}
+}
+
+// newEnvelope returns a new envelope with the given contents. Text goes
+// first, followed by the other mime types in alphabetical order.
+func newEnvelope(instanceID, device string, c clipContents) *Envelope {
+	e := &Envelope{
+		InstanceID: instanceID,
+		Device:     device,
+		Timestamp:  time.Now().UnixMilli(),
+		Sequence:   nextSequence(),
+		DeviceID:   localDeviceID,
+		version:    protocolVersion,
+	}
+	if data, ok := c[mimeTextPlain]; ok {
+		e.Parts = append(e.Parts, EnvelopePart{ContentType: mimeTextPlain, Data: data})
+	}
+	for _, t := range c.types() {
+		if t != mimeTextPlain {
+			e.Parts = append(e.Parts, EnvelopePart{ContentType: t, Data: c[t]})
+		}
+	}
+	return e
+}
+
+// contents returns the clipboard contents in the envelope.
+func (e *Envelope) contents() clipContents {
+	if len(e.Parts) == 0 {
+		return nil
+	}
+	ret := clipContents{}
+	for _, p := range e.Parts {
+		ret[canonicalMimeType(p.ContentType)] = p.Data
+	}
+	return ret
+}
+
+// sender returns a printable identification of the sender.
+func (e *Envelope) sender() string {
+	ret := e.InstanceID
+	if e.Device != "" {
+		ret = fmt.Sprintf("%s (%s)", e.Device, e.InstanceID)
+	}
+	if e.signer != "" {
+		ret += " signed by " + e.signer
+	}
+	return ret
+}
+
+// marshal returns the wire representation of the envelope (header + body).
+func (e *Envelope) marshal() ([]byte, error) {
+	body, err := cbor.Marshal(e)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding message: %v", err)
+	}
+	buf := make([]byte, envelopeHeaderLen, envelopeHeaderLen+len(body))
+	copy(buf, envelopeMagic)
+	buf[len(envelopeMagic)] = protocolVersion
+	binary.BigEndian.PutUint32(buf[len(envelopeMagic)+1:], uint32(len(body)))
+	return append(buf, body...), nil
+}
+
+// unmarshalEnvelope decodes a message in the wire format. Messages in the
+// legacy gob format are also accepted.
+func unmarshalEnvelope(data []byte) (*Envelope, error) {
+	if !bytes.HasPrefix(data, []byte(envelopeMagic)) {
+		return unmarshalLegacy(data)
+	}
+	if len(data) < envelopeHeaderLen {
+		return nil, errors.New("message too short")
+	}
+	version := int(data[len(envelopeMagic)])
+	if version > protocolVersion {
+		return nil, fmt.Errorf("peer speaks protocol v%d, but we only speak up to v%d. Please upgrade clipsync", version, protocolVersion)
+	}
+	length := binary.BigEndian.Uint32(data[len(envelopeMagic)+1:])
+	body := data[envelopeHeaderLen:]
+	if uint32(len(body)) != length {
+		return nil, fmt.Errorf("message length mismatch: header says %d bytes, got %d", length, len(body))
+	}
+
+	e := &Envelope{}
+	if err := cbor.Unmarshal(body, e); err != nil {
+		return nil, fmt.Errorf("error decoding protocol v%d message: %v", version, err)
+	}
+	e.version = version
+	return e, nil
+}
+
+// unmarshalLegacy decodes a message in the gob encoded Lineformat (protocol
+// version 1) format.
+func unmarshalLegacy(data []byte) (*Envelope, error) {
+	var l Lineformat
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&l); err != nil {
+		return nil, fmt.Errorf("unknown message format (not protocol v%d or legacy gob): %v", protocolVersion, err)
+	}
+	c := clipContents(l.Contents)
+	if len(c) == 0 {
+		c = textContents(l.Message)
+	}
+	e := newEnvelope(l.InstanceID, "", c)
+	e.Timestamp = 0
+	e.Sequence = 0
+	e.version = legacyProtocolVersion
+	return e, nil
+}
+
+// reportPeerVersion logs (once per peer) when a peer speaks a protocol
+// version different from ours.
+func reportPeerVersion(e *Envelope) {
+	if e.version == protocolVersion || e.plain {
+		return
+	}
+	if _, found := reportedPeers.LoadOrStore(e.InstanceID, true); found {
+		return
+	}
+	log.Infof("Peer %s speaks protocol v%d (we speak v%d). Please upgrade clipsync on that machine.", e.sender(), e.version, protocolVersion)
+}
@@ -0,0 +1,142 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"reflect"
+	"testing"
+)
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents clipContents
+	}{
+		{"text", textContents("hello, world")},
+		{"empty", nil},
+		{"binary", clipContents{"image/png": {0x89, 'P', 'N', 'G', 0, 1, 2}}},
+		{"multiple types", clipContents{
+			mimeTextPlain: []byte("hello"),
+			"text/html":   []byte("<b>hello</b>"),
+			"image/png":   {1, 2, 3},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newEnvelope("host:0-1234", "host", tt.contents)
+			data, err := e.marshal()
+			if err != nil {
+				t.Fatalf("marshal: %v", err)
+			}
+			got, err := unmarshalEnvelope(data)
+			if err != nil {
+				t.Fatalf("unmarshalEnvelope: %v", err)
+			}
+			if got.version != protocolVersion {
+				t.Errorf("version = %d, want %d", got.version, protocolVersion)
+			}
+			if got.InstanceID != e.InstanceID || got.Device != e.Device || got.Timestamp != e.Timestamp || got.Sequence != e.Sequence {
+				t.Errorf("got %+v, want %+v", got, e)
+			}
+			if !reflect.DeepEqual(got.contents(), e.contents()) {
+				t.Errorf("contents = %v, want %v", got.contents(), e.contents())
+			}
+		})
+	}
+}
+
+func TestEnvelopeTextFirst(t *testing.T) {
+	e := newEnvelope("id", "", clipContents{"image/png": {1}, mimeTextPlain: []byte("a"), "text/html": []byte("b")})
+	if len(e.Parts) != 3 || e.Parts[0].ContentType != mimeTextPlain {
+		t.Errorf("parts = %+v, want %s first", e.Parts, mimeTextPlain)
+	}
+}
+
+func TestEnvelopeSequence(t *testing.T) {
+	a := newEnvelope("id", "", nil)
+	b := newEnvelope("id", "", nil)
+	if b.Sequence <= a.Sequence {
+		t.Errorf("sequence did not increase: %d, then %d", a.Sequence, b.Sequence)
+	}
+}
+
+func TestUnmarshalEnvelopeInvalid(t *testing.T) {
+	data, err := newEnvelope("host:0-1234", "host", textContents("hello")).marshal()
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+
+	future := append([]byte{}, data...)
+	future[len(envelopeMagic)] = protocolVersion + 1
+
+	longer := append([]byte{}, data...)
+	binary.BigEndian.PutUint32(longer[len(envelopeMagic)+1:], uint32(len(data)))
+
+	badBody := append([]byte{}, data[:envelopeHeaderLen]...)
+	badBody = append(badBody, bytes.Repeat([]byte{0xff}, len(data)-envelopeHeaderLen)...)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"garbage", []byte("not a message")},
+		{"header only", data[:envelopeHeaderLen-1]},
+		{"truncated body", data[:len(data)-1]},
+		{"trailing data", append(append([]byte{}, data...), 0)},
+		{"length mismatch", longer},
+		{"future version", future},
+		{"invalid body", badBody},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if e, err := unmarshalEnvelope(tt.data); err == nil {
+				t.Errorf("unmarshalEnvelope succeeded: %+v", e)
+			}
+		})
+	}
+}
+
+func TestUnmarshalLegacy(t *testing.T) {
+	tests := []struct {
+		name string
+		line Lineformat
+		want clipContents
+	}{
+		{
+			name: "message only",
+			line: Lineformat{InstanceID: "old:0-1", Message: "hello"},
+			want: textContents("hello"),
+		},
+		{
+			name: "contents",
+			line: Lineformat{InstanceID: "old:0-1", Message: "hello", Contents: map[string][]byte{"image/png": {1, 2}}},
+			want: clipContents{"image/png": {1, 2}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := gob.NewEncoder(&buf).Encode(tt.line); err != nil {
+				t.Fatalf("gob encode: %v", err)
+			}
+			e, err := unmarshalEnvelope(buf.Bytes())
+			if err != nil {
+				t.Fatalf("unmarshalEnvelope: %v", err)
+			}
+			if e.version != legacyProtocolVersion || e.InstanceID != tt.line.InstanceID {
+				t.Errorf("got version %d, instance %q", e.version, e.InstanceID)
+			}
+			if e.Sequence != 0 || e.Timestamp != 0 {
+				t.Errorf("legacy message has sequence %d, timestamp %d", e.Sequence, e.Timestamp)
+			}
+			if !reflect.DeepEqual(e.contents(), tt.want) {
+				t.Errorf("contents = %v, want %v", e.contents(), tt.want)
+			}
+		})
+	}
+}
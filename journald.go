@@ -0,0 +1,172 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+// Journald handler
+//
+// Log records are sent to the journal using its native protocol: one datagram
+// per entry, holding one field per line ("KEY=value"). Values containing
+// newlines are sent as the key, a newline, the length of the value (64-bit
+// little endian), the value and a newline. Record attributes become journal
+// fields with uppercase names (E.g. "sender" becomes SENDER), so entries can
+// be filtered with journalctl (E.g. journalctl --user -u clipsync EVENT=drop).
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Socket for native journal entries.
+	journalSocket = "/run/systemd/journal/socket"
+
+	// Identifier of our journal entries.
+	journalIdentifier = "clipsync"
+)
+
+// journalHandler is a slog handler sending records to the journal.
+type journalHandler struct {
+	conn   *net.UnixConn
+	level  slog.Leveler
+	attrs  []slog.Attr
+	prefix string
+}
+
+// newJournalHandler connects to the journal.
+func newJournalHandler(level slog.Leveler) (*journalHandler, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journalHandler{conn: conn, level: level}, nil
+}
+
+func (h *journalHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *journalHandler) Handle(_ context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	journalField(&buf, "MESSAGE", r.Message)
+	journalField(&buf, "PRIORITY", strconv.Itoa(journalPriority(r.Level)))
+	journalField(&buf, "SYSLOG_IDENTIFIER", journalIdentifier)
+	if r.PC != 0 {
+		frame, _ := runtime.CallersFrames([]uintptr{r.PC}).Next()
+		journalField(&buf, "CODE_FILE", frame.File)
+		journalField(&buf, "CODE_LINE", strconv.Itoa(frame.Line))
+		journalField(&buf, "CODE_FUNC", frame.Function)
+	}
+	for _, a := range h.attrs {
+		journalAttr(&buf, "", a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		journalAttr(&buf, h.prefix, a)
+		return true
+	})
+
+	if _, err := h.conn.Write(buf.Bytes()); err != nil {
+		// Don't lose the message (E.g. entries too large for a datagram).
+		fmt.Fprintln(os.Stderr, r.Message)
+		return err
+	}
+	return nil
+}
+
+func (h *journalHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	ret := *h
+	ret.attrs = append([]slog.Attr{}, h.attrs...)
+	for _, a := range attrs {
+		if h.prefix != "" {
+			a.Key = h.prefix + a.Key
+		}
+		ret.attrs = append(ret.attrs, a)
+	}
+	return &ret
+}
+
+func (h *journalHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	ret := *h
+	ret.prefix = h.prefix + name + "_"
+	return &ret
+}
+
+// journalAttr adds an attribute (and the attributes in groups) to the entry.
+func journalAttr(buf *bytes.Buffer, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "_"
+		}
+		for _, ga := range a.Value.Group() {
+			journalAttr(buf, prefix, ga)
+		}
+		return
+	}
+	if name := journalFieldName(prefix + a.Key); name != "" {
+		journalField(buf, name, a.Value.String())
+	}
+}
+
+// journalField adds a field to the entry.
+func journalField(buf *bytes.Buffer, name, value string) {
+	buf.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+	var size [8]byte
+	binary.LittleEndian.PutUint64(size[:], uint64(len(value)))
+	buf.WriteByte('\n')
+	buf.Write(size[:])
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// journalFieldName returns a valid journal field name for an attribute key:
+// uppercase letters, digits and underscores, not starting with an underscore
+// or digit, up to 64 characters. Returns blank if there's no valid name.
+func journalFieldName(key string) string {
+	name := []byte(strings.ToUpper(key))
+	for i, c := range name {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			name[i] = '_'
+		}
+	}
+	ret := strings.TrimLeft(string(name), "_0123456789")
+	if len(ret) > 64 {
+		ret = ret[:64]
+	}
+	return ret
+}
+
+// journalPriority returns the syslog priority for a log level.
+func journalPriority(level slog.Level) int {
+	switch {
+	case level >= levelCritical:
+		return 2
+	case level >= slog.LevelError:
+		return 3
+	case level >= slog.LevelWarn:
+		return 4
+	case level >= slog.LevelInfo:
+		return 6
+	}
+	return 7
+}
@@ -0,0 +1,127 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+// JSON messages
+//
+// With --no-encrypt, messages are sent as plain JSON documents, so other MQTT
+// consumers (E.g. Home Assistant, Node-RED or mosquitto_sub) can read and
+// write clipboard entries:
+//
+//	{
+//	  "text": "hello",              text contents (UTF-8 text/* types)
+//	  "data": "aGVsbG8=",           base64 contents (other types)
+//	  "type": "text/plain",         mime type (default: text/plain)
+//	  "sender": "host:0-1234",      sender instance ID
+//	  "device": "host",             sender device name
+//	  "timestamp": 1700000000000,   milliseconds since the epoch
+//	  "parts": [...]                other mime types (type, text, data)
+//	}
+//
+// Only "text" (or "type" and "data") is required from third-party
+// publishers.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Sender used for JSON messages without a sender.
+const jsonDefaultSender = "json"
+
+// jsonPart holds the contents in one mime type.
+type jsonPart struct {
+	Type string `json:"type,omitempty"`
+	Text string `json:"text,omitempty"`
+	Data []byte `json:"data,omitempty"`
+}
+
+// jsonMessage is the JSON representation of an envelope. The first part is
+// stored at the top level.
+type jsonMessage struct {
+	jsonPart
+	Sender    string     `json:"sender,omitempty"`
+	Device    string     `json:"device,omitempty"`
+	Timestamp int64      `json:"timestamp,omitempty"`
+	Parts     []jsonPart `json:"parts,omitempty"`
+}
+
+// newJSONPart returns the JSON representation of an envelope part. Text that
+// is not valid UTF-8 (E.g. Latin-1) can't be represented in a JSON string, so
+// it's sent as data.
+func newJSONPart(p EnvelopePart) jsonPart {
+	if strings.HasPrefix(p.ContentType, "text/") && utf8.Valid(p.Data) {
+		return jsonPart{Type: p.ContentType, Text: string(p.Data)}
+	}
+	return jsonPart{Type: p.ContentType, Data: p.Data}
+}
+
+// contents returns the mime type and data in the part.
+func (p jsonPart) contents() (string, []byte) {
+	mimetype := canonicalMimeType(p.Type)
+	if mimetype == "" {
+		mimetype = mimeTextPlain
+	}
+	if p.Data != nil {
+		return mimetype, p.Data
+	}
+	return mimetype, []byte(p.Text)
+}
+
+// marshalJSON returns the JSON representation of the envelope.
+func (e *Envelope) marshalJSON() ([]byte, error) {
+	m := jsonMessage{
+		Sender:    e.InstanceID,
+		Device:    e.Device,
+		Timestamp: e.Timestamp,
+	}
+	for i, p := range e.Parts {
+		if i == 0 {
+			m.jsonPart = newJSONPart(p)
+			continue
+		}
+		m.Parts = append(m.Parts, newJSONPart(p))
+	}
+	ret, err := json.Marshal(m)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding JSON message: %v", err)
+	}
+	return ret, nil
+}
+
+// isJSON returns true if the data looks like a JSON document.
+func isJSON(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("{"))
+}
+
+// unmarshalJSON decodes a JSON message, sent by us or by a third party.
+func unmarshalJSON(data []byte) (*Envelope, error) {
+	var m jsonMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("error decoding JSON message: %v", err)
+	}
+	c := clipContents{}
+	for _, p := range append([]jsonPart{m.jsonPart}, m.Parts...) {
+		if mimetype, data := p.contents(); len(data) != 0 {
+			if _, ok := c[mimetype]; !ok {
+				c[mimetype] = data
+			}
+		}
+	}
+	if c.empty() {
+		return nil, errors.New("JSON message has no contents")
+	}
+	if m.Sender == "" {
+		m.Sender = jsonDefaultSender
+	}
+	e := newEnvelope(m.Sender, m.Device, c)
+	e.Timestamp = m.Timestamp
+	e.Sequence = 0
+	e.plain = true
+	return e, nil
+}
@@ -0,0 +1,140 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMarshalJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents clipContents
+		want     string
+	}{
+		{
+			name:     "text",
+			contents: textContents("hello"),
+			want:     `{"type":"text/plain","text":"hello","sender":"host:0-1234","device":"host","timestamp":1700000000000}`,
+		},
+		{
+			name:     "binary",
+			contents: clipContents{"image/png": []byte("hello")},
+			want:     `{"type":"image/png","data":"aGVsbG8=","sender":"host:0-1234","device":"host","timestamp":1700000000000}`,
+		},
+		{
+			name:     "invalid UTF-8 text",
+			contents: textContents("caf\xe9"),
+			want:     `{"type":"text/plain","data":"Y2Fm6Q==","sender":"host:0-1234","device":"host","timestamp":1700000000000}`,
+		},
+		{
+			name:     "multiple types",
+			contents: clipContents{mimeTextPlain: []byte("hello"), "image/png": []byte("hello")},
+			want:     `{"type":"text/plain","text":"hello","sender":"host:0-1234","device":"host","timestamp":1700000000000,"parts":[{"type":"image/png","data":"aGVsbG8="}]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newEnvelope("host:0-1234", "host", tt.contents)
+			e.Timestamp = 1700000000000
+			data, err := e.marshalJSON()
+			if err != nil {
+				t.Fatalf("marshalJSON: %v", err)
+			}
+			if string(data) != tt.want {
+				t.Errorf("got  %s\nwant %s", data, tt.want)
+			}
+			if !isJSON(data) {
+				t.Error("isJSON = false")
+			}
+
+			got, err := unmarshalJSON(data)
+			if err != nil {
+				t.Fatalf("unmarshalJSON: %v", err)
+			}
+			if got.InstanceID != e.InstanceID || got.Device != e.Device || got.Timestamp != e.Timestamp || !got.plain {
+				t.Errorf("got %+v, want %+v", got, e)
+			}
+			if !reflect.DeepEqual(got.contents(), tt.contents) {
+				t.Errorf("contents = %v, want %v", got.contents(), tt.contents)
+			}
+		})
+	}
+}
+
+func TestUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		sender string
+		want   clipContents
+	}{
+		{"text only", `{"text": "hello"}`, jsonDefaultSender, textContents("hello")},
+		{"leading space", " \n{\"text\": \"hello\", \"sender\": \"script\"}", "script", textContents("hello")},
+		{"text type", `{"type": "UTF8_STRING", "text": "hello"}`, jsonDefaultSender, textContents("hello")},
+		{"data", `{"type": "image/png", "data": "aGVsbG8="}`, jsonDefaultSender, clipContents{"image/png": []byte("hello")}},
+		{"data without type", `{"data": "aGVsbG8="}`, jsonDefaultSender, textContents("hello")},
+		{"parts only", `{"parts": [{"type": "text/html", "text": "<b>hi</b>"}]}`, jsonDefaultSender, clipContents{"text/html": []byte("<b>hi</b>")}},
+		{"first part wins", `{"text": "a", "parts": [{"text": "b"}]}`, jsonDefaultSender, textContents("a")},
+		{"unknown fields", `{"text": "hello", "color": "blue"}`, jsonDefaultSender, textContents("hello")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !isJSON([]byte(tt.data)) {
+				t.Error("isJSON = false")
+			}
+			e, err := unmarshalJSON([]byte(tt.data))
+			if err != nil {
+				t.Fatalf("unmarshalJSON: %v", err)
+			}
+			if e.InstanceID != tt.sender || e.Sequence != 0 || !e.plain {
+				t.Errorf("got sender %q, sequence %d, plain %v", e.InstanceID, e.Sequence, e.plain)
+			}
+			if !reflect.DeepEqual(e.contents(), tt.want) {
+				t.Errorf("contents = %v, want %v", e.contents(), tt.want)
+			}
+		})
+	}
+}
+
+func TestUnmarshalJSONInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"empty object", `{}`},
+		{"empty text", `{"text": ""}`},
+		{"truncated", `{"text": "hello"`},
+		{"wrong type", `{"text": 1}`},
+		{"invalid base64", `{"type": "image/png", "data": "!!"}`},
+		{"not an object", `["hello"]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if e, err := unmarshalJSON([]byte(tt.data)); err == nil {
+				t.Errorf("unmarshalJSON succeeded: %+v", e)
+			}
+		})
+	}
+}
+
+func TestDecodeMQTTJSON(t *testing.T) {
+	sig, err := newSigner(false, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := decodeMQTT(`{"text": "hello"}`, "topic", nil, sig, newReassembler())
+	if err != nil {
+		t.Fatalf("decodeMQTT: %v", err)
+	}
+	if !reflect.DeepEqual(e.contents(), textContents("hello")) {
+		t.Errorf("contents = %v", e.contents())
+	}
+
+	// With encryption, JSON messages are rejected.
+	if _, err := decodeMQTT(`{"text": "hello"}`, "topic", newKeyring(testKey(1)), sig, newReassembler()); err == nil {
+		t.Error("decodeMQTT accepted an unencrypted JSON message with encryption")
+	}
+}
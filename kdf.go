@@ -0,0 +1,257 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+// Passphrase mode
+//
+// Instead of a crypt file with a random 32 character key, users can choose a
+// passphrase (E.g. a few random words) that's easy to type on every machine.
+// The encryption key is derived from the passphrase with Argon2id, using a
+// random salt published (retained) to "<topic>/salt" by the first client to
+// use the topic. The salt is not secret, but it must never change: clients
+// save it next to the passphrase file on first use (or take it from
+// --passphrase-salt) and never read it from the broker again, and salts in
+// the broker are never replaced.
+//
+// When a random topic is requested, the salt is kept under the topic given by
+// the user (which must be unique) and the random topic is derived from the
+// salted key, like with crypt files. Deriving it from the passphrase alone
+// would allow a single dictionary attack on all passphrase topics.
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/term"
+)
+
+const (
+	// Default passphrase file, under configDir.
+	passphraseFile = "passphrase"
+
+	// Minimum passphrase length.
+	minPassphraseLen = 12
+
+	// Argon2id parameters (see RFC 9106, section 4).
+	argonTime    = 3
+	argonMemory  = 64 * 1024 // KiB
+	argonThreads = 4
+
+	// Salt length in bytes.
+	saltLen = 16
+
+	// Time to wait for the retained salt from the broker.
+	saltTimeout = 5 * time.Second
+)
+
+// saltTopic returns the topic holding the salt for the given topic.
+func saltTopic(topic string) string {
+	return topic + "/salt"
+}
+
+// readPassphrase reads the passphrase from a file.
+func readPassphrase(fname string) ([]byte, error) {
+	p, err := os.ReadFile(tildeExpand(fname))
+	if err != nil {
+		return nil, err
+	}
+	pass := []byte(strings.TrimRight(string(p), "\n"))
+	if len(pass) < minPassphraseLen {
+		return nil, fmt.Errorf("passphrase must be at least %d characters long", minPassphraseLen)
+	}
+	return pass, nil
+}
+
+// deriveKey derives an encryption key from the passphrase and salt.
+func deriveKey(passphrase, salt []byte) []byte {
+	return argon2.IDKey(passphrase, salt, argonTime, argonMemory, argonThreads, cryptKeyLen)
+}
+
+// decodeSalt decodes a hex encoded salt.
+func decodeSalt(s string) ([]byte, error) {
+	salt, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(salt) != saltLen {
+		return nil, fmt.Errorf("salt must have %d hex digits", saltLen*2)
+	}
+	return salt, nil
+}
+
+// saltFileName returns the file holding the salt for the passphrase file.
+func saltFileName(passfile string) string {
+	return tildeExpand(passfile) + ".salt"
+}
+
+// readSalt reads the salt saved for the topic. Returns nil if there's no
+// salt saved for the topic.
+func readSalt(fname, topic string) ([]byte, error) {
+	data, err := os.ReadFile(fname)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	savedTopic, hexsalt, ok := strings.Cut(strings.TrimSpace(string(data)), " ")
+	if !ok {
+		return nil, fmt.Errorf("invalid salt file %s", fname)
+	}
+	if savedTopic != topic {
+		return nil, nil
+	}
+	return decodeSalt(hexsalt)
+}
+
+// saveSalt saves the salt for the topic.
+func saveSalt(fname, topic string, salt []byte) error {
+	return os.WriteFile(fname, []byte(topic+" "+hex.EncodeToString(salt)+"\n"), 0600)
+}
+
+// passphraseSalt returns the salt for the configured topic: the salt given
+// with --passphrase-salt, the salt saved locally or, on first use, the salt
+// from the broker (saved locally, so later changes in the broker are ignored).
+func passphraseSalt(cfg globalConfig) ([]byte, error) {
+	fname := saltFileName(*cfg.passfile)
+	if *cfg.passsalt != "" {
+		salt, err := decodeSalt(*cfg.passsalt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --passphrase-salt: %v", err)
+		}
+		return salt, saveSalt(fname, *cfg.topic, salt)
+	}
+
+	salt, err := readSalt(fname, *cfg.topic)
+	if err != nil || salt != nil {
+		return salt, err
+	}
+	salt, err = brokerSalt(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := saveSalt(fname, *cfg.topic, salt); err != nil {
+		return nil, fmt.Errorf("unable to save salt: %v", err)
+	}
+	log.Infof("Salt for this passphrase saved to %s. Use --passphrase-salt=%x to set up other devices without the broker.", fname, salt)
+	return salt, nil
+}
+
+// brokerSalt returns the salt for the configured topic from the broker. A new
+// random salt is created and published if the topic has no salt yet. If other
+// clients create a salt at the same time, all of them use (and the creator
+// republishes) the smallest one.
+func brokerSalt(cfg globalConfig) ([]byte, error) {
+	// Always use the server: peers can't be authenticated without the key.
+	broker, err := newServerTransport(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to broker: %v", err)
+	}
+	defer broker.close()
+
+	topic := saltTopic(*cfg.topic)
+	ch := make(chan []byte, 16)
+	err = broker.subscribe([]string{topic}, 1, func(msg message) {
+		if len(msg.payload) == 0 {
+			return
+		}
+		select {
+		case ch <- msg.payload:
+		default:
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to subscribe to topic %s: %v", topic, err)
+	}
+
+	select {
+	case payload := <-ch:
+		salt, err := decodeSalt(string(payload))
+		if err != nil {
+			return nil, fmt.Errorf("invalid salt in topic %s: %v", topic, err)
+		}
+		log.Debugf("Using salt from topic %s", topic)
+		return salt, nil
+
+	case <-time.After(saltTimeout):
+	}
+
+	// No salt yet: we're the first client using this topic.
+	mine := make([]byte, saltLen)
+	if _, err := rand.Read(mine); err != nil {
+		return nil, fmt.Errorf("error creating salt: %v", err)
+	}
+	if err := broker.publish(topic, 1, true, []byte(hex.EncodeToString(mine))); err != nil {
+		return nil, fmt.Errorf("unable to publish salt to topic %s: %v", topic, err)
+	}
+
+	// Watch for salts created by other clients starting at the same time.
+	salt, conflict := mine, false
+	timeout := time.After(saltTimeout)
+	for done := false; !done; {
+		select {
+		case payload := <-ch:
+			other, err := decodeSalt(string(payload))
+			if err != nil || bytes.Equal(other, mine) {
+				continue
+			}
+			conflict = true
+			if bytes.Compare(other, salt) < 0 {
+				salt = other
+			}
+		case <-timeout:
+			done = true
+		}
+	}
+	if !bytes.Equal(salt, mine) {
+		log.Infof("Another client created a salt in topic %s at the same time. Using it.", topic)
+		return salt, nil
+	}
+	if conflict {
+		if err := broker.publish(topic, 1, true, []byte(hex.EncodeToString(mine))); err != nil {
+			return nil, fmt.Errorf("unable to publish salt to topic %s: %v", topic, err)
+		}
+	}
+	log.Infof("Created a new salt in topic %s", topic)
+	return salt, nil
+}
+
+// setPassphrase asks for a new passphrase (twice) and saves it to the file.
+func setPassphrase(fname string) error {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return errors.New("set-passphrase must be run from a terminal")
+	}
+	fmt.Fprint(os.Stderr, "New passphrase: ")
+	pass, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return err
+	}
+	if len(pass) < minPassphraseLen {
+		return fmt.Errorf("passphrase must be at least %d characters long", minPassphraseLen)
+	}
+	fmt.Fprint(os.Stderr, "Repeat passphrase: ")
+	again, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(pass, again) {
+		return errors.New("passphrases do not match")
+	}
+	if err := os.WriteFile(tildeExpand(fname), append(pass, '\n'), 0600); err != nil {
+		return err
+	}
+	// The salt saved for the previous passphrase (and topic) is no longer
+	// valid.
+	if err := os.Remove(saltFileName(fname)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	log.Infof("Passphrase saved to %s", fname)
+	return nil
+}
@@ -0,0 +1,36 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// keygencmd creates a new crypt file with a random key. Existing files are
+// only overwritten if force is set.
+func keygencmd(cryptfile string, force bool) error {
+	if fileExists(cryptfile) && !force {
+		return fmt.Errorf("crypt file %s already exists. Use --force to overwrite it", cryptfile)
+	}
+	if err := writeKeyFile(cryptfile); err != nil {
+		return err
+	}
+	log.Infof("Created a new crypt file with a random key at %s", cryptfile)
+	log.Infof("Copy this file to all machines syncing their clipboards.")
+	return nil
+}
+
+// writeKeyFile writes a new random key to the file, readable only by the user.
+func writeKeyFile(fname string) error {
+	key, err := createKey()
+	if err != nil {
+		return err
+	}
+	// WriteFile does not change the permissions of existing files.
+	if err := os.WriteFile(fname, append(key, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Chmod(fname, 0600)
+}
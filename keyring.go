@@ -0,0 +1,235 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+// Keyring
+//
+// The crypt file holds one key per line. The first line is the current key,
+// used for encryption and decryption. Keys replaced by "clipsync rotate-key"
+// are kept for decryption only, until the end of the grace period:
+//
+//	<current key>
+//	<previous key> until=<RFC3339 time>
+//	topic=<topic>
+//
+// The optional topic line pins the random topic (which is derived from the
+// key) so it doesn't change when the key is rotated. Legacy crypt files hold
+// a single 32 character password.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Length of key IDs, in bytes.
+const keyIDLen = 8
+
+// ringKey holds one key in the keyring.
+type ringKey struct {
+	key []byte
+	id  []byte
+	// Zero for the current key.
+	until time.Time
+}
+
+// keyring holds the current key and the previous keys still valid for
+// decryption. It's safe for concurrent use.
+type keyring struct {
+	sync.RWMutex
+	// Crypt file the keys were read from (blank in passphrase mode).
+	fname string
+	// keys[0] is the current key.
+	keys  []ringKey
+	topic string
+	// Cipher and padding used to encrypt.
+	opts cryptOptions
+}
+
+// keyID returns the ID of a key. IDs identify the key used to encrypt a
+// message without revealing anything about the key.
+func keyID(key []byte) []byte {
+	h := sha256.Sum256(append([]byte("clipsync key id:"), key...))
+	return h[:keyIDLen]
+}
+
+// newKeyring returns a keyring holding a single key.
+func newKeyring(key []byte) *keyring {
+	return &keyring{keys: []ringKey{{key: key, id: keyID(key)}}}
+}
+
+// readKeyring reads the keyring from the crypt file.
+func readKeyring(fname string) (*keyring, error) {
+	p, err := os.ReadFile(tildeExpand(fname))
+	if err != nil {
+		return nil, err
+	}
+
+	k := &keyring{fname: fname}
+	for n, line := range strings.Split(string(p), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "topic=") && len(line) != cryptKeyLen {
+			k.topic = strings.TrimPrefix(line, "topic=")
+			continue
+		}
+		fields := strings.Fields(line)
+		key, err := decodeKey(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s, line %d: %v", fname, n+1, err)
+		}
+		rk := ringKey{key: key, id: keyID(key)}
+		if len(fields) > 1 {
+			until := strings.TrimPrefix(fields[1], "until=")
+			if rk.until, err = time.Parse(time.RFC3339, until); err != nil {
+				return nil, fmt.Errorf("%s, line %d: invalid time: %v", fname, n+1, err)
+			}
+		}
+		k.keys = append(k.keys, rk)
+	}
+	if len(k.keys) == 0 || !k.keys[0].until.IsZero() {
+		return nil, fmt.Errorf("%s: the first line must contain the current key", fname)
+	}
+	return k, nil
+}
+
+// save writes the keyring back to the crypt file. Expired keys are dropped.
+func (k *keyring) save() error {
+	if k.fname == "" {
+		return errors.New("keys derived from a passphrase cannot be saved")
+	}
+	k.RLock()
+	defer k.RUnlock()
+
+	var buf bytes.Buffer
+	for _, rk := range k.keys {
+		if rk.until.IsZero() {
+			fmt.Fprintln(&buf, hex.EncodeToString(rk.key))
+			continue
+		}
+		if time.Now().Before(rk.until) {
+			fmt.Fprintf(&buf, "%s until=%s\n", hex.EncodeToString(rk.key), rk.until.Format(time.RFC3339))
+		}
+	}
+	if k.topic != "" {
+		fmt.Fprintf(&buf, "topic=%s\n", k.topic)
+	}
+	if err := os.WriteFile(tildeExpand(k.fname), buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Chmod(tildeExpand(k.fname), 0600)
+}
+
+// current returns the current key and its ID.
+func (k *keyring) current() ([]byte, []byte) {
+	k.RLock()
+	defer k.RUnlock()
+	return k.keys[0].key, k.keys[0].id
+}
+
+// lookup returns the key with the given ID, or nil if there's no such key or
+// its grace period ended.
+func (k *keyring) lookup(id []byte) []byte {
+	k.RLock()
+	defer k.RUnlock()
+	for _, rk := range k.keys {
+		if bytes.Equal(rk.id, id) && rk.valid() {
+			return rk.key
+		}
+	}
+	return nil
+}
+
+// decryptAny tries to decrypt the ciphertext with all valid keys. Used for
+// messages from older clients, which carry no key ID.
+func (k *keyring) decryptAny(ciphertext string, aad []byte) (string, error) {
+	k.RLock()
+	defer k.RUnlock()
+	err := errors.New("no valid keys")
+	for _, rk := range k.keys {
+		if !rk.valid() {
+			continue
+		}
+		var cleartext string
+		if cleartext, err = decrypt(ciphertext, rk.key, aad); err == nil {
+			return cleartext, nil
+		}
+	}
+	return "", err
+}
+
+// encrypt encrypts the cleartext with the current key.
+func (k *keyring) encrypt(cleartext, topic string) (string, error) {
+	return encrypt64(cleartext, topic, k)
+}
+
+// decrypt decrypts the ciphertext with the key it was encrypted with.
+func (k *keyring) decrypt(ciphertext, topic string) (string, error) {
+	return decrypt64(ciphertext, topic, k)
+}
+
+// has returns true if the keyring holds the key.
+func (k *keyring) has(key []byte) bool {
+	return k.lookup(keyID(key)) != nil
+}
+
+// rotate makes newKey the current key. The previous keys remain valid for
+// decryption until the given time. Previous keys are dropped if until is in
+// the past.
+func (k *keyring) rotate(newKey []byte, until time.Time) {
+	k.Lock()
+	defer k.Unlock()
+
+	keys := []ringKey{{key: newKey, id: keyID(newKey)}}
+	for _, rk := range k.keys {
+		if bytes.Equal(rk.key, newKey) {
+			continue
+		}
+		if rk.until.IsZero() || rk.until.After(until) {
+			rk.until = until
+		}
+		if rk.valid() {
+			keys = append(keys, rk)
+		}
+	}
+	k.keys = keys
+}
+
+// valid returns true if the key can still be used.
+func (rk ringKey) valid() bool {
+	return rk.until.IsZero() || time.Now().Before(rk.until)
+}
+
+// adoptKey makes newKey the current key after a rotation announced by a peer
+// (encrypted with the key with ID id) and saves the keyring. Only rotations
+// encrypted with the current key are adopted, so older keys can't replace
+// (or shorten the life of) newer ones. If topic is not blank and no topic is
+// pinned yet, it becomes the pinned topic.
+func (k *keyring) adoptKey(newKey []byte, until time.Time, topic string, id []byte) error {
+	if k.has(newKey) {
+		return nil
+	}
+	if k.fname == "" {
+		return errors.New("ignoring key rotation: keys are derived from a passphrase")
+	}
+	if _, current := k.current(); !bytes.Equal(id, current) {
+		return fmt.Errorf("ignoring key rotation encrypted with key %x: not the current key", id)
+	}
+	k.rotate(newKey, until)
+	k.Lock()
+	if k.topic == "" {
+		k.topic = topic
+	}
+	k.Unlock()
+	log.Infof("Adopted new encryption key %x (previous keys valid until %s)", keyID(newKey), until.Format(time.RFC3339))
+	return k.save()
+}
@@ -0,0 +1,200 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+// Logging
+//
+// Logs are written with log/slog to stderr, in the format chosen with
+// --log-format:
+//
+//	text      key=value lines
+//	json      one JSON object per line
+//	journald  native journal entries (see journald.go), with every field
+//	          as a journal field (E.g. EVENT=drop REASON=duplicate)
+//	auto      journald when stderr is connected to the journal (E.g.
+//	          running as a systemd unit), text otherwise
+//
+// Decisions made by the client are logged with an "event" field and, when
+// applicable, "sender", "size", "selection" and "reason" fields. Clipboard
+// contents must always be logged through redact.
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Log formats.
+const (
+	logFormatAuto     = "auto"
+	logFormatText     = "text"
+	logFormatJSON     = "json"
+	logFormatJournald = "journald"
+)
+
+// Extra log levels.
+const (
+	levelTrace    = slog.LevelDebug - 4
+	levelCritical = slog.LevelError + 4
+)
+
+// logger logs messages through a slog handler. Methods ending in "f" format
+// the message with fmt.Sprintf, the others take a constant message followed by
+// key/value pairs, like slog.
+type logger struct {
+	handler slog.Handler
+}
+
+// log is used by all functions in this namespace. The handler is replaced by
+// setupLogging.
+var log = &logger{handler: slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{ReplaceAttr: replaceLogAttr})}
+
+// emit logs a message at the given level. Must be called directly by the
+// logging methods, so the caller is reported correctly.
+func (l *logger) emit(level slog.Level, msg string, args ...any) {
+	ctx := context.Background()
+	if !l.handler.Enabled(ctx, level) {
+		return
+	}
+	// Skip runtime.Callers, emit and the logging method.
+	var pcs [1]uintptr
+	runtime.Callers(3, pcs[:])
+	r := slog.NewRecord(time.Now(), level, msg, pcs[0])
+	r.Add(args...)
+	l.handler.Handle(ctx, r)
+}
+
+// emitf formats and logs a message at the given level. Must be called directly
+// by the logging methods, so the caller is reported correctly.
+func (l *logger) emitf(level slog.Level, format string, v ...any) {
+	ctx := context.Background()
+	if !l.handler.Enabled(ctx, level) {
+		return
+	}
+	var pcs [1]uintptr
+	runtime.Callers(3, pcs[:])
+	l.handler.Handle(ctx, slog.NewRecord(time.Now(), level, fmt.Sprintf(format, v...), pcs[0]))
+}
+
+func (l *logger) Debug(msg string, args ...any) { l.emit(slog.LevelDebug, msg, args...) }
+func (l *logger) Info(msg string, args ...any)  { l.emit(slog.LevelInfo, msg, args...) }
+func (l *logger) Warn(msg string, args ...any)  { l.emit(slog.LevelWarn, msg, args...) }
+func (l *logger) Error(msg string, args ...any) { l.emit(slog.LevelError, msg, args...) }
+
+func (l *logger) Debugf(format string, v ...any) { l.emitf(slog.LevelDebug, format, v...) }
+func (l *logger) Infof(format string, v ...any)  { l.emitf(slog.LevelInfo, format, v...) }
+func (l *logger) Warnf(format string, v ...any)  { l.emitf(slog.LevelWarn, format, v...) }
+func (l *logger) Errorf(format string, v ...any) { l.emitf(slog.LevelError, format, v...) }
+
+// Tracef logs very verbose messages, shown only with --debug.
+func (l *logger) Tracef(format string, v ...any) { l.emitf(levelTrace, format, v...) }
+
+// Define a logger object that logs everything using log.Debug.
+// This is used by mqtt log levels.
+type mqttLogger struct{}
+
+func (mqttLogger) Println(v ...interface{}) {
+	log.emit(slog.LevelDebug, strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
+func (mqttLogger) Printf(format string, v ...interface{}) {
+	log.emitf(slog.LevelDebug, format, v...)
+}
+
+// fatal logs a critical message and exits with a return code.
+func fatal(v ...any) {
+	if v != nil {
+		log.emit(levelCritical, fmt.Sprint(v...))
+	}
+	os.Exit(1)
+}
+
+// fatalf logs a formatted critical message and exits with a return code.
+func fatalf(f string, v ...any) {
+	if v != nil {
+		log.emitf(levelCritical, f, v...)
+	}
+	os.Exit(1)
+}
+
+// setupLogging configures the logging parameters from the command line
+// options and other conditions. Must be called before starting goroutines.
+func setupLogging(cfg globalConfig) {
+	level := slog.LevelInfo
+	if *cfg.verbose {
+		level = slog.LevelDebug
+	}
+	if *cfg.debug {
+		level = levelTrace
+	}
+
+	format := *cfg.logformat
+	if format == logFormatAuto {
+		format = logFormatText
+		if stderrIsJournal() {
+			format = logFormatJournald
+		}
+	}
+
+	opts := &slog.HandlerOptions{
+		AddSource:   *cfg.verbose || *cfg.debug,
+		Level:       level,
+		ReplaceAttr: replaceLogAttr,
+	}
+	switch format {
+	case logFormatJSON:
+		log.handler = slog.NewJSONHandler(os.Stderr, opts)
+	case logFormatJournald:
+		h, err := newJournalHandler(level)
+		if err == nil {
+			log.handler = h
+			return
+		}
+		log.handler = slog.NewTextHandler(os.Stderr, opts)
+		log.Warnf("Unable to log to journald, using text: %v", err)
+	default:
+		log.handler = slog.NewTextHandler(os.Stderr, opts)
+	}
+}
+
+// replaceLogAttr names our extra log levels and removes the timestamp if
+// stderr does not point to a tty (syslog and journald already add it).
+func replaceLogAttr(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) != 0 {
+		return a
+	}
+	switch a.Key {
+	case slog.TimeKey:
+		if fi, _ := os.Stderr.Stat(); (fi.Mode() & os.ModeCharDevice) == 0 {
+			return slog.Attr{}
+		}
+	case slog.LevelKey:
+		switch a.Value.Any().(slog.Level) {
+		case levelTrace:
+			a.Value = slog.StringValue("TRACE")
+		case levelCritical:
+			a.Value = slog.StringValue("CRITICAL")
+		}
+	}
+	return a
+}
+
+// stderrIsJournal returns true if stderr is connected to the journal. Systemd
+// sets $JOURNAL_STREAM to the device and inode of the stream ("dev:inode").
+func stderrIsJournal() bool {
+	dev, ino, ok := strings.Cut(os.Getenv("JOURNAL_STREAM"), ":")
+	if !ok {
+		return false
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(os.Stderr.Fd()), &st); err != nil {
+		return false
+	}
+	return dev == strconv.FormatUint(uint64(st.Dev), 10) && ino == strconv.FormatUint(st.Ino, 10)
+}
@@ -8,14 +8,15 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
-	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/alecthomas/kingpin/v2"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
-	log "github.com/romana/rlog"
 )
 
 const (
@@ -23,6 +24,8 @@ const (
 	configDir         = "~/.config/clipsync"
 	configFile        = "config"
 	cryptPasswordFile = "crypt-password"
+	defaultTopic      = "clipsync"
+	publicServer      = "test.mosquitto.org:1883"
 	syncerLockDir     = "/tmp"
 )
 
@@ -35,15 +38,33 @@ var BuildVersion string
 type globalConfig struct {
 	cafile       *string
 	cert         []byte
+	cipher       *string
+	compress     *bool
 	debug        *bool
 	cryptfile    *string
+	device       *string
+	encryption   *string
+	legacytopic  *bool
+	logformat    *string
+	maxchunk     *int
 	mqttdebug    *bool
 	nocolors     *bool
+	noencrypt    *bool
+	p2p          *bool
+	p2pkey       []byte
+	p2pport      *int
+	padding      *string
+	padbucket    *int
 	password     *string
 	passwordfile *string
+	passfile     *string
+	passsalt     *string
+	legacymsgs   *string
 	randomtopic  *bool
 	redactlevel  *int
+	replaywindow *time.Duration
 	server       *string
+	sign         *bool
 	topic        *string
 	user         *string
 	verbose      *bool
@@ -51,9 +72,12 @@ type globalConfig struct {
 
 // clientConfig holds the options for the "client" operation.
 type clientConfig struct {
-	chromequirk *bool
-	syncsel     *bool
-	polltime    *int
+	backend       *string
+	chromequirk   *bool
+	mimetypes     *[]string
+	metricslisten *string
+	syncsel       *bool
+	polltime      *int
 }
 
 // The redact object is used by other functions in this namespace.
@@ -85,27 +109,11 @@ func randomTopic(pass []byte) string {
 	return strings.Join(frags, "/")
 }
 
-// readCryptPassword will read the crypt password file and return it.
-func readCryptPassword(fname string) ([]byte, error) {
-	var pass []byte
-
-	p, err := os.ReadFile(tildeExpand(fname))
-	if err != nil {
-		return nil, err
-	}
-	pass = []byte(strings.TrimRight(string(p), "\n"))
-	if len(pass) != cryptKeyLen {
-		return nil, errors.New("crypt password must be exactly 32 characters")
-	}
-
-	return pass, nil
-}
-
 // initConfig creates the basic configuration directories under home and generates
 // a new crypt-password file with a random password in our default location if
-// cryptfile is blank. Returns the name of the cryptfile used (or created). This
-// will be the input cryptfile or the default location if cryptfile = blank.
-func initConfig(d, f string) (string, error) {
+// cryptfile is blank and create is set. Returns the name of the cryptfile used (or
+// created). This will be the input cryptfile or the default location if cryptfile = blank.
+func initConfig(d, f string, create bool) (string, error) {
 	dir := tildeExpand(d)
 	cryptfile := tildeExpand(f)
 
@@ -121,38 +129,59 @@ func initConfig(d, f string) (string, error) {
 
 	// Default location.
 	cryptfile = filepath.Join(tildeExpand(configDir), tildeExpand(cryptPasswordFile))
-	log.Infof("Using crypt file: %s", cryptfile)
+	if create {
+		log.Infof("Using crypt file: %s", cryptfile)
+	}
 
 	// Create a brand new crypt file if it does not exist.
-	if !fileExists(cryptfile) {
-		p := createPassword()
-		if err := os.WriteFile(cryptfile, p, 0700); err != nil {
+	if create && !fileExists(cryptfile) {
+		if err := writeKeyFile(cryptfile); err != nil {
 			return "", err
 		}
-		log.Infof("Created a new crypt file with a random password at %s", cryptfile)
+		log.Infof("Created a new crypt file with a random key at %s", cryptfile)
 	}
 
 	return cryptfile, nil
 }
 
 func main() {
-	var err error
+	var (
+		err         error
+		maxchunkSet bool
+	)
 
 	// General flags
 	app := kingpin.New("clipsync", "Sync clipboard across machines")
 
 	cfg := globalConfig{
 		cafile:       app.Flag("cafile", "CA certificates file (usually /etc/ssl/certs/ca-certificates.crt").String(),
-		debug:        app.Flag("debug", "Make verbose more verbose").Short('D').Bool(),
+		cipher:       app.Flag("cipher", "Cipher used to encrypt messages with shared encryption (aes-256-gcm, xchacha20-poly1305).").Default(cipherAESGCM).Enum(cipherAESGCM, cipherXChaCha),
+		compress:     app.Flag("compress", "Compress large messages before sending (receivers always accept compressed messages).").Bool(),
+		debug:        app.Flag("debug", "Make verbose more verbose (also log traces)").Short('D').Bool(),
 		cryptfile:    app.Flag("crypt-file", "File containing a 32-byte clipboard encryption password").String(),
+		device:       app.Flag("device-name", "Name of this device, as shown to other clients (default: hostname)").String(),
+		encryption:   app.Flag("encryption", "Encryption mode: shared (crypt file or passphrase) or age (per-device keys).").Default(encryptionShared).Enum(encryptionShared, encryptionAge),
+		legacytopic:  app.Flag("legacy-topic", "Derive random topics from the plain SHA-256 of the key (compatible with older versions).").Bool(),
+		logformat:    app.Flag("log-format", "Log format (auto, text, json, journald). Auto uses journald under systemd.").Default(logFormatAuto).Enum(logFormatAuto, logFormatText, logFormatJSON, logFormatJournald),
+		maxchunk:     app.Flag("max-chunk-size", "Split messages larger than this many bytes into chunks (0 = never split).").IsSetByUser(&maxchunkSet).Default(strconv.Itoa(defaultMaxChunkSize)).Int(),
 		mqttdebug:    app.Flag("mqtt-debug", "Turn on MQTT debugging").Bool(),
 		nocolors:     app.Flag("no-colors", "No colors on log output to terminal.").Bool(),
+		noencrypt:    app.Flag("no-encrypt", "Send unencrypted JSON messages (only for trusted private servers).").Bool(),
+		p2p:          app.Flag("p2p", "Sync directly with peers on the local network (found with mDNS), using the server only if no peers are found.").Bool(),
+		p2pport:      app.Flag("p2p-port", "TCP port for connections from peers (0 = random).").Int(),
+		padding:      app.Flag("padding", "Pad messages to hide their length (none, pow2, bucket).").Default(paddingNone).Enum(paddingNone, paddingPow2, paddingBucket),
+		padbucket:    app.Flag("padding-bucket-size", "Pad messages to a multiple of this many bytes (with --padding=bucket).").Default("4096").Int(),
 		password:     app.Flag("password", "MQTT password").Short('p').String(),
 		passwordfile: app.Flag("password-file", "File containing the MQTT password").String(),
+		passfile:     app.Flag("passphrase-file", "File containing the clipboard encryption passphrase (default: "+configDir+"/"+passphraseFile+", if present).").String(),
+		passsalt:     app.Flag("passphrase-salt", "Salt for the passphrase, in hex (default: saved locally or read from the broker on first use).").String(),
+		legacymsgs:   app.Flag("legacy-messages", "Accept messages from older clients, which can't be checked for replays: auto (until a newer client is seen), accept or reject.").Default(legacyAuto).Enum(legacyAuto, legacyAccept, legacyReject),
 		randomtopic:  app.Flag("random-topic", "Use a random topic name based on your encryption key.").Bool(),
 		redactlevel:  app.Flag("redact-level", "Max number of characters to show on redacted messages").Int(),
-		server:       app.Flag("server", "MQTT broker URL. E.g. ssl://ip:port.").Short('s').String(),
-		topic:        app.Flag("topic", "MQTT topic").Short('t').Default("clipsync").String(),
+		replaywindow: app.Flag("replay-window", "Reject messages older than this (0 = accept messages of any age).").Default("10m").Duration(),
+		server:       app.Flag("server", "Server URL. E.g. ssl://ip:port (MQTT), nats://ip:port or redis://ip:port.").Short('s').String(),
+		sign:         app.Flag("sign", "Sign outgoing messages with this device's signing key.").Bool(),
+		topic:        app.Flag("topic", "MQTT topic").Short('t').Default(defaultTopic).String(),
 		user:         app.Flag("user", "MQTT user").Short('u').String(),
 		verbose:      app.Flag("verbose", "Verbose mode.").Short('v').Bool(),
 	}
@@ -160,17 +189,86 @@ func main() {
 	// Client
 	clientCmd := app.Command("client", "Connect to a server and sync clipboards.")
 	clientcfg := clientConfig{
-		chromequirk: clientCmd.Flag("fix-chrome-quirk", "Protect clipboard against one-character copies.").Bool(),
-		syncsel:     clientCmd.Flag("sync-selections", "Synchonize primary (middle mouse) and clipboard (Ctrl-C/V).").Short('S').Bool(),
-		polltime:    app.Flag("poll-time", "Time between clipboard reads (in seconds)").Short('P').Default("1").Int(),
+		backend:       clientCmd.Flag("backend", "Clipboard backend (auto, x11, wayland).").Default(backendAuto).Enum(backendAuto, backendX11, backendWayland),
+		chromequirk:   clientCmd.Flag("fix-chrome-quirk", "Protect clipboard against one-character copies.").Bool(),
+		metricslisten: clientCmd.Flag("metrics-listen", "Serve Prometheus metrics on this address (E.g. localhost:9292).").String(),
+		mimetypes:     clientCmd.Flag("mime-types", "Mime types to synchronize, in order of preference (repeat for multiple types).").Default(defaultMimeTypes...).Strings(),
+		syncsel:       clientCmd.Flag("sync-selections", "Synchonize primary (middle mouse) and clipboard (Ctrl-C/V).").Short('S').Bool(),
+		polltime:      app.Flag("poll-time", "Time between clipboard reads (in seconds)").Short('P').Default("1").Int(),
 	}
 
 	// Copy
 	copyCmd := app.Command("copy", "Send contents of stdin to all clipboards.")
 	copyCmdFilter := copyCmd.Flag("filter", "Work as a filter: also copy stdin to stdout.").Short('f').Bool()
+	copyCmdType := copyCmd.Flag("type", "Mime type of the data in stdin (E.g. image/png).").Short('T').Default(mimeTextPlain).String()
 
 	// Paste
 	pasteCmd := app.Command("paste", "Paste from the server clipboard.")
+	pasteCmdType := pasteCmd.Flag("type", "Mime type to paste (E.g. image/png).").Short('T').Default(mimeTextPlain).String()
+
+	// Pause/Resume
+	pauseCmd := app.Command("pause", "Pause syncing in the running client.")
+	resumeCmd := app.Command("resume", "Resume syncing in the running client.")
+
+	// Status
+	statusCmd := app.Command("status", "Show the status of the client running for this display.")
+	statusCmdJSON := statusCmd.Flag("json", "Show the status in JSON.").Bool()
+	statusCmdShort := statusCmd.Flag("short", "Show the status in one line (E.g. for status bars).").Bool()
+
+	// Keygen
+	keygenCmd := app.Command("keygen", "Create a new crypt file with a random key.")
+	keygenCmdForce := keygenCmd.Flag("force", "Overwrite an existing crypt file.").Bool()
+
+	// Rotate key
+	rotateKeyCmd := app.Command("rotate-key", "Replace the encryption key and announce the new key to online peers.")
+	rotateKeyCmdGrace := rotateKeyCmd.Flag("grace-period", "Time during which the previous keys remain valid for decryption.").Default("168h").Duration()
+	rotateKeyCmdRevoke := rotateKeyCmd.Flag("revoke", "Revoke the previous keys immediately and don't announce the new key.").Bool()
+
+	// Devices
+	deviceCmd := app.Command("device", "Manage the devices allowed to read our messages (with --encryption=age).")
+	deviceIDCmd := deviceCmd.Command("id", "Show the recipient (public key) of this device.")
+	deviceListCmd := deviceCmd.Command("list", "List the devices allowed to read our messages.")
+	deviceAddCmd := deviceCmd.Command("add", "Allow a device to read our messages.")
+	deviceAddCmdName := deviceAddCmd.Arg("name", "Device name.").Required().String()
+	deviceAddCmdRecipient := deviceAddCmd.Arg("recipient", "Device recipient, as shown by \"clipsync device id\" on that device.").Required().String()
+	deviceRemoveCmd := deviceCmd.Command("remove", "Stop a device from reading our messages.")
+	deviceRemoveCmdName := deviceRemoveCmd.Arg("name", "Device name.").Required().String()
+
+	// Signers
+	signerCmd := app.Command("signer", "Manage the devices trusted to send us messages.")
+	signerIDCmd := signerCmd.Command("id", "Show the signing public key of this device.")
+	signerListCmd := signerCmd.Command("list", "List the trusted signers.")
+	signerTrustCmd := signerCmd.Command("trust", "Accept messages signed by a device (and reject unsigned messages).")
+	signerTrustCmdName := signerTrustCmd.Arg("name", "Signer name.").Required().String()
+	signerTrustCmdKey := signerTrustCmd.Arg("pubkey", "Signing public key, as shown by \"clipsync signer id\" on that device.").Required().String()
+	signerUntrustCmd := signerCmd.Command("untrust", "Stop accepting messages signed by a device.")
+	signerUntrustCmdName := signerUntrustCmd.Arg("name", "Signer name.").Required().String()
+
+	// Pairing
+	pairCmd := app.Command("pair", "Show a one-time code to set up a new device, or set up this device with a code.")
+	pairCmdCode := pairCmd.Arg("code", "Pairing code shown by \"clipsync pair\" on the other device.").String()
+	pairCmdServer := pairCmd.Flag("pairing-server", "MQTT broker used for pairing, without credentials (default: the configured server).").String()
+	pairCmdForce := pairCmd.Flag("force", "Overwrite an existing crypt file.").Bool()
+
+	// Set passphrase
+	setPassphraseCmd := app.Command("set-passphrase", "Set the clipboard encryption passphrase (instead of a crypt file).")
+
+	// Server
+	serverCmd := app.Command("server", "Run an MQTT broker for other clients (E.g. --server=<this host>).")
+	srvcfg := serverConfig{
+		listen:    serverCmd.Flag("listen", "Address to listen on (default :1883, or :8883 with TLS).").String(),
+		certfile:  serverCmd.Flag("tls-cert", "TLS certificate file (enables TLS).").String(),
+		keyfile:   serverCmd.Flag("tls-key", "TLS private key file.").String(),
+		usersfile: serverCmd.Flag("users-file", "File with <user>:<password> lines (plain text or bcrypt).").String(),
+		aclfile:   serverCmd.Flag("acl-file", "File with <user> <read|write|readwrite> <topic filter> lines.").String(),
+		maxsize:   serverCmd.Flag("max-message-size", "Reject messages larger than this many bytes.").Default(strconv.Itoa(defaultServerMaxSize)).Int(),
+	}
+
+	// SSH config
+	sshConfigCmd := app.Command("ssh-config", "Show the ssh config to forward the client to a remote host.")
+	sshConfigCmdHost := sshConfigCmd.Arg("host", "Remote host (as used in \"ssh <host>\").").Default("*").String()
+	sshConfigCmdUser := sshConfigCmd.Flag("remote-user", "User name on the remote host (default: local user).").String()
+	sshConfigCmdSocket := sshConfigCmd.Flag("remote-socket", "Path of the forwarded socket on the remote host, in a private directory (default: /tmp/clipsync-<user>.sock).").String()
 
 	// Version
 	versionCmd := app.Command("version", "Show version information.")
@@ -181,14 +279,131 @@ func main() {
 
 	setupLogging(cfg)
 
+	if cmdline == versionCmd.FullCommand() {
+		fmt.Printf("Build Version: %s\n", BuildVersion)
+		os.Exit(0)
+	}
+
+	// The server needs no keys or clipboard.
+	if cmdline == serverCmd.FullCommand() {
+		if (*srvcfg.certfile == "") != (*srvcfg.keyfile == "") {
+			fatal("Please specify both --tls-cert and --tls-key.")
+		}
+		if err := servercmd(srvcfg); err != nil {
+			fatal(err)
+		}
+		os.Exit(0)
+	}
+
+	if cmdline == sshConfigCmd.FullCommand() {
+		if err := sshconfigcmd(*sshConfigCmdHost, *sshConfigCmdUser, *sshConfigCmdSocket); err != nil {
+			fatal(err)
+		}
+		os.Exit(0)
+	}
+
+	// Copy, paste, pause and status through the running client (if any),
+	// which needs no keys or connection to the server.
+	var copyData []byte
+	controlSocket := localControlSocket()
+	err = errNoClient
+	switch cmdline {
+	case copyCmd.FullCommand():
+		if copyData, err = io.ReadAll(os.Stdin); err != nil {
+			fatalf("Unable to read data from stdin: %v", err)
+		}
+		err = controlcopycmd(controlSocket, copyData, *copyCmdFilter, *copyCmdType)
+	case pasteCmd.FullCommand():
+		err = controlpastecmd(controlSocket, *pasteCmdType)
+	case pauseCmd.FullCommand(), resumeCmd.FullCommand():
+		if err = controlpausecmd(controlSocket, cmdline == pauseCmd.FullCommand()); errors.Is(err, errNoClient) {
+			fatal("No clipsync client running for this display.")
+		}
+	case statusCmd.FullCommand():
+		if err = statuscmd(controlSocket, displayLockFile(), *statusCmdJSON, *statusCmdShort); errors.Is(err, errNoClient) {
+			fatal("No clipsync client running for this display.")
+		}
+	}
+	switch {
+	case err == nil:
+		os.Exit(0)
+	case !errors.Is(err, errNoClient):
+		fatal(err)
+	case os.Getenv(controlSocketEnv) != "" && (cmdline == copyCmd.FullCommand() || cmdline == pasteCmd.FullCommand()):
+		// Never fall back to the server (and create keys) on remote hosts.
+		fatalf("Unable to reach the client through $%s (%s): %v", controlSocketEnv, controlSocket, err)
+	}
+
+	// Use passphrase mode if requested or the default passphrase file exists.
+	defaultPassfile := filepath.Join(tildeExpand(configDir), passphraseFile)
+	if *cfg.passfile == "" && (fileExists(defaultPassfile) || cmdline == setPassphraseCmd.FullCommand()) {
+		*cfg.passfile = defaultPassfile
+	}
+
 	// Create basic directories and a crypt file containing a
 	// random key, if it doesn't yet exist and is in the default
 	// location (blank).
-	*cfg.cryptfile, err = initConfig(configDir, *cfg.cryptfile)
+	joining := cmdline == pairCmd.FullCommand() && *pairCmdCode != ""
+	createCrypt := *cfg.encryption == encryptionShared && *cfg.passfile == "" && !*cfg.noencrypt && cmdline != keygenCmd.FullCommand() && !joining
+	*cfg.cryptfile, err = initConfig(configDir, *cfg.cryptfile, createCrypt)
 	if err != nil {
 		fatalf("Error initializing configuration: %v", err)
 	}
 
+	// Device management (per-device encryption).
+	identityPath := filepath.Join(tildeExpand(configDir), identityFile)
+	recipientsPath := filepath.Join(tildeExpand(configDir), recipientsFile)
+	switch cmdline {
+	case deviceIDCmd.FullCommand():
+		err = deviceidcmd(identityPath)
+	case deviceListCmd.FullCommand():
+		err = devicelistcmd(recipientsPath)
+	case deviceAddCmd.FullCommand():
+		err = deviceaddcmd(recipientsPath, *deviceAddCmdName, *deviceAddCmdRecipient)
+	case deviceRemoveCmd.FullCommand():
+		err = deviceremovecmd(recipientsPath, *deviceRemoveCmdName)
+	}
+	if err != nil {
+		fatal(err)
+	}
+	if strings.HasPrefix(cmdline, deviceCmd.FullCommand()+" ") {
+		os.Exit(0)
+	}
+
+	// Trusted signers.
+	signingKeyPath := filepath.Join(tildeExpand(configDir), signingKeyFile)
+	trustedPath := filepath.Join(tildeExpand(configDir), trustedSignersFile)
+	switch cmdline {
+	case signerIDCmd.FullCommand():
+		err = signeridcmd(signingKeyPath)
+	case signerListCmd.FullCommand():
+		err = signerlistcmd(trustedPath)
+	case signerTrustCmd.FullCommand():
+		err = signertrustcmd(trustedPath, *signerTrustCmdName, *signerTrustCmdKey)
+	case signerUntrustCmd.FullCommand():
+		err = signeruntrustcmd(trustedPath, *signerUntrustCmdName)
+	}
+	if err != nil {
+		fatal(err)
+	}
+	if strings.HasPrefix(cmdline, signerCmd.FullCommand()+" ") {
+		os.Exit(0)
+	}
+
+	if cmdline == keygenCmd.FullCommand() {
+		if err := keygencmd(*cfg.cryptfile, *keygenCmdForce); err != nil {
+			fatal(err)
+		}
+		os.Exit(0)
+	}
+
+	if cmdline == setPassphraseCmd.FullCommand() {
+		if err := setPassphrase(*cfg.passfile); err != nil {
+			fatal(err)
+		}
+		os.Exit(0)
+	}
+
 	// Read MQTT password from file, if requested.
 	if *cfg.passwordfile != "" {
 		p, err := os.ReadFile(tildeExpand(*cfg.passwordfile))
@@ -198,11 +413,6 @@ func main() {
 		*cfg.password = strings.TrimRight(string(p), "\n")
 	}
 
-	cryptPassword, err := readCryptPassword(*cfg.cryptfile)
-	if err != nil {
-		fatalf("Error reading crypt password: %v", err)
-	}
-
 	// Read CA File into our filesystem, if requested.
 	if *cfg.cafile != "" {
 		cfg.cert, err = os.ReadFile(*cfg.cafile)
@@ -216,7 +426,7 @@ func main() {
 
 	// MQTT debugging
 	if *cfg.mqttdebug {
-		mqttlog := rlogger{}
+		mqttlog := mqttLogger{}
 		mqtt.DEBUG = mqttlog
 		mqtt.ERROR = mqttlog
 		mqtt.CRITICAL = mqttlog
@@ -227,16 +437,14 @@ func main() {
 	// (test.mosquitto.org).  There's a number of parameters that we need to
 	// override.
 	if *cfg.server == "" {
+		if *cfg.noencrypt {
+			fatal("Unencrypted mode (--no-encrypt) requires a private server (--server).")
+		}
 		log.Info("No server specified. Using public server. YMMV.")
 		*cfg.user = ""
 		*cfg.password = ""
 		*cfg.randomtopic = true
-		*cfg.server = "test.mosquitto.org:1883"
-	}
-
-	// if randomtopic uses a random topic based on the sha256 of the cryptPassword.
-	if *cfg.randomtopic {
-		*cfg.topic = randomTopic(cryptPassword)
+		*cfg.server = publicServer
 	}
 
 	// Make sure host is not blank after any possible overrides.
@@ -244,6 +452,127 @@ func main() {
 		fatal("I don't have a server right before starting to work. This should not happen.")
 	}
 
+	// Set up this device with a pairing code (before reading the keys).
+	if joining {
+		if err := pairjoincmd(cfg, *pairCmdCode, *pairCmdServer, *pairCmdForce); err != nil {
+			fatal(err)
+		}
+		os.Exit(0)
+	}
+
+	// Read the keys from the crypt file, derive the key from the passphrase,
+	// use per-device keys, or no encryption at all. If randomtopic is set, use
+	// a random topic based on the key or passphrase (unless pinned in the
+	// crypt file).
+	var (
+		crypt crypter
+		keys  *keyring
+	)
+	switch {
+	case *cfg.noencrypt:
+		if *cfg.randomtopic {
+			fatal("Random topics (--random-topic) require encryption.")
+		}
+		// JSON messages are never compressed, split or signed.
+		switch {
+		case *cfg.compress:
+			fatal("Compression (--compress) requires encryption.")
+		case maxchunkSet && *cfg.maxchunk != 0:
+			fatal("Chunked messages (--max-chunk-size) require encryption.")
+		case *cfg.sign:
+			fatal("Signed messages (--sign) require encryption.")
+		}
+		log.Warn("Encryption disabled: clipboard contents are sent as plain text.")
+
+	case *cfg.encryption == encryptionAge:
+		// There's no shared secret, so random topics are derived from the
+		// topic name, which must be chosen by the user.
+		if *cfg.randomtopic {
+			if *cfg.topic == defaultTopic {
+				fatal("Per-device encryption with a random topic requires a unique --topic name (shared by all devices).")
+			}
+			*cfg.topic = randomTopic([]byte(*cfg.topic))
+		}
+		crypt, err = newAgeCrypter(identityPath, recipientsPath)
+		if err != nil {
+			fatalf("Error reading device identity: %v", err)
+		}
+
+	case *cfg.passfile != "":
+		passphrase, err := readPassphrase(*cfg.passfile)
+		if err != nil {
+			fatalf("Error reading passphrase: %v", err)
+		}
+		// The salt is kept under the topic chosen by the user, and the
+		// random topic derived from the (salted) key.
+		if *cfg.randomtopic && *cfg.topic == defaultTopic {
+			fatal("Passphrases with a random topic require a unique --topic name (shared by all devices).")
+		}
+		salt, err := passphraseSalt(cfg)
+		if err != nil {
+			fatalf("Error reading passphrase salt: %v", err)
+		}
+		keys = newKeyring(deriveKey(passphrase, salt))
+		if *cfg.randomtopic {
+			key, _ := keys.current()
+			*cfg.topic = randomTopic(subkey(key, subkeyTopic))
+		}
+		crypt = keys
+
+	default:
+		keys, err = readKeyring(*cfg.cryptfile)
+		if err != nil {
+			fatalf("Error reading crypt password: %v", err)
+		}
+		if *cfg.randomtopic {
+			key, _ := keys.current()
+			*cfg.topic = randomTopic(subkey(key, subkeyTopic))
+			if *cfg.legacytopic {
+				*cfg.topic = randomTopic(key)
+			}
+			if keys.topic != "" {
+				*cfg.topic = keys.topic
+			}
+		}
+		crypt = keys
+	}
+
+	sig, err := newSigner(*cfg.sign, signingKeyPath, trustedPath)
+	if err != nil {
+		fatalf("Error reading signing key: %v", err)
+	}
+
+	// Anyone can encrypt to a device's public key, so per-device encryption
+	// only accepts messages from trusted signers.
+	if *cfg.encryption == encryptionAge && !*cfg.noencrypt {
+		trusted, err := readTrustedSigners(trustedPath)
+		if err != nil {
+			fatalf("Error reading trusted signers: %v", err)
+		}
+		if !*cfg.sign || len(trusted) == 0 {
+			fatal("Per-device encryption (--encryption=age) requires signed messages (--sign) and trusted signers (see 'clipsync signer trust').")
+		}
+		sig.requireTrusted = true
+	}
+
+	if keys != nil {
+		keys.opts = cryptOptions{cipher: *cfg.cipher, padding: *cfg.padding, bucketSize: *cfg.padbucket}
+	}
+
+	// Peers authenticate each other with a subkey of the shared key.
+	if *cfg.p2p {
+		if keys == nil {
+			fatal("Peer-to-peer sync (--p2p) requires shared encryption (a crypt file or passphrase).")
+		}
+		key, _ := keys.current()
+		cfg.p2pkey = subkey(key, subkeyP2P)
+	}
+
+	// Device name defaults to the hostname.
+	if *cfg.device == "" {
+		*cfg.device, _ = os.Hostname()
+	}
+
 	// Unique instance ID.
 	instanceID, err := instanceID()
 	if err != nil {
@@ -251,41 +580,59 @@ func main() {
 	}
 	log.Debugf("Instance ID: %s", instanceID)
 
+	localDeviceID, err = loadDeviceID(filepath.Join(tildeExpand(configDir), deviceIDFile))
+	if err != nil {
+		fatalf("Error reading device ID: %v", err)
+	}
+
 	switch cmdline {
 	case pasteCmd.FullCommand():
-		if err := pastecmd(cfg, instanceID, cryptPassword); err != nil {
+		if err := pastecmd(cfg, instanceID, crypt, sig, *pasteCmdType); err != nil {
 			fatal(err)
 		}
 
 	case copyCmd.FullCommand():
-		if err := copycmd(cfg, instanceID, cryptPassword, *copyCmdFilter); err != nil {
+		if err := copycmd(cfg, instanceID, crypt, sig, copyData, *copyCmdFilter, *copyCmdType); err != nil {
+			fatal(err)
+		}
+
+	case rotateKeyCmd.FullCommand():
+		if keys == nil {
+			fatal("rotate-key only works with shared encryption (--encryption=shared).")
+		}
+		if err := rotatekeycmd(cfg, keys, sig, instanceID, *rotateKeyCmdGrace, *rotateKeyCmdRevoke); err != nil {
+			fatal(err)
+		}
+
+	case pairCmd.FullCommand():
+		if keys == nil {
+			fatal("pair only works with shared encryption (--encryption=shared).")
+		}
+		if err := pairoffercmd(cfg, keys, *pairCmdServer); err != nil {
 			fatal(err)
 		}
 
 	case clientCmd.FullCommand():
-		// Single instance of client.
-		// Client mode only makes sense if the DISPLAY environment
-		// variable is set (otherwise we don't have a clipboard to sync).
-		display := os.Getenv("DISPLAY")
-		if display == "" {
-			fatal("Client mode requires the DISPLAY variable to be set")
-		}
-		re := regexp.MustCompile(`:[0-9]+`)
-		match := re.FindString(display)
-		if match == "" {
-			fatalf("Unable to parse display number from DISPLAY environment var: %s", display)
-		}
-		lckfile := fmt.Sprintf("%s/clipsync-lock-%s.lock", syncerLockDir, match[1:])
+		// Single instance of client per display.
+		// Client mode only makes sense if the WAYLAND_DISPLAY or DISPLAY
+		// environment variables are set (otherwise we don't have a
+		// clipboard to sync).
+		*clientcfg.backend, err = detectBackend(*clientcfg.backend)
+		if err != nil {
+			fatal(err)
+		}
+		display, err := displayName(*clientcfg.backend)
+		if err != nil {
+			fatal(err)
+		}
+		lckfile := clientLockFile(display)
 		log.Debugf("Using lockfile: %s", lckfile)
 		lock := singleInstanceOrDie(lckfile)
 		defer lock.Unlock()
 
-		if err := clientcmd(cfg, clientcfg, instanceID, cryptPassword); err != nil {
+		if err := clientcmd(cfg, clientcfg, instanceID, crypt, sig); err != nil {
 			fatal(err)
 		}
-
-	case versionCmd.FullCommand():
-		fmt.Printf("Build Version: %s\n", BuildVersion)
 	}
 	os.Exit(0)
 }
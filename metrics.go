@@ -0,0 +1,112 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+// Metrics
+//
+// The client keeps Prometheus metrics about published, received and dropped
+// messages, clipboard backend calls and the connection to the server. They
+// are served on /metrics when --metrics-listen is given.
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Reasons for dropping received messages.
+const (
+	dropDuplicate = "duplicate"
+	dropOwnEcho   = "own_echo"
+	dropDecrypt   = "decrypt_failure"
+	dropEmpty     = "empty"
+	dropInvalid   = "invalid"
+	dropUntrusted = "untrusted"
+	dropReplay    = "replay"
+	dropPaused    = "paused"
+)
+
+// Time between checks of the connection to the server.
+const metricsConnectionPoll = time.Second
+
+var (
+	metricPublished = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "clipsync_messages_published_total",
+		Help: "Clipboard contents published to the server.",
+	})
+	metricPublishErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "clipsync_publish_errors_total",
+		Help: "Clipboard contents that could not be published.",
+	})
+	metricReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "clipsync_messages_received_total",
+		Help: "Messages received from the server (including chunks and key rotations).",
+	})
+	metricDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "clipsync_messages_dropped_total",
+		Help: "Received messages ignored, by reason.",
+	}, []string{"reason"})
+	metricPayloadBytes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "clipsync_payload_bytes",
+		Help:    "Size of the clipboard contents sent and received.",
+		Buckets: prometheus.ExponentialBuckets(64, 4, 10),
+	}, []string{"direction"})
+	metricSelectionChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "clipsync_selection_changes_total",
+		Help: "Selection changes reported by the clipboard backend.",
+	}, []string{"selection"})
+	metricBackendDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "clipsync_backend_call_duration_seconds",
+		Help:    "Latency of calls to the clipboard backend.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 12),
+	}, []string{"op", "selection"})
+	metricConnected = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "clipsync_broker_connected",
+		Help: "Whether the connection to the server is up (1) or down (0).",
+	})
+	metricReconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "clipsync_broker_reconnects_total",
+		Help: "Times the connection to the server was restored.",
+	})
+)
+
+// observeBackendCall records the latency of a clipboard backend call started
+// at start.
+func observeBackendCall(op, sel string, start time.Time) {
+	metricBackendDuration.WithLabelValues(op, sel).Observe(time.Since(start).Seconds())
+}
+
+// serveMetrics serves the metrics on addr and keeps track of the connection
+// to the server. Never returns.
+func serveMetrics(addr string, broker transport) {
+	go watchConnection(broker)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	log.Infof("Serving metrics on %s/metrics", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Errorf("Unable to serve metrics: %v", err)
+	}
+}
+
+// watchConnection updates the connection metrics periodically.
+func watchConnection(broker transport) {
+	up := broker.connected()
+	for {
+		if up {
+			metricConnected.Set(1)
+		} else {
+			metricConnected.Set(0)
+		}
+		time.Sleep(metricsConnectionPoll)
+		now := broker.connected()
+		if now && !up {
+			metricReconnects.Inc()
+		}
+		up = now
+	}
+}
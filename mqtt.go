@@ -6,14 +6,31 @@ package main
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"sync"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/google/uuid"
-	log "github.com/romana/rlog"
 )
 
-func newBroker(cfg globalConfig, handler func(client mqtt.Client, msg mqtt.Message)) (mqtt.Client, error) {
+// mqttSubscription holds the filters and handler of a subscription.
+type mqttSubscription struct {
+	filters map[string]byte
+	handler mqtt.MessageHandler
+}
+
+// mqttTransport sends and receives messages through an MQTT broker.
+type mqttTransport struct {
+	sync.Mutex
+	client   mqtt.Client
+	subs     []mqttSubscription
+	connects int
+}
+
+// newMQTTTransport connects to the MQTT broker.
+func newMQTTTransport(cfg globalConfig) (*mqttTransport, error) {
+	t := &mqttTransport{}
+
 	tlsconfig := newTLSConfig(cfg.cert)
 	opts := mqtt.NewClientOptions()
 	opts.AddBroker(*cfg.server)
@@ -36,25 +53,63 @@ func newBroker(cfg globalConfig, handler func(client mqtt.Client, msg mqtt.Messa
 		opts.SetPassword(*cfg.password)
 	}
 
-	// If handler is present, assume we'll subscribe to a topic. In this case,
-	// set OnConnectHandler to re-subscribe every time we have a connection.
-	// This, together with SetAutoReconnect guarantees that we'll keep
-	// receiving messages from the topic after an automatic reconnect.
-	if handler != nil {
-		opts.SetOnConnectHandler(func(onconn mqtt.Client) {
-			log.Debugf("Connection detected. Subscribing to topic: %q", *cfg.topic)
-			if token := onconn.Subscribe(*cfg.topic, 0, handler); token.Wait() && token.Error() != nil {
-				log.Errorf("Unable to subscribe to topic %s: %v", *cfg.topic, token.Error())
+	// Re-subscribe every time we reconnect. This, together with
+	// SetAutoReconnect guarantees that we'll keep receiving messages from
+	// the topics after an automatic reconnect. Subscriptions made after the
+	// first connection are already in place.
+	opts.SetOnConnectHandler(func(onconn mqtt.Client) {
+		t.Lock()
+		defer t.Unlock()
+		t.connects++
+		if t.connects == 1 {
+			return
+		}
+		for _, s := range t.subs {
+			log.Debugf("Connection detected. Subscribing to topics: %v", s.filters)
+			if token := onconn.SubscribeMultiple(s.filters, s.handler); token.Wait() && token.Error() != nil {
+				log.Errorf("Unable to subscribe to topics %v: %v", s.filters, token.Error())
 			}
-		})
-	}
+		}
+	})
 
-	c := mqtt.NewClient(opts)
-	if token := c.Connect(); token.Wait() && token.Error() != nil {
+	t.client = mqtt.NewClient(opts)
+	if token := t.client.Connect(); token.Wait() && token.Error() != nil {
 		return nil, token.Error()
 	}
+	return t, nil
+}
+
+func (t *mqttTransport) publish(topic string, qos byte, retained bool, payload []byte) error {
+	token := t.client.Publish(topic, qos, retained, payload)
+	token.Wait()
+	return token.Error()
+}
+
+func (t *mqttTransport) subscribe(filters []string, qos byte, handler func(message)) error {
+	s := mqttSubscription{
+		filters: map[string]byte{},
+		handler: func(_ mqtt.Client, msg mqtt.Message) {
+			handler(message{topic: msg.Topic(), payload: msg.Payload(), retained: msg.Retained()})
+		},
+	}
+	for _, f := range filters {
+		s.filters[f] = qos
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	t.subs = append(t.subs, s)
+	token := t.client.SubscribeMultiple(s.filters, s.handler)
+	token.Wait()
+	return token.Error()
+}
+
+func (t *mqttTransport) connected() bool {
+	return t.client.IsConnectionOpen()
+}
 
-	return c, nil
+func (t *mqttTransport) close() {
+	t.client.Disconnect(1)
 }
 
 func newTLSConfig(cert []byte) *tls.Config {
@@ -0,0 +1,658 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+// Embedded MQTT broker
+//
+// A small MQTT 3.1.1 broker, with just enough features to serve clipsync
+// clients (and other well behaved MQTT clients): QoS 0 and 1 delivery (QoS 2
+// messages are accepted and delivered with QoS 1), retained messages, will
+// messages, wildcard subscriptions, username/password authentication and
+// per-user topic ACLs. Sessions are never persisted (all sessions are clean)
+// and retained messages are kept in memory only, up to serverMaxRetained
+// topics and serverMaxRetainedBytes (further retained messages are delivered,
+// but not retained).
+//
+// QoS 2 messages are forwarded when the PUBLISH arrives. Their packet IDs are
+// kept until the PUBREL, so retransmissions of the PUBLISH are acknowledged
+// but not forwarded again.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MQTT control packet types.
+const (
+	mqttConnect     = 1
+	mqttConnack     = 2
+	mqttPublish     = 3
+	mqttPuback      = 4
+	mqttPubrec      = 5
+	mqttPubrel      = 6
+	mqttPubcomp     = 7
+	mqttSubscribe   = 8
+	mqttSuback      = 9
+	mqttUnsubscribe = 10
+	mqttUnsuback    = 11
+	mqttPingreq     = 12
+	mqttPingresp    = 13
+	mqttDisconnect  = 14
+)
+
+// CONNACK return codes.
+const (
+	connAccepted           = 0
+	connBadProtocol        = 1
+	connIdentifierRejected = 2
+	connBadCredentials     = 4
+	connNotAuthorized      = 5
+)
+
+const (
+	// Time allowed for clients to send CONNECT.
+	serverConnectTimeout = 10 * time.Second
+
+	// Outgoing packets queued per client. Clients that fall behind are
+	// disconnected.
+	serverQueueLen = 256
+
+	// Maximum QoS granted to subscriptions.
+	serverMaxQoS = 1
+
+	// Maximum number of QoS 2 messages awaiting PUBREL per client.
+	serverMaxInflight = serverQueueLen
+
+	// Limits of the retained messages store.
+	serverMaxRetained      = 10000
+	serverMaxRetainedBytes = 256 * 1024 * 1024
+)
+
+// serverMessage holds a published message.
+type serverMessage struct {
+	topic   string
+	payload []byte
+	qos     byte
+	retain  bool
+}
+
+// mqttServer holds the state of the broker.
+type mqttServer struct {
+	sync.Mutex
+	clients  map[string]*serverClient
+	retained map[string]serverMessage
+	// Total size of the retained payloads, and limits of the store.
+	retainedBytes    int
+	maxRetained      int
+	maxRetainedBytes int
+	auth             *serverAuth
+	maxSize          int
+}
+
+// serverClient holds a connected client.
+type serverClient struct {
+	sync.Mutex
+	id     string
+	user   string
+	conn   net.Conn
+	out    chan []byte
+	subs   map[string]byte
+	will   *serverMessage
+	nextID uint16
+	// IDs of QoS 2 messages received and not yet released (PUBREL).
+	inflight map[uint16]bool
+	closed   chan struct{}
+	once     sync.Once
+}
+
+// newMQTTServer returns a new broker, accepting messages up to maxSize bytes.
+func newMQTTServer(auth *serverAuth, maxSize int) *mqttServer {
+	return &mqttServer{
+		clients:          map[string]*serverClient{},
+		retained:         map[string]serverMessage{},
+		maxRetained:      serverMaxRetained,
+		maxRetainedBytes: serverMaxRetainedBytes,
+		auth:             auth,
+		maxSize:          maxSize,
+	}
+}
+
+// serve accepts connections on the listener until it's closed.
+func (s *mqttServer) serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+// handle runs the session of one client.
+func (s *mqttServer) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	conn.SetReadDeadline(time.Now().Add(serverConnectTimeout))
+	ptype, _, body, err := readPacket(r, s.maxSize)
+	if err != nil || ptype != mqttConnect {
+		log.Debugf("Server: %s: expected CONNECT: %v", conn.RemoteAddr(), err)
+		return
+	}
+	c, keepalive, code := s.connect(conn, body)
+	conn.Write([]byte{mqttConnack << 4, 2, 0, code})
+	if code != connAccepted {
+		log.Infof("Server: connection from %s refused (code %d)", conn.RemoteAddr(), code)
+		return
+	}
+	log.Debugf("Server: client %q (user %q) connected from %s", c.id, c.user, conn.RemoteAddr())
+
+	go c.writer()
+	s.register(c)
+	clean := false
+	defer func() {
+		s.unregister(c)
+		c.close()
+		if !clean && c.will != nil {
+			s.publish(*c.will)
+		}
+		log.Debugf("Server: client %q disconnected", c.id)
+	}()
+
+	for {
+		// Clients must send something within 1.5 times the keepalive.
+		if keepalive > 0 {
+			conn.SetReadDeadline(time.Now().Add(keepalive * 3 / 2))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
+		ptype, flags, body, err := readPacket(r, s.maxSize)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Debugf("Server: client %q: %v", c.id, err)
+			}
+			return
+		}
+		switch ptype {
+		case mqttPublish:
+			err = s.handlePublish(c, flags, body)
+		case mqttPubrel:
+			if len(body) >= 2 {
+				delete(c.inflight, binary.BigEndian.Uint16(body))
+				c.send(mqttPubcomp<<4, body[:2])
+			}
+		case mqttPuback, mqttPubrec, mqttPubcomp:
+			// Outgoing messages are never retried.
+		case mqttSubscribe:
+			err = s.handleSubscribe(c, flags, body)
+		case mqttUnsubscribe:
+			err = s.handleUnsubscribe(c, flags, body)
+		case mqttPingreq:
+			c.send(mqttPingresp<<4, nil)
+		case mqttDisconnect:
+			clean = true
+			return
+		default:
+			err = fmt.Errorf("unexpected packet type %d", ptype)
+		}
+		if err != nil {
+			log.Debugf("Server: client %q: %v", c.id, err)
+			return
+		}
+	}
+}
+
+// connect parses a CONNECT packet, authenticates the client, and returns the
+// new client, the keepalive interval and the CONNACK return code.
+func (s *mqttServer) connect(conn net.Conn, body []byte) (*serverClient, time.Duration, byte) {
+	p := &packetReader{data: body}
+	proto := p.string()
+	level := p.byte()
+	flags := p.byte()
+	keepalive := time.Duration(p.uint16()) * time.Second
+	if p.err != nil {
+		return nil, 0, connBadProtocol
+	}
+	if !(proto == "MQTT" && level == 4) && !(proto == "MQIsdp" && level == 3) {
+		return nil, 0, connBadProtocol
+	}
+
+	c := &serverClient{
+		conn:     conn,
+		out:      make(chan []byte, serverQueueLen),
+		subs:     map[string]byte{},
+		inflight: map[uint16]bool{},
+		closed:   make(chan struct{}),
+	}
+	c.id = p.string()
+	if flags&0x04 != 0 {
+		c.will = &serverMessage{qos: (flags >> 3) & 3, retain: flags&0x20 != 0}
+		c.will.topic = p.string()
+		c.will.payload = p.bytes()
+	}
+	var user, password string
+	if flags&0x80 != 0 {
+		user = p.string()
+	}
+	if flags&0x40 != 0 {
+		password = p.string()
+	}
+	if p.err != nil {
+		return nil, 0, connBadProtocol
+	}
+	if c.id == "" {
+		if flags&0x02 == 0 {
+			return nil, 0, connIdentifierRejected
+		}
+		c.id = fmt.Sprintf("auto-%s", conn.RemoteAddr())
+	}
+	if !s.auth.login(user, password) {
+		return nil, 0, connBadCredentials
+	}
+	c.user = user
+	if c.will != nil && (!validTopic(c.will.topic) || !s.auth.canWrite(user, c.will.topic)) {
+		return nil, 0, connNotAuthorized
+	}
+	return c, keepalive, connAccepted
+}
+
+// register adds the client, disconnecting any client with the same ID.
+func (s *mqttServer) register(c *serverClient) {
+	s.Lock()
+	old := s.clients[c.id]
+	s.clients[c.id] = c
+	s.Unlock()
+	if old != nil {
+		log.Debugf("Server: client %q taken over by a new connection", c.id)
+		old.close()
+	}
+}
+
+// unregister removes the client (unless it was taken over).
+func (s *mqttServer) unregister(c *serverClient) {
+	s.Lock()
+	defer s.Unlock()
+	if s.clients[c.id] == c {
+		delete(s.clients, c.id)
+	}
+}
+
+// handlePublish handles a PUBLISH packet.
+func (s *mqttServer) handlePublish(c *serverClient, flags byte, body []byte) error {
+	p := &packetReader{data: body}
+	msg := serverMessage{
+		topic:  p.string(),
+		qos:    (flags >> 1) & 3,
+		retain: flags&1 != 0,
+	}
+	var id []byte
+	if msg.qos > 0 {
+		id = p.next(2)
+	}
+	if p.err != nil || msg.qos > 2 || !validTopic(msg.topic) {
+		return errors.New("invalid PUBLISH packet")
+	}
+	msg.payload = p.rest()
+
+	// Retransmitted QoS 2 message: acknowledge it again, but don't forward
+	// it twice. The inflight map is only used by the client's goroutine.
+	if msg.qos == 2 {
+		pid := binary.BigEndian.Uint16(id)
+		if c.inflight[pid] {
+			c.send(mqttPubrec<<4, id)
+			return nil
+		}
+		if len(c.inflight) >= serverMaxInflight {
+			return errors.New("too many QoS 2 messages awaiting PUBREL")
+		}
+		c.inflight[pid] = true
+	}
+
+	if s.auth.canWrite(c.user, msg.topic) {
+		s.publish(msg)
+	} else {
+		log.Infof("Server: user %q is not allowed to publish to %q", c.user, msg.topic)
+	}
+
+	switch msg.qos {
+	case 1:
+		c.send(mqttPuback<<4, id)
+	case 2:
+		c.send(mqttPubrec<<4, id)
+	}
+	return nil
+}
+
+// publish stores the message (if retained) and sends it to all subscribers
+// allowed to read it.
+func (s *mqttServer) publish(msg serverMessage) {
+	s.Lock()
+	defer s.Unlock()
+	if msg.retain {
+		s.retain(msg)
+	}
+	for _, c := range s.clients {
+		if qos, ok := c.matches(msg.topic); ok && s.auth.canRead(c.user, msg.topic) {
+			// The retain flag is only set for messages sent on subscription.
+			c.deliver(serverMessage{topic: msg.topic, payload: msg.payload, qos: minQoS(msg.qos, qos)})
+		}
+	}
+}
+
+// retain stores (or, if empty, removes) a retained message. Messages that
+// would exceed the limits of the store are not kept, and the previous message
+// for the topic is removed. Must be called with the lock held.
+func (s *mqttServer) retain(msg serverMessage) {
+	old, exists := s.retained[msg.topic]
+	size := s.retainedBytes - len(old.payload)
+	if len(msg.payload) == 0 {
+		delete(s.retained, msg.topic)
+		s.retainedBytes = size
+		return
+	}
+	if (!exists && len(s.retained) >= s.maxRetained) || size+len(msg.payload) > s.maxRetainedBytes {
+		log.Infof("Server: retained messages store full, not retaining message to %q", msg.topic)
+		delete(s.retained, msg.topic)
+		s.retainedBytes = size
+		return
+	}
+	s.retained[msg.topic] = msg
+	s.retainedBytes = size + len(msg.payload)
+}
+
+// handleSubscribe handles a SUBSCRIBE packet, sending the retained messages
+// matching the new subscriptions.
+func (s *mqttServer) handleSubscribe(c *serverClient, flags byte, body []byte) error {
+	p := &packetReader{data: body}
+	id := p.next(2)
+	if flags != 2 || p.err != nil {
+		return errors.New("invalid SUBSCRIBE packet")
+	}
+	ack := append([]byte{}, id...)
+	granted := map[string]byte{}
+	for p.err == nil && p.remaining() > 0 {
+		filter := p.string()
+		qos := p.byte()
+		if p.err != nil || qos > 2 {
+			return errors.New("invalid SUBSCRIBE packet")
+		}
+		if !validFilter(filter) {
+			ack = append(ack, 0x80)
+			continue
+		}
+		qos = minQoS(qos, serverMaxQoS)
+		c.Lock()
+		c.subs[filter] = qos
+		c.Unlock()
+		ack = append(ack, qos)
+		granted[filter] = qos
+	}
+	c.send(mqttSuback<<4, ack)
+
+	// ACLs are checked on delivery, so subscriptions always succeed.
+	s.Lock()
+	defer s.Unlock()
+	for _, msg := range s.retained {
+		for filter, qos := range granted {
+			if topicMatch(filter, msg.topic) && s.auth.canRead(c.user, msg.topic) {
+				c.deliver(serverMessage{topic: msg.topic, payload: msg.payload, qos: minQoS(msg.qos, qos), retain: true})
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// handleUnsubscribe handles an UNSUBSCRIBE packet.
+func (s *mqttServer) handleUnsubscribe(c *serverClient, flags byte, body []byte) error {
+	p := &packetReader{data: body}
+	id := p.next(2)
+	if flags != 2 || p.err != nil {
+		return errors.New("invalid UNSUBSCRIBE packet")
+	}
+	for p.err == nil && p.remaining() > 0 {
+		filter := p.string()
+		c.Lock()
+		delete(c.subs, filter)
+		c.Unlock()
+	}
+	c.send(mqttUnsuback<<4, id)
+	return nil
+}
+
+// matches returns the highest QoS of the subscriptions matching the topic.
+func (c *serverClient) matches(topic string) (byte, bool) {
+	c.Lock()
+	defer c.Unlock()
+	var (
+		qos   byte
+		found bool
+	)
+	for filter, q := range c.subs {
+		if topicMatch(filter, topic) {
+			found = true
+			if q > qos {
+				qos = q
+			}
+		}
+	}
+	return qos, found
+}
+
+// deliver sends a PUBLISH packet with the message to the client.
+func (c *serverClient) deliver(msg serverMessage) {
+	flags := msg.qos << 1
+	if msg.retain {
+		flags |= 1
+	}
+	body := appendString(nil, msg.topic)
+	if msg.qos > 0 {
+		c.Lock()
+		c.nextID++
+		if c.nextID == 0 {
+			c.nextID = 1
+		}
+		body = append(body, byte(c.nextID>>8), byte(c.nextID))
+		c.Unlock()
+	}
+	c.send(mqttPublish<<4|flags, append(body, msg.payload...))
+}
+
+// send queues a packet to the client. Clients that can't keep up are
+// disconnected.
+func (c *serverClient) send(header byte, body []byte) {
+	pkt := appendLength([]byte{header}, len(body))
+	pkt = append(pkt, body...)
+	select {
+	case c.out <- pkt:
+	case <-c.closed:
+	default:
+		log.Infof("Server: client %q is too slow, disconnecting", c.id)
+		c.close()
+	}
+}
+
+// writer sends the queued packets to the client.
+func (c *serverClient) writer() {
+	for {
+		select {
+		case pkt := <-c.out:
+			if _, err := c.conn.Write(pkt); err != nil {
+				c.close()
+				return
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// close disconnects the client.
+func (c *serverClient) close() {
+	c.once.Do(func() {
+		close(c.closed)
+		c.conn.Close()
+	})
+}
+
+// readPacket reads an MQTT control packet, returning its type, flags and
+// body. Packets larger than maxSize are rejected.
+func readPacket(r *bufio.Reader, maxSize int) (byte, byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	length, mult := 0, 1
+	for i := 0; ; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		length += int(b&0x7f) * mult
+		if b&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return 0, 0, nil, errors.New("invalid remaining length")
+		}
+		mult *= 128
+	}
+	if length > maxSize {
+		return 0, 0, nil, fmt.Errorf("packet too large (%d bytes, maximum is %d)", length, maxSize)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, 0, nil, err
+	}
+	return header >> 4, header & 0x0f, body, nil
+}
+
+// appendLength appends the MQTT encoding of a remaining length.
+func appendLength(b []byte, n int) []byte {
+	for {
+		d := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			d |= 0x80
+		}
+		b = append(b, d)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+// appendString appends a length prefixed string.
+func appendString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+// packetReader reads fields from the body of a packet. Errors are sticky.
+type packetReader struct {
+	data []byte
+	err  error
+}
+
+// next returns the next n bytes.
+func (p *packetReader) next(n int) []byte {
+	if p.err != nil {
+		return nil
+	}
+	if len(p.data) < n {
+		p.err = errors.New("packet too short")
+		return nil
+	}
+	ret := p.data[:n]
+	p.data = p.data[n:]
+	return ret
+}
+
+func (p *packetReader) byte() byte {
+	if b := p.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (p *packetReader) uint16() uint16 {
+	if b := p.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (p *packetReader) bytes() []byte {
+	return p.next(int(p.uint16()))
+}
+
+func (p *packetReader) string() string {
+	return string(p.bytes())
+}
+
+func (p *packetReader) rest() []byte {
+	ret := p.data
+	p.data = nil
+	return ret
+}
+
+func (p *packetReader) remaining() int {
+	return len(p.data)
+}
+
+// validTopic returns true if the topic can be published to.
+func validTopic(topic string) bool {
+	return topic != "" && !strings.ContainsAny(topic, "+#\x00")
+}
+
+// validFilter returns true if the subscription filter is valid.
+func validFilter(filter string) bool {
+	if filter == "" || strings.Contains(filter, "\x00") {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, l := range levels {
+		if strings.Contains(l, "#") && (l != "#" || i != len(levels)-1) {
+			return false
+		}
+		if strings.Contains(l, "+") && l != "+" {
+			return false
+		}
+	}
+	return true
+}
+
+// topicMatch returns true if the topic matches the subscription filter.
+// Wildcards at the first level don't match topics starting with "$".
+func topicMatch(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i, l := range f {
+		if l == "#" {
+			return true
+		}
+		if i >= len(t) || (l != "+" && l != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+// minQoS returns the lowest of two QoS levels.
+func minQoS(a, b byte) byte {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,258 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTopicMatch(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/b", "a/b/c", false},
+		{"a/b/c", "a/b", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/+/c", "a/b/c", true},
+		{"+/+", "a/b", true},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"#", "a/b", true},
+		{"a/+", "a/", true},
+		{"+", "", true},
+		{"#", "$SYS/load", false},
+		{"+/load", "$SYS/load", false},
+		{"$SYS/#", "$SYS/load", true},
+		{"$SYS/+", "$SYS/load", true},
+		{"a/#", "a/$b", true},
+	}
+	for _, tt := range tests {
+		if got := topicMatch(tt.filter, tt.topic); got != tt.want {
+			t.Errorf("topicMatch(%q, %q) = %v, want %v", tt.filter, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestValidFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   bool
+	}{
+		{"a/b", true},
+		{"a/+/c", true},
+		{"a/#", true},
+		{"#", true},
+		{"", false},
+		{"a/#/c", false},
+		{"a/b#", false},
+		{"a/b+", false},
+		{"a\x00", false},
+	}
+	for _, tt := range tests {
+		if got := validFilter(tt.filter); got != tt.want {
+			t.Errorf("validFilter(%q) = %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestRetainLimits(t *testing.T) {
+	s := newMQTTServer(&serverAuth{}, defaultServerMaxSize)
+	s.maxRetained = 2
+	s.maxRetainedBytes = 10
+
+	msg := func(topic, payload string) serverMessage {
+		return serverMessage{topic: topic, payload: []byte(payload), retain: true}
+	}
+	tests := []struct {
+		name  string
+		msg   serverMessage
+		want  map[string]string
+		bytes int
+	}{
+		{"first", msg("a", "1234"), map[string]string{"a": "1234"}, 4},
+		{"second", msg("b", "1234"), map[string]string{"a": "1234", "b": "1234"}, 8},
+		{"too many topics", msg("c", "1"), map[string]string{"a": "1234", "b": "1234"}, 8},
+		{"replace", msg("a", "123456"), map[string]string{"a": "123456", "b": "1234"}, 10},
+		{"too large removes previous", msg("b", "12345"), map[string]string{"a": "123456"}, 6},
+		{"delete", msg("a", ""), map[string]string{}, 0},
+		{"empty store", msg("c", "1234567890"), map[string]string{"c": "1234567890"}, 10},
+	}
+	for _, tt := range tests {
+		s.retain(tt.msg)
+		got := map[string]string{}
+		for topic, m := range s.retained {
+			got[topic] = string(m.payload)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: retained %v, want %v", tt.name, got, tt.want)
+		}
+		for topic, payload := range tt.want {
+			if got[topic] != payload {
+				t.Errorf("%s: retained %v, want %v", tt.name, got, tt.want)
+			}
+		}
+		if s.retainedBytes != tt.bytes {
+			t.Errorf("%s: retained %d bytes, want %d", tt.name, s.retainedBytes, tt.bytes)
+		}
+	}
+}
+
+// testMQTTClient speaks MQTT to the server over a pipe.
+type testMQTTClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// newTestMQTTClient connects a new client to the server and subscribes it to
+// the topic.
+func newTestMQTTClient(t *testing.T, s *mqttServer, topic string) *testMQTTClient {
+	t.Helper()
+	server, conn := net.Pipe()
+	go s.handle(server)
+	c := &testMQTTClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	t.Cleanup(func() { conn.Close() })
+
+	body := appendString(nil, "MQTT")
+	body = append(body, 4, 0x02, 0, 0)
+	c.send(mqttConnect<<4, appendString(body, "test"))
+	c.expect(mqttConnack, []byte{0, connAccepted})
+
+	c.send(mqttSubscribe<<4|2, append(appendString([]byte{0, 1}, topic), 2))
+	c.expect(mqttSuback, []byte{0, 1, serverMaxQoS})
+	return c
+}
+
+// send sends a packet to the server.
+func (c *testMQTTClient) send(header byte, body []byte) {
+	c.t.Helper()
+	c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.conn.Write(append(appendLength([]byte{header}, len(body)), body...)); err != nil {
+		c.t.Fatalf("write: %v", err)
+	}
+}
+
+// receive returns the next packet from the server.
+func (c *testMQTTClient) receive() (byte, byte, []byte) {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	ptype, flags, body, err := readPacket(c.r, defaultServerMaxSize)
+	if err != nil {
+		c.t.Fatalf("read: %v", err)
+	}
+	return ptype, flags, body
+}
+
+// expect checks the next packet from the server.
+func (c *testMQTTClient) expect(ptype byte, body []byte) {
+	c.t.Helper()
+	gotType, _, gotBody := c.receive()
+	if gotType != ptype || !bytes.Equal(gotBody, body) {
+		c.t.Fatalf("got packet %d %x, want %d %x", gotType, gotBody, ptype, body)
+	}
+}
+
+// expectPublish checks that the next packet is a PUBLISH of the payload to
+// the topic, with the given QoS.
+func (c *testMQTTClient) expectPublish(topic string, qos byte, payload string) {
+	c.t.Helper()
+	ptype, flags, body := c.receive()
+	p := &packetReader{data: body}
+	gotTopic := p.string()
+	if qos > 0 {
+		p.next(2)
+	}
+	gotPayload := p.rest()
+	if ptype != mqttPublish || (flags>>1)&3 != qos || gotTopic != topic || string(gotPayload) != payload {
+		c.t.Fatalf("got packet %d (flags %x) %q %q, want PUBLISH QoS %d %q %q", ptype, flags, gotTopic, gotPayload, qos, topic, payload)
+	}
+}
+
+// publish sends a PUBLISH packet with the given QoS and packet ID.
+func (c *testMQTTClient) publish(topic string, qos byte, id uint16, payload string, dup bool) {
+	c.t.Helper()
+	flags := qos << 1
+	if dup {
+		flags |= 0x08
+	}
+	body := appendString(nil, topic)
+	if qos > 0 {
+		body = append(body, byte(id>>8), byte(id))
+	}
+	c.send(mqttPublish<<4|flags, append(body, payload...))
+}
+
+func TestMQTTServerQoS(t *testing.T) {
+	s := newMQTTServer(&serverAuth{}, defaultServerMaxSize)
+	c := newTestMQTTClient(t, s, "topic/#")
+
+	// QoS 0: delivered, not acknowledged.
+	c.publish("topic/a", 0, 0, "qos0", false)
+	c.expectPublish("topic/a", 0, "qos0")
+
+	// QoS 1: delivered and acknowledged.
+	c.publish("topic/a", 1, 10, "qos1", false)
+	c.expectPublish("topic/a", 1, "qos1")
+	c.expect(mqttPuback, []byte{0, 10})
+
+	// QoS 2: delivered once (with the QoS granted) and acknowledged again
+	// if retransmitted before the PUBREL.
+	c.publish("topic/a", 2, 20, "qos2", false)
+	c.expectPublish("topic/a", 1, "qos2")
+	c.expect(mqttPubrec, []byte{0, 20})
+	c.publish("topic/a", 2, 20, "qos2", true)
+	c.expect(mqttPubrec, []byte{0, 20})
+	c.send(mqttPubrel<<4|2, []byte{0, 20})
+	c.expect(mqttPubcomp, []byte{0, 20})
+
+	// After the PUBREL, the packet ID identifies a new message.
+	c.publish("topic/a", 2, 20, "again", false)
+	c.expectPublish("topic/a", 1, "again")
+	c.expect(mqttPubrec, []byte{0, 20})
+
+	// Nothing else was delivered.
+	c.send(mqttPingreq<<4, nil)
+	c.expect(mqttPingresp, nil)
+
+	// Messages to other topics are not delivered.
+	c.publish("other", 1, 30, "other", false)
+	c.expect(mqttPuback, []byte{0, 30})
+}
+
+func TestMQTTServerRetained(t *testing.T) {
+	s := newMQTTServer(&serverAuth{}, defaultServerMaxSize)
+	s.retain(serverMessage{topic: "topic/a", payload: []byte("retained"), qos: 1, retain: true})
+	s.retain(serverMessage{topic: "other", payload: []byte("other"), qos: 1, retain: true})
+
+	// Retained messages are sent on subscription, with the retain flag.
+	server, conn := net.Pipe()
+	go s.handle(server)
+	c := &testMQTTClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	defer conn.Close()
+	body := appendString(nil, "MQTT")
+	body = append(body, 4, 0x02, 0, 0)
+	c.send(mqttConnect<<4, appendString(body, "test"))
+	c.expect(mqttConnack, []byte{0, connAccepted})
+	c.send(mqttSubscribe<<4|2, append(appendString([]byte{0, 1}, "topic/#"), 1))
+	c.expect(mqttSuback, []byte{0, 1, 1})
+
+	ptype, flags, body := c.receive()
+	p := &packetReader{data: body}
+	topic := p.string()
+	p.next(2)
+	if ptype != mqttPublish || flags&1 == 0 || topic != "topic/a" || string(p.rest()) != "retained" {
+		t.Errorf("got packet %d (flags %x) to %q, want retained PUBLISH to topic/a", ptype, flags, topic)
+	}
+	c.send(mqttPingreq<<4, nil)
+	c.expect(mqttPingresp, nil)
+}
@@ -0,0 +1,231 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+// NATS transport
+//
+// Topic levels are mapped to subject tokens ("a/b" is sent to subject "a.b")
+// and the "+" and "#" wildcards to "*" and ">". Topics can't contain dots.
+//
+// Core NATS has no retained messages, so clipsync clients keep them: every
+// client remembers the last retained message sent to the topics it
+// subscribes to (retained messages carry a "Clipsync-Retained" header), and
+// answers requests for them on natsRetainedSubject. New subscribers ask for
+// the retained messages matching their filters and keep the newest reply for
+// each topic. This needs a NATS server with support for headers (2.2 or
+// newer), and at least one client running to hand over retained messages.
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// Subject used to request retained messages. The request holds the
+	// topic filter.
+	natsRetainedSubject = "_CLIPSYNC.retained"
+
+	// Time to wait for replies with retained messages.
+	natsRetainedWait = 2 * time.Second
+
+	// Message headers.
+	natsHeaderRetained = "Clipsync-Retained"
+	natsHeaderTopic    = "Clipsync-Topic"
+	natsHeaderTime     = "Clipsync-Time"
+)
+
+// natsTransport sends and receives messages through a NATS server.
+type natsTransport struct {
+	sync.Mutex
+	conn     *nats.Conn
+	retained map[string]retainedMessage
+}
+
+// newNATSTransport connects to the NATS server.
+func newNATSTransport(cfg globalConfig) (*natsTransport, error) {
+	t := &natsTransport{retained: map[string]retainedMessage{}}
+
+	opts := []nats.Option{
+		nats.Name("clipsync-" + uuid.New().String()),
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(2 * time.Second),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			log.Debugf("Disconnected from NATS server: %v", err)
+		}),
+		nats.ReconnectHandler(func(_ *nats.Conn) {
+			log.Debug("Reconnected to NATS server")
+		}),
+	}
+	if *cfg.user != "" || *cfg.password != "" {
+		opts = append(opts, nats.UserInfo(*cfg.user, *cfg.password))
+	}
+	if len(cfg.cert) != 0 {
+		opts = append(opts, nats.Secure(newTLSConfig(cfg.cert)))
+	}
+
+	conn, err := nats.Connect(*cfg.server, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if !conn.HeadersSupported() {
+		conn.Close()
+		return nil, errors.New("NATS server has no support for headers (version 2.2 or newer required)")
+	}
+	t.conn = conn
+
+	if _, err := conn.Subscribe(natsRetainedSubject, t.sendRetained); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to subscribe to %s: %v", natsRetainedSubject, err)
+	}
+	return t, nil
+}
+
+func (t *natsTransport) publish(topic string, _ byte, retained bool, payload []byte) error {
+	msg := nats.NewMsg(natsSubject(topic))
+	msg.Data = payload
+	if retained {
+		now := time.Now().UnixMilli()
+		msg.Header.Set(natsHeaderRetained, "1")
+		msg.Header.Set(natsHeaderTime, strconv.FormatInt(now, 10))
+		t.keep(topic, payload, now)
+	}
+	if err := t.conn.PublishMsg(msg); err != nil {
+		return err
+	}
+	return t.conn.Flush()
+}
+
+func (t *natsTransport) subscribe(filters []string, _ byte, handler func(message)) error {
+	for _, f := range expandFilters(filters) {
+		_, err := t.conn.Subscribe(natsSubject(f), func(msg *nats.Msg) {
+			topic := natsTopic(msg.Subject)
+			retained := msg.Header.Get(natsHeaderRetained) != ""
+			if retained {
+				sent, _ := strconv.ParseInt(msg.Header.Get(natsHeaderTime), 10, 64)
+				t.keep(topic, msg.Data, sent)
+			}
+			handler(message{topic: topic, payload: msg.Data, retained: retained})
+		})
+		if err != nil {
+			return fmt.Errorf("unable to subscribe to %s: %v", f, err)
+		}
+	}
+	go t.requestRetained(filters, handler)
+	return nil
+}
+
+func (t *natsTransport) connected() bool {
+	return t.conn.IsConnected()
+}
+
+func (t *natsTransport) close() {
+	t.conn.Close()
+}
+
+// keep saves a retained message, unless a newer one is already saved. Empty
+// messages clear the topic.
+func (t *natsTransport) keep(topic string, payload []byte, sent int64) {
+	t.Lock()
+	defer t.Unlock()
+	if r, ok := t.retained[topic]; ok && r.time > sent {
+		return
+	}
+	if len(payload) == 0 {
+		delete(t.retained, topic)
+		return
+	}
+	t.retained[topic] = retainedMessage{payload: payload, time: sent}
+}
+
+// sendRetained answers a request for the retained messages matching a topic
+// filter, with one reply per topic.
+func (t *natsTransport) sendRetained(req *nats.Msg) {
+	filter := string(req.Data)
+	if req.Reply == "" || !validFilter(filter) {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	for topic, r := range t.retained {
+		if !topicMatch(filter, topic) {
+			continue
+		}
+		msg := nats.NewMsg(req.Reply)
+		msg.Data = r.payload
+		msg.Header.Set(natsHeaderTopic, topic)
+		msg.Header.Set(natsHeaderTime, strconv.FormatInt(r.time, 10))
+		if err := t.conn.PublishMsg(msg); err != nil {
+			log.Debugf("Unable to send retained message for %s: %v", topic, err)
+		}
+	}
+}
+
+// requestRetained asks other clients for the retained messages matching the
+// filters, and calls handler with the newest message for each topic.
+func (t *natsTransport) requestRetained(filters []string, handler func(message)) {
+	inbox := nats.NewInbox()
+	replies := make(chan *nats.Msg, 64)
+	sub, err := t.conn.ChanSubscribe(inbox, replies)
+	if err != nil {
+		log.Errorf("Unable to request retained messages: %v", err)
+		return
+	}
+	defer sub.Unsubscribe()
+
+	for _, f := range filters {
+		if err := t.conn.PublishRequest(natsRetainedSubject, inbox, []byte(f)); err != nil {
+			log.Errorf("Unable to request retained messages: %v", err)
+			return
+		}
+	}
+
+	newest := map[string]retainedMessage{}
+	timeout := time.After(natsRetainedWait)
+	for done := false; !done; {
+		select {
+		case msg := <-replies:
+			topic := msg.Header.Get(natsHeaderTopic)
+			sent, _ := strconv.ParseInt(msg.Header.Get(natsHeaderTime), 10, 64)
+			if r, ok := newest[topic]; topic == "" || (ok && r.time >= sent) {
+				continue
+			}
+			newest[topic] = retainedMessage{payload: msg.Data, time: sent}
+		case <-timeout:
+			done = true
+		}
+	}
+
+	for topic, r := range newest {
+		log.Debugf("Received retained message for %s from another client", topic)
+		t.keep(topic, r.payload, r.time)
+		handler(message{topic: topic, payload: r.payload, retained: true})
+	}
+}
+
+// natsSubject returns the NATS subject for an MQTT topic or topic filter.
+func natsSubject(topic string) string {
+	levels := strings.Split(topic, "/")
+	for i, l := range levels {
+		switch l {
+		case "+":
+			levels[i] = "*"
+		case "#":
+			levels[i] = ">"
+		}
+	}
+	return strings.Join(levels, ".")
+}
+
+// natsTopic returns the MQTT topic for a NATS subject.
+func natsTopic(subject string) string {
+	return strings.ReplaceAll(subject, ".", "/")
+}
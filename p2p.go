@@ -0,0 +1,612 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+// Peer-to-peer transport
+//
+// With --p2p, clients announce themselves on the local network with mDNS
+// (service p2pService), with a TXT record holding a service ID derived from
+// the p2p key (a subkey of the shared encryption key) and the topic. Clients
+// with the same service ID connect to each other (the one with the lowest
+// instance name dials) over TLS, using throwaway self-signed certificates.
+// After the TLS handshake, each side sends a hello:
+//
+//	"CSYP"       magic
+//	role         1 byte (1 = dialer, 2 = listener)
+//	nonce        16 bytes
+//	name length  1 byte
+//	name         instance name
+//
+// followed by a proof that it knows the p2p key:
+//
+//	HMAC-SHA256(p2p key, "clipsync-p2p" | role | peer nonce | nonce | TLS exporter)
+//
+// Binding the proof to the TLS session keeps a man in the middle from
+// relaying it. Peer-to-peer sync therefore requires shared encryption (a
+// crypt file or passphrase), and peers must use the same current key: after
+// a key rotation, restart the clients. Messages are then sent as frames:
+//
+//	flags        1 byte (bit 0 = retained)
+//	time         8 bytes, milliseconds since the epoch
+//	topic length 2 bytes
+//	topic
+//	length       4 bytes
+//	payload      the same (encrypted) payload sent to the server
+//
+// Peers keep the last retained message sent to each topic, and send them to
+// new peers. If no peers are found at startup (or when publishing), the
+// configured server is used as a fallback, until a peer connects. If the
+// server can't be reached either, the client keeps waiting for peers.
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grandcat/zeroconf"
+)
+
+const (
+	// mDNS service type and domain.
+	p2pService = "_clipsync._tcp"
+	p2pDomain  = "local."
+
+	// Hello magic and roles.
+	p2pMagic          = "CSYP"
+	p2pRoleDialer     = 1
+	p2pRoleListener   = 2
+	p2pNonceLen       = 16
+	p2pExporterLabel  = "EXPORTER-clipsync-p2p"
+	p2pProofLabel     = "clipsync-p2p"
+	p2pFlagRetained   = 1
+	p2pHandshakeLimit = 10 * time.Second
+
+	// Time to wait for peers before falling back to the server.
+	p2pDiscoveryWait = 3 * time.Second
+
+	// Time to wait before dialing a lost peer again, and number of attempts.
+	p2pRedialWait     = 5 * time.Second
+	p2pRedialAttempts = 12
+
+	// Timeout for writes to a peer.
+	p2pWriteTimeout = 10 * time.Second
+)
+
+// p2pSubscription holds the filters and handler of a subscription.
+type p2pSubscription struct {
+	filters []string
+	handler func(message)
+}
+
+// p2pPeer is a connection to a peer.
+type p2pPeer struct {
+	sync.Mutex
+	name string
+	conn net.Conn
+	w    *bufio.Writer
+}
+
+// p2pTransport exchanges messages directly with peers on the local network.
+type p2pTransport struct {
+	sync.Mutex
+	cfg       globalConfig
+	name      string
+	serviceID string
+	secret    []byte
+	tlsconfig *tls.Config
+	listener  net.Listener
+	mdns      *zeroconf.Server
+	cancel    context.CancelFunc
+	peers     map[string]*p2pPeer
+	dialing   map[string]bool
+	subs      []p2pSubscription
+	retained  map[string]retainedMessage
+	fallback  transport
+	found     chan struct{}
+	closed    bool
+}
+
+// newP2PTransport announces this client on the local network and connects to
+// the peers found. Falls back to the server if no peers are found (and keeps
+// running with peers only if the server can't be reached).
+func newP2PTransport(cfg globalConfig) (*p2pTransport, error) {
+	cert, err := newP2PCertificate()
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.p2pkey) == 0 {
+		return nil, errors.New("peer-to-peer sync requires shared encryption (a crypt file or passphrase)")
+	}
+	mac := hmac.New(sha256.New, cfg.p2pkey)
+	mac.Write([]byte(p2pProofLabel + ":" + *cfg.topic))
+	t := &p2pTransport{
+		cfg:       cfg,
+		name:      uuid.New().String(),
+		serviceID: hex.EncodeToString(mac.Sum(nil)[:8]),
+		secret:    cfg.p2pkey,
+		tlsconfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS13,
+			// Peers are authenticated by the proof in the hello (and
+			// messages by their encryption), not by certificates.
+			InsecureSkipVerify: true,
+		},
+		peers:    map[string]*p2pPeer{},
+		dialing:  map[string]bool{},
+		retained: map[string]retainedMessage{},
+		found:    make(chan struct{}, 1),
+	}
+
+	t.listener, err = tls.Listen("tcp", ":"+strconv.Itoa(*cfg.p2pport), t.tlsconfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen for peers: %v", err)
+	}
+	port := t.listener.Addr().(*net.TCPAddr).Port
+	go t.accept()
+
+	t.mdns, err = zeroconf.Register(t.name, p2pService, p2pDomain, port, []string{"id=" + t.serviceID}, nil)
+	if err != nil {
+		t.listener.Close()
+		return nil, fmt.Errorf("unable to announce on the local network: %v", err)
+	}
+	resolver, err := zeroconf.NewResolver(nil)
+	if err != nil {
+		t.close()
+		return nil, fmt.Errorf("unable to browse the local network: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.cancel = cancel
+	entries := make(chan *zeroconf.ServiceEntry)
+	go t.discover(entries)
+	if err := resolver.Browse(ctx, p2pService, p2pDomain, entries); err != nil {
+		t.close()
+		return nil, fmt.Errorf("unable to browse the local network: %v", err)
+	}
+	log.Debugf("Announced %s (service ID %s) on port %d", t.name, t.serviceID, port)
+
+	select {
+	case <-t.found:
+	case <-time.After(p2pDiscoveryWait):
+		log.Infof("No peers found on the local network, using server %s", *cfg.server)
+		if err := t.useFallback(); err != nil {
+			log.Errorf("%v (waiting for peers)", err)
+		}
+	}
+	return t, nil
+}
+
+func (t *p2pTransport) publish(topic string, qos byte, retained bool, payload []byte) error {
+	now := time.Now().UnixMilli()
+	if retained {
+		t.keep(topic, payload, now)
+	}
+
+	t.Lock()
+	peers := make([]*p2pPeer, 0, len(t.peers))
+	for _, p := range t.peers {
+		peers = append(peers, p)
+	}
+	t.Unlock()
+
+	for _, p := range peers {
+		if err := p.send(topic, retained, now, payload); err != nil {
+			log.Debugf("Unable to send to peer %s: %v", p.name, err)
+			p.conn.Close()
+		}
+	}
+	if len(peers) > 0 {
+		return nil
+	}
+
+	if err := t.useFallback(); err != nil {
+		return err
+	}
+	t.Lock()
+	fallback := t.fallback
+	t.Unlock()
+	if fallback == nil {
+		return errors.New("no peers or server connected")
+	}
+	return fallback.publish(topic, qos, retained, payload)
+}
+
+func (t *p2pTransport) subscribe(filters []string, qos byte, handler func(message)) error {
+	t.Lock()
+	t.subs = append(t.subs, p2pSubscription{filters: filters, handler: handler})
+	var msgs []message
+	for topic, r := range t.retained {
+		if matchesAny(filters, topic) {
+			msgs = append(msgs, message{topic: topic, payload: r.payload, retained: true})
+		}
+	}
+	fallback := t.fallback
+	t.Unlock()
+
+	// Like MQTT, never call the handler before subscribe returns.
+	go func() {
+		for _, msg := range msgs {
+			handler(msg)
+		}
+	}()
+	if fallback != nil {
+		return fallback.subscribe(filters, qos, handler)
+	}
+	return nil
+}
+
+func (t *p2pTransport) connected() bool {
+	t.Lock()
+	defer t.Unlock()
+	return len(t.peers) > 0 || (t.fallback != nil && t.fallback.connected())
+}
+
+func (t *p2pTransport) close() {
+	t.Lock()
+	defer t.Unlock()
+	t.closed = true
+	if t.cancel != nil {
+		t.cancel()
+	}
+	if t.mdns != nil {
+		t.mdns.Shutdown()
+	}
+	t.listener.Close()
+	for _, p := range t.peers {
+		p.conn.Close()
+	}
+	if t.fallback != nil {
+		t.fallback.close()
+	}
+}
+
+// useFallback connects to the server (once), and subscribes to the topics
+// we're subscribed to.
+func (t *p2pTransport) useFallback() error {
+	t.Lock()
+	defer t.Unlock()
+	if t.fallback != nil {
+		return nil
+	}
+	fallback, err := newServerTransport(t.cfg)
+	if err != nil {
+		return fmt.Errorf("unable to connect to broker: %v", err)
+	}
+	for _, s := range t.subs {
+		if err := fallback.subscribe(s.filters, 1, s.handler); err != nil {
+			fallback.close()
+			return err
+		}
+	}
+	t.fallback = fallback
+	return nil
+}
+
+// keep saves a retained message, unless a newer one is already saved. Empty
+// messages clear the topic. Returns false if the message is older than the
+// one saved.
+func (t *p2pTransport) keep(topic string, payload []byte, sent int64) bool {
+	t.Lock()
+	defer t.Unlock()
+	if r, ok := t.retained[topic]; ok && r.time > sent {
+		return false
+	}
+	if len(payload) == 0 {
+		delete(t.retained, topic)
+		return true
+	}
+	t.retained[topic] = retainedMessage{payload: payload, time: sent}
+	return true
+}
+
+// discover dials the peers found with mDNS.
+func (t *p2pTransport) discover(entries chan *zeroconf.ServiceEntry) {
+	for e := range entries {
+		if !stringInSlice("id="+t.serviceID, e.Text) || e.Instance == t.name {
+			continue
+		}
+		// Only one side dials, to avoid duplicate connections.
+		if e.Instance < t.name {
+			log.Debugf("Found peer %s, waiting for it to connect", e.Instance)
+			continue
+		}
+		var ip net.IP
+		switch {
+		case len(e.AddrIPv4) > 0:
+			ip = e.AddrIPv4[0]
+		case len(e.AddrIPv6) > 0:
+			ip = e.AddrIPv6[0]
+		default:
+			continue
+		}
+		t.Lock()
+		busy := t.dialing[e.Instance] || t.peers[e.Instance] != nil
+		if !busy {
+			t.dialing[e.Instance] = true
+		}
+		t.Unlock()
+		if !busy {
+			go t.dial(e.Instance, net.JoinHostPort(ip.String(), strconv.Itoa(e.Port)))
+		}
+	}
+}
+
+// dial connects to a peer, and reconnects while the peer can be reached.
+func (t *p2pTransport) dial(name, addr string) {
+	defer func() {
+		t.Lock()
+		delete(t.dialing, name)
+		t.Unlock()
+	}()
+
+	dialer := &net.Dialer{Timeout: p2pHandshakeLimit}
+	for attempt := 0; attempt < p2pRedialAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(p2pRedialWait)
+		}
+		t.Lock()
+		closed := t.closed
+		t.Unlock()
+		if closed {
+			return
+		}
+
+		conn, err := tls.DialWithDialer(dialer, "tcp", addr, t.tlsconfig)
+		if err != nil {
+			log.Debugf("Unable to connect to peer %s at %s: %v", name, addr, err)
+			continue
+		}
+		if t.serve(conn, p2pRoleDialer) {
+			attempt = 0
+		}
+	}
+	log.Debugf("Giving up on peer %s at %s", name, addr)
+}
+
+// accept serves incoming connections from peers.
+func (t *p2pTransport) accept() {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			return
+		}
+		go t.serve(conn, p2pRoleListener)
+	}
+}
+
+// serve authenticates a peer, sends it our retained messages, and reads its
+// messages until the connection is closed. Returns false if the handshake
+// failed.
+func (t *p2pTransport) serve(conn net.Conn, role byte) bool {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(p2pHandshakeLimit))
+	r := bufio.NewReader(conn)
+	p, err := t.handshake(conn, r, role)
+	if err != nil {
+		log.Debugf("Rejecting peer %s: %v", conn.RemoteAddr(), err)
+		return false
+	}
+	conn.SetDeadline(time.Time{})
+
+	t.Lock()
+	if t.closed || t.peers[p.name] != nil {
+		t.Unlock()
+		return true
+	}
+	t.peers[p.name] = p
+	retained := map[string]retainedMessage{}
+	for topic, m := range t.retained {
+		retained[topic] = m
+	}
+	// Peers replace the server.
+	fallback := t.fallback
+	t.fallback = nil
+	t.Unlock()
+	select {
+	case t.found <- struct{}{}:
+	default:
+	}
+
+	log.Infof("Connected to peer %s (%s)", p.name, conn.RemoteAddr())
+	if fallback != nil {
+		log.Infof("Disconnecting from server %s", *t.cfg.server)
+		fallback.close()
+	}
+	defer func() {
+		t.Lock()
+		delete(t.peers, p.name)
+		t.Unlock()
+		log.Infof("Disconnected from peer %s", p.name)
+	}()
+
+	for topic, m := range retained {
+		if err := p.send(topic, true, m.time, m.payload); err != nil {
+			log.Debugf("Unable to send to peer %s: %v", p.name, err)
+			return true
+		}
+	}
+
+	for {
+		flags, sent, topic, payload, err := readP2PFrame(r)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Debugf("Error reading from peer %s: %v", p.name, err)
+			}
+			return true
+		}
+		t.dispatch(topic, flags&p2pFlagRetained != 0, sent, payload)
+	}
+}
+
+// handshake exchanges hellos and proofs with a peer.
+func (t *p2pTransport) handshake(conn net.Conn, r *bufio.Reader, role byte) (*p2pPeer, error) {
+	tlsconn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil, errors.New("not a TLS connection")
+	}
+	if err := tlsconn.Handshake(); err != nil {
+		return nil, err
+	}
+	cs := tlsconn.ConnectionState()
+	exporter, err := cs.ExportKeyingMaterial(p2pExporterLabel, nil, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, p2pNonceLen)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	hello := append([]byte(p2pMagic), role)
+	hello = append(hello, nonce...)
+	hello = append(hello, byte(len(t.name)))
+	hello = append(hello, t.name...)
+	if _, err := conn.Write(hello); err != nil {
+		return nil, err
+	}
+
+	head := make([]byte, len(p2pMagic)+1+p2pNonceLen+1)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	if string(head[:len(p2pMagic)]) != p2pMagic {
+		return nil, errors.New("invalid hello")
+	}
+	peerRole := head[len(p2pMagic)]
+	if peerRole == role || (peerRole != p2pRoleDialer && peerRole != p2pRoleListener) {
+		return nil, errors.New("invalid role")
+	}
+	peerNonce := head[len(p2pMagic)+1 : len(p2pMagic)+1+p2pNonceLen]
+	name := make([]byte, head[len(head)-1])
+	if _, err := io.ReadFull(r, name); err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(t.proof(role, peerNonce, nonce, exporter)); err != nil {
+		return nil, err
+	}
+	proof := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(r, proof); err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(proof, t.proof(peerRole, nonce, peerNonce, exporter)) {
+		return nil, errors.New("invalid proof (different key or topic?)")
+	}
+	return &p2pPeer{name: string(name), conn: conn, w: bufio.NewWriter(conn)}, nil
+}
+
+// proof returns the proof of knowledge of the p2p key sent by the side with
+// the given role and nonce.
+func (t *p2pTransport) proof(role byte, peerNonce, nonce, exporter []byte) []byte {
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte(p2pProofLabel))
+	mac.Write([]byte{role})
+	mac.Write(peerNonce)
+	mac.Write(nonce)
+	mac.Write(exporter)
+	return mac.Sum(nil)
+}
+
+// dispatch calls the handlers of the subscriptions matching the topic.
+func (t *p2pTransport) dispatch(topic string, retained bool, sent int64, payload []byte) {
+	if retained && !t.keep(topic, payload, sent) {
+		return
+	}
+	t.Lock()
+	var handlers []func(message)
+	for _, s := range t.subs {
+		if matchesAny(s.filters, topic) {
+			handlers = append(handlers, s.handler)
+		}
+	}
+	t.Unlock()
+	for _, h := range handlers {
+		h(message{topic: topic, payload: payload, retained: retained})
+	}
+}
+
+// send writes a message frame to the peer.
+func (p *p2pPeer) send(topic string, retained bool, sent int64, payload []byte) error {
+	var flags byte
+	if retained {
+		flags |= p2pFlagRetained
+	}
+	frame := []byte{flags}
+	frame = append(frame, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(frame[1:], uint64(sent))
+	frame = append(frame, byte(len(topic)>>8), byte(len(topic)))
+	frame = append(frame, topic...)
+	frame = append(frame, byte(len(payload)>>24), byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload)))
+
+	p.Lock()
+	defer p.Unlock()
+	p.conn.SetWriteDeadline(time.Now().Add(p2pWriteTimeout))
+	p.w.Write(frame)
+	p.w.Write(payload)
+	return p.w.Flush()
+}
+
+// readP2PFrame reads a message frame. Returns the flags, time, topic and
+// payload.
+func readP2PFrame(r *bufio.Reader) (byte, int64, string, []byte, error) {
+	head := make([]byte, 11)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return 0, 0, "", nil, err
+	}
+	topic := make([]byte, binary.BigEndian.Uint16(head[9:]))
+	if _, err := io.ReadFull(r, topic); err != nil {
+		return 0, 0, "", nil, err
+	}
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return 0, 0, "", nil, err
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n > defaultServerMaxSize {
+		return 0, 0, "", nil, fmt.Errorf("message too large (%d bytes)", n)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, 0, "", nil, err
+	}
+	if !validTopic(string(topic)) {
+		return 0, 0, "", nil, fmt.Errorf("invalid topic %q", topic)
+	}
+	return head[0], int64(binary.BigEndian.Uint64(head[1:])), string(topic), payload, nil
+}
+
+// newP2PCertificate returns a throwaway self-signed certificate.
+func newP2PCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("error creating certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
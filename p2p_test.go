@@ -0,0 +1,141 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+// testP2PTransport returns a transport (not listening or announced) using
+// the key.
+func testP2PTransport(t *testing.T, name string, key []byte) *p2pTransport {
+	t.Helper()
+	cert, err := newP2PCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &p2pTransport{
+		name:   name,
+		secret: key,
+		tlsconfig: &tls.Config{
+			Certificates:       []tls.Certificate{cert},
+			MinVersion:         tls.VersionTLS13,
+			InsecureSkipVerify: true,
+		},
+	}
+}
+
+// p2pHandshakeResult holds the result of one side of a handshake.
+type p2pHandshakeResult struct {
+	peer *p2pPeer
+	err  error
+}
+
+// testP2PHandshake runs the handshake between a dialer and a listener over a
+// loopback TCP connection.
+func testP2PHandshake(t *testing.T, dialer, listener *p2pTransport) (p2pHandshakeResult, p2pHandshakeResult) {
+	t.Helper()
+	l, err := tls.Listen("tcp", "127.0.0.1:0", listener.tlsconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ch := make(chan p2pHandshakeResult, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			ch <- p2pHandshakeResult{err: err}
+			return
+		}
+		conn.SetDeadline(time.Now().Add(p2pHandshakeLimit))
+		t.Cleanup(func() { conn.Close() })
+		p, err := listener.handshake(conn, bufio.NewReader(conn), p2pRoleListener)
+		ch <- p2pHandshakeResult{peer: p, err: err}
+	}()
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), dialer.tlsconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(p2pHandshakeLimit))
+	t.Cleanup(func() { conn.Close() })
+	p, err := dialer.handshake(conn, bufio.NewReader(conn), p2pRoleDialer)
+	return p2pHandshakeResult{peer: p, err: err}, <-ch
+}
+
+func TestP2PHandshake(t *testing.T) {
+	dialer := testP2PTransport(t, "a", testKey(1))
+	listener := testP2PTransport(t, "b", testKey(1))
+	d, l := testP2PHandshake(t, dialer, listener)
+	if d.err != nil || l.err != nil {
+		t.Fatalf("handshake: dialer %v, listener %v", d.err, l.err)
+	}
+	if d.peer.name != "b" || l.peer.name != "a" {
+		t.Errorf("peer names %q and %q, want b and a", d.peer.name, l.peer.name)
+	}
+}
+
+func TestP2PHandshakeWrongKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		dialer   []byte
+		listener []byte
+	}{
+		{"dialer with the wrong key", testKey(2), testKey(1)},
+		{"listener with the wrong key", testKey(1), testKey(2)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, l := testP2PHandshake(t, testP2PTransport(t, "a", tt.dialer), testP2PTransport(t, "b", tt.listener))
+			if d.err == nil || l.err == nil {
+				t.Errorf("handshake succeeded: dialer %v, listener %v", d.err, l.err)
+			}
+		})
+	}
+}
+
+func TestP2PProof(t *testing.T) {
+	tr := testP2PTransport(t, "a", testKey(1))
+	nonce, peerNonce, exporter := []byte("nonce"), []byte("peer nonce"), []byte("exporter")
+	proof := tr.proof(p2pRoleDialer, peerNonce, nonce, exporter)
+
+	tests := []struct {
+		name  string
+		proof []byte
+	}{
+		{"wrong key", testP2PTransport(t, "a", testKey(2)).proof(p2pRoleDialer, peerNonce, nonce, exporter)},
+		{"wrong role", tr.proof(p2pRoleListener, peerNonce, nonce, exporter)},
+		{"swapped nonces", tr.proof(p2pRoleDialer, nonce, peerNonce, exporter)},
+		{"other TLS session", tr.proof(p2pRoleDialer, peerNonce, nonce, []byte("other"))},
+	}
+	for _, tt := range tests {
+		if bytes.Equal(tt.proof, proof) {
+			t.Errorf("%s: same proof", tt.name)
+		}
+	}
+}
+
+func TestP2PFrame(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	p := &p2pPeer{name: "peer", conn: client, w: bufio.NewWriter(client)}
+
+	payload := bytes.Repeat([]byte("x"), 1000)
+	go p.send("topic/a", true, 1234, payload)
+
+	flags, sent, topic, got, err := readP2PFrame(bufio.NewReader(server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags&p2pFlagRetained == 0 || sent != 1234 || topic != "topic/a" || !bytes.Equal(got, payload) {
+		t.Errorf("readP2PFrame = %d, %d, %q, %d bytes", flags, sent, topic, len(got))
+	}
+}
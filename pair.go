@@ -0,0 +1,468 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+// Device pairing
+//
+// "clipsync pair" (on a device already set up) prints a one-time code, and
+// "clipsync pair <code>" (on the new device) receives the crypt key, server
+// settings and topic. The devices run SPAKE2 (RFC 9382) over edwards25519,
+// with the code as the password, through the configured broker (or the one
+// given with --pairing-server). An eavesdropper (or the broker) learns
+// nothing about the key, and an attacker gets a single guess at the code.
+//
+// The code looks like "1234-abcd-efgh". The first two groups select the
+// pairing topic, "clipsync/pair/<hash>", so the topic can't be guessed (or
+// squatted) without seeing the code. Messages:
+//
+//	offer    (offering device, retained) pA
+//	join     (new device)                pB + confirmation MAC
+//	settings (offering device)           confirmation MAC + encrypted settings
+//
+// Both devices show a fingerprint of the exchange, and ask the user to
+// confirm it matches before sending or saving anything.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"filippo.io/edwards25519"
+	"github.com/fxamacker/cbor/v2"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// Time to wait for the other device.
+	pairTimeout = 5 * time.Minute
+
+	// Characters used in the secret part of pairing codes (no 0, 1, l, o).
+	pairAlphabet = "abcdefghijkmnpqrstuvwxyz23456789"
+
+	// SPAKE2 identities of the offering and joining devices.
+	pairOfferID = "clipsync offer"
+	pairJoinID  = "clipsync join"
+
+	// Files written by the new device, under configDir.
+	pairCAFile       = "ca.pem"
+	pairPasswordFile = "mqtt-password"
+)
+
+// SPAKE2 M and N points for edwards25519 (RFC 9382, section 6).
+const (
+	spakeM = "d048032c6ea0b6d697ddc2e86bda85a33adac920f1bf18e1b0c6d166a5cecdaf"
+	spakeN = "d3bfb518f44f3430f29d0c92af503865a1ed3281dc69b35dd868ba85f886c4ab"
+)
+
+// pairingSettings holds the settings sent to the new device.
+type pairingSettings struct {
+	Key      []byte `cbor:"1,keyasint"`
+	Server   string `cbor:"2,keyasint"`
+	User     string `cbor:"3,keyasint,omitempty"`
+	Password string `cbor:"4,keyasint,omitempty"`
+	Topic    string `cbor:"5,keyasint"`
+	CA       []byte `cbor:"6,keyasint,omitempty"`
+}
+
+// spake holds one side of a SPAKE2 exchange.
+type spake struct {
+	w *edwards25519.Scalar
+	x *edwards25519.Scalar
+	// Our message (pA or pB).
+	msg []byte
+	// Set after the exchange completes.
+	encKey   []byte
+	confirmA []byte
+	confirmB []byte
+	transcr  []byte
+}
+
+// newSpake starts a SPAKE2 exchange with the code as the password. The
+// offering device uses M, the joining device uses N.
+func newSpake(code string, offer bool) (*spake, error) {
+	h := sha512.Sum512([]byte("clipsync pairing code:" + code))
+	w, err := edwards25519.NewScalar().SetUniformBytes(h[:])
+	if err != nil {
+		return nil, err
+	}
+	r := make([]byte, 64)
+	if _, err := rand.Read(r); err != nil {
+		return nil, err
+	}
+	x, err := edwards25519.NewScalar().SetUniformBytes(r)
+	if err != nil {
+		return nil, err
+	}
+	blind, err := spakePoint(offer)
+	if err != nil {
+		return nil, err
+	}
+	// T = x*G + w*(M or N)
+	t := edwards25519.NewIdentityPoint().ScalarBaseMult(x)
+	t.Add(t, edwards25519.NewIdentityPoint().ScalarMult(w, blind))
+	return &spake{w: w, x: x, msg: t.Bytes()}, nil
+}
+
+// spakePoint returns M (offer) or N (join).
+func spakePoint(offer bool) (*edwards25519.Point, error) {
+	s := spakeN
+	if offer {
+		s = spakeM
+	}
+	b, _ := hex.DecodeString(s)
+	return edwards25519.NewIdentityPoint().SetBytes(b)
+}
+
+// finish completes the exchange with the message from the other device and
+// derives the encryption and confirmation keys.
+func (s *spake) finish(peerMsg []byte, offer bool) error {
+	peer, err := edwards25519.NewIdentityPoint().SetBytes(peerMsg)
+	if err != nil {
+		return fmt.Errorf("invalid pairing message: %v", err)
+	}
+	blind, err := spakePoint(!offer)
+	if err != nil {
+		return err
+	}
+	// K = h*x*(peer - w*(N or M))
+	k := edwards25519.NewIdentityPoint().ScalarMult(s.w, blind)
+	k.Subtract(peer, k)
+	k.MultByCofactor(k)
+	k.ScalarMult(s.x, k)
+	if k.Equal(edwards25519.NewIdentityPoint()) == 1 {
+		return errors.New("invalid pairing message")
+	}
+
+	pA, pB := s.msg, peerMsg
+	if !offer {
+		pA, pB = peerMsg, s.msg
+	}
+	var tt bytes.Buffer
+	for _, b := range [][]byte{[]byte(pairOfferID), []byte(pairJoinID), pA, pB, k.Bytes(), s.w.Bytes()} {
+		binary.Write(&tt, binary.LittleEndian, uint64(len(b)))
+		tt.Write(b)
+	}
+	s.transcr = tt.Bytes()
+
+	h := sha512.Sum512(s.transcr)
+	s.encKey = h[:cryptKeyLen]
+	confirmKeys := make([]byte, 64)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, h[cryptKeyLen:], nil, []byte("ConfirmationKeys")), confirmKeys); err != nil {
+		return err
+	}
+	s.confirmA = pairMAC(confirmKeys[:32], s.transcr)
+	s.confirmB = pairMAC(confirmKeys[32:], s.transcr)
+	return nil
+}
+
+// fingerprint returns a short fingerprint of the exchange, shown on both
+// devices.
+func (s *spake) fingerprint() string {
+	f := pairMAC(s.encKey, []byte("clipsync pairing fingerprint"))
+	return fmt.Sprintf("%x-%x-%x", f[0:2], f[2:4], f[4:6])
+}
+
+// pairMAC returns the HMAC-SHA256 of the data.
+func pairMAC(key, data []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write(data)
+	return m.Sum(nil)
+}
+
+// newPairingCode returns a random pairing code.
+func newPairingCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(10000))
+	if err != nil {
+		return "", err
+	}
+	secret := make([]byte, 8)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	for i := range secret {
+		secret[i] = pairAlphabet[int(secret[i])%len(pairAlphabet)]
+	}
+	return fmt.Sprintf("%04d-%s-%s", n.Int64(), secret[:4], secret[4:]), nil
+}
+
+// pairTopic returns the topic used to pair with the given code.
+func pairTopic(code string) (string, error) {
+	fields := strings.Split(strings.ToLower(strings.TrimSpace(code)), "-")
+	if len(fields) != 3 || len(fields[0]) != 4 || len(fields[1]) != 4 || len(fields[2]) != 4 {
+		return "", fmt.Errorf("invalid pairing code: %q", code)
+	}
+	h := sha256.Sum256([]byte("clipsync pair " + fields[0] + "-" + fields[1]))
+	return defaultTopic + "/pair/" + hex.EncodeToString(h[:16]), nil
+}
+
+// pairingConfig returns a copy of the configuration used for pairing (never
+// peer-to-peer). If server is not blank, it connects to that server instead
+// of the configured one, without credentials.
+func pairingConfig(cfg globalConfig, server string) globalConfig {
+	var p2p bool
+	cfg.p2p = &p2p
+	if server == "" {
+		return cfg
+	}
+	var user, password string
+	cfg.server = &server
+	cfg.user = &user
+	cfg.password = &password
+	cfg.cert = nil
+	return cfg
+}
+
+// pairSubscribe subscribes to the topic and returns a channel receiving the
+// non-empty messages.
+func pairSubscribe(broker transport, topic string) (chan []byte, error) {
+	ch := make(chan []byte, 1)
+	err := broker.subscribe([]string{topic}, 1, func(msg message) {
+		if len(msg.payload) == 0 {
+			return
+		}
+		select {
+		case ch <- msg.payload:
+		default:
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to subscribe to topic %s: %v", topic, err)
+	}
+	return ch, nil
+}
+
+// pairReceive waits for a message from the other device.
+func pairReceive(ch chan []byte) ([]byte, error) {
+	select {
+	case msg := <-ch:
+		return msg, nil
+	case <-time.After(pairTimeout):
+		return nil, errors.New("timeout waiting for the other device")
+	}
+}
+
+// pairConfirm shows the fingerprint and asks the user to confirm it matches
+// the one shown on the other device.
+func pairConfirm(fingerprint string) bool {
+	fmt.Fprintf(os.Stderr, "Fingerprint: %s\n", fingerprint)
+	fmt.Fprint(os.Stderr, "Does it match the fingerprint shown on the other device? [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// pairoffercmd prints a pairing code and sends our key and settings to the
+// device that joins with it.
+func pairoffercmd(cfg globalConfig, keys *keyring, server string) error {
+	if keys.fname == "" {
+		return errors.New("pairing is not needed with a passphrase. Run set-passphrase on the new device instead")
+	}
+	code, err := newPairingCode()
+	if err != nil {
+		return fmt.Errorf("error creating pairing code: %v", err)
+	}
+	topic, _ := pairTopic(code)
+
+	broker, err := newTransport(pairingConfig(cfg, server))
+	if err != nil {
+		return fmt.Errorf("unable to connect to pairing server: %v", err)
+	}
+	defer broker.close()
+
+	join, err := pairSubscribe(broker, topic+"/join")
+	if err != nil {
+		return err
+	}
+	s, err := newSpake(code, true)
+	if err != nil {
+		return err
+	}
+	if err := broker.publish(topic+"/offer", 1, true, s.msg); err != nil {
+		return fmt.Errorf("error publishing to pairing server: %v", err)
+	}
+	// Remove the retained offer when done.
+	defer broker.publish(topic+"/offer", 1, true, nil)
+
+	fmt.Printf("Run this on the new device: clipsync pair %s\n", code)
+
+	msg, err := pairReceive(join)
+	if err != nil {
+		return err
+	}
+	if len(msg) != 32+sha256.Size {
+		return errors.New("invalid pairing message")
+	}
+	if err := s.finish(msg[:32], true); err != nil {
+		return err
+	}
+	if !hmac.Equal(msg[32:], s.confirmB) {
+		return errors.New("pairing failed: wrong code. Run clipsync pair again for a new code")
+	}
+	if !pairConfirm(s.fingerprint()) {
+		return errors.New("pairing cancelled")
+	}
+
+	key, _ := keys.current()
+	settings, err := cbor.Marshal(pairingSettings{
+		Key:      key,
+		Server:   *cfg.server,
+		User:     *cfg.user,
+		Password: *cfg.password,
+		Topic:    *cfg.topic,
+		CA:       cfg.cert,
+	})
+	if err != nil {
+		return err
+	}
+	ciphertext, err := encrypt(string(settings), s.encKey, []byte(topic))
+	if err != nil {
+		return err
+	}
+	if err := broker.publish(topic+"/settings", 1, false, append(s.confirmA, ciphertext...)); err != nil {
+		return fmt.Errorf("error publishing to pairing server: %v", err)
+	}
+	log.Infof("Settings sent to the new device.")
+	return nil
+}
+
+// pairjoincmd joins the pairing started by another device with the given
+// code, and saves the key and settings received. The crypt file is only
+// overwritten if force is set.
+func pairjoincmd(cfg globalConfig, code, server string, force bool) error {
+	topic, err := pairTopic(code)
+	if err != nil {
+		return err
+	}
+	code = strings.ToLower(strings.TrimSpace(code))
+	if fileExists(*cfg.cryptfile) && !force {
+		return fmt.Errorf("crypt file %s already exists. Use --force to overwrite it", *cfg.cryptfile)
+	}
+
+	broker, err := newTransport(pairingConfig(cfg, server))
+	if err != nil {
+		return fmt.Errorf("unable to connect to pairing server: %v", err)
+	}
+	defer broker.close()
+
+	offer, err := pairSubscribe(broker, topic+"/offer")
+	if err != nil {
+		return err
+	}
+	settingsCh, err := pairSubscribe(broker, topic+"/settings")
+	if err != nil {
+		return err
+	}
+	msg, err := pairReceive(offer)
+	if err != nil {
+		return err
+	}
+
+	s, err := newSpake(code, false)
+	if err != nil {
+		return err
+	}
+	if err := s.finish(msg, false); err != nil {
+		return err
+	}
+	if err := broker.publish(topic+"/join", 1, false, append(s.msg, s.confirmB...)); err != nil {
+		return fmt.Errorf("error publishing to pairing server: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Fingerprint: %s (confirm it on the other device)\n", s.fingerprint())
+
+	msg, err = pairReceive(settingsCh)
+	if err != nil {
+		return err
+	}
+	if len(msg) < sha256.Size || !hmac.Equal(msg[:sha256.Size], s.confirmA) {
+		return errors.New("pairing failed: wrong code")
+	}
+	cleartext, err := decrypt(string(msg[sha256.Size:]), s.encKey, []byte(topic))
+	if err != nil {
+		return err
+	}
+	var settings pairingSettings
+	if err := cbor.Unmarshal([]byte(cleartext), &settings); err != nil {
+		return fmt.Errorf("error decoding settings: %v", err)
+	}
+	if len(settings.Key) != cryptKeyLen {
+		return errors.New("invalid key received")
+	}
+	if !pairConfirm(s.fingerprint()) {
+		return errors.New("pairing cancelled")
+	}
+	return savePairingSettings(cfg, settings)
+}
+
+// savePairingSettings saves the key to the crypt file and the server settings
+// to the config file.
+func savePairingSettings(cfg globalConfig, settings pairingSettings) error {
+	keys := newKeyring(settings.Key)
+	keys.fname = *cfg.cryptfile
+	if err := keys.save(); err != nil {
+		return err
+	}
+	log.Infof("Key saved to %s", *cfg.cryptfile)
+
+	dir := tildeExpand(configDir)
+	flags := []string{"--server=" + settings.Server, "--topic=" + settings.Topic}
+	if settings.User != "" {
+		flags = append(flags, "--user="+settings.User)
+	}
+	if settings.Password != "" {
+		fname := filepath.Join(dir, pairPasswordFile)
+		if err := os.WriteFile(fname, []byte(settings.Password+"\n"), 0600); err != nil {
+			return err
+		}
+		flags = append(flags, "--password-file="+fname)
+	}
+	if len(settings.CA) != 0 {
+		fname := filepath.Join(dir, pairCAFile)
+		if err := os.WriteFile(fname, settings.CA, 0600); err != nil {
+			return err
+		}
+		flags = append(flags, "--cafile="+fname)
+	}
+	fname := filepath.Join(dir, configFile)
+	if err := updateConfigFile(fname, flags); err != nil {
+		return err
+	}
+	log.Infof("Server settings saved to %s", fname)
+	return nil
+}
+
+// updateConfigFile replaces the server settings in the config file (one flag
+// per line) with the given flags. Other lines are kept.
+func updateConfigFile(fname string, flags []string) error {
+	replaced := []string{"--server", "--topic", "--user", "--password", "--password-file", "--cafile", "--random-topic"}
+
+	var buf bytes.Buffer
+	p, err := os.ReadFile(fname)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, line := range strings.Split(string(p), "\n") {
+		name := strings.SplitN(strings.TrimSpace(line), "=", 2)[0]
+		if name == "" || stringInSlice(name, replaced) {
+			continue
+		}
+		fmt.Fprintln(&buf, line)
+	}
+	for _, f := range flags {
+		fmt.Fprintln(&buf, f)
+	}
+	return os.WriteFile(fname, buf.Bytes(), 0600)
+}
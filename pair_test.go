@@ -0,0 +1,167 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// testSpake runs a SPAKE2 exchange between an offering device using
+// offerCode and a joining device using joinCode.
+func testSpake(t *testing.T, offerCode, joinCode string) (*spake, *spake) {
+	t.Helper()
+	a, err := newSpake(offerCode, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newSpake(joinCode, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.finish(b.msg, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.finish(a.msg, false); err != nil {
+		t.Fatal(err)
+	}
+	return a, b
+}
+
+func TestSpake(t *testing.T) {
+	code := "1234-abcd-efgh"
+	tests := []struct {
+		name     string
+		joinCode string
+		match    bool
+	}{
+		{"same code", code, true},
+		{"different secret", "1234-abcd-efgk", false},
+		{"different topic", "1235-abcd-efgh", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := testSpake(t, code, tt.joinCode)
+			checks := []struct {
+				name string
+				a, b []byte
+			}{
+				{"encryption key", a.encKey, b.encKey},
+				{"offer confirmation", a.confirmA, b.confirmA},
+				{"join confirmation", a.confirmB, b.confirmB},
+			}
+			for _, c := range checks {
+				if got := bytes.Equal(c.a, c.b); got != tt.match {
+					t.Errorf("%s: equal = %v, want %v", c.name, got, tt.match)
+				}
+			}
+			if got := a.fingerprint() == b.fingerprint(); got != tt.match {
+				t.Errorf("fingerprints %s and %s: equal = %v, want %v", a.fingerprint(), b.fingerprint(), got, tt.match)
+			}
+			if bytes.Equal(a.confirmA, a.confirmB) {
+				t.Error("both confirmations are equal")
+			}
+		})
+	}
+}
+
+func TestSpakeFresh(t *testing.T) {
+	code := "1234-abcd-efgh"
+	a1, _ := testSpake(t, code, code)
+	a2, _ := testSpake(t, code, code)
+	if bytes.Equal(a1.msg, a2.msg) || bytes.Equal(a1.encKey, a2.encKey) {
+		t.Error("two exchanges with the same code produced the same messages or keys")
+	}
+}
+
+func TestSpakeInvalidMessage(t *testing.T) {
+	a, err := newSpake("1234-abcd-efgh", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// w*N (a message with no secret of the joining device) yields the
+	// identity as the shared point.
+	n, err := spakePoint(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, msg := range map[string][]byte{
+		"identity": n.ScalarMult(a.w, n).Bytes(),
+		"short":    {1, 2, 3},
+	} {
+		if err := a.finish(msg, true); err == nil {
+			t.Errorf("%s: finish succeeded", name)
+		}
+	}
+}
+
+func TestPairTopic(t *testing.T) {
+	topic, err := pairTopic("1234-abcd-efgh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(topic, defaultTopic+"/pair/") || !validTopic(topic) {
+		t.Errorf("pairTopic = %q, want a valid topic under %s/pair/", topic, defaultTopic)
+	}
+
+	tests := []struct {
+		code string
+		same bool
+	}{
+		{" 1234-ABCD-efgh\n", true},
+		{"1234-abcd-zzzz", true},
+		{"1234-abce-efgh", false},
+		{"1235-abcd-efgh", false},
+	}
+	for _, tt := range tests {
+		got, err := pairTopic(tt.code)
+		if err != nil {
+			t.Errorf("pairTopic(%q): %v", tt.code, err)
+			continue
+		}
+		if (got == topic) != tt.same {
+			t.Errorf("pairTopic(%q) = %q, same as 1234-abcd-efgh = %v, want %v", tt.code, got, got == topic, tt.same)
+		}
+	}
+
+	for _, code := range []string{"", "1234", "1234-abcd", "123-abcd-efgh", "1234-abcd-efgh-ijkl", "1234-abcde-fgh"} {
+		if _, err := pairTopic(code); err == nil {
+			t.Errorf("pairTopic(%q) succeeded", code)
+		}
+	}
+}
+
+func TestNewPairingCode(t *testing.T) {
+	code, err := newPairingCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pairTopic(code); err != nil {
+		t.Errorf("newPairingCode = %q: %v", code, err)
+	}
+	for _, c := range strings.ReplaceAll(code[5:], "-", "") {
+		if !strings.ContainsRune(pairAlphabet, c) {
+			t.Errorf("newPairingCode = %q, contains %q", code, c)
+		}
+	}
+}
+
+func TestPairingConfig(t *testing.T) {
+	server, user, password, p2p := "ssl://broker:8883", "alice", "secret", true
+	cfg := globalConfig{server: &server, user: &user, password: &password, p2p: &p2p, cert: []byte("ca")}
+
+	got := pairingConfig(cfg, "")
+	if *got.server != server || *got.user != user || *got.password != password || string(got.cert) != "ca" || *got.p2p {
+		t.Errorf("pairingConfig without a pairing server: server %q, user %q, p2p %v", *got.server, *got.user, *got.p2p)
+	}
+
+	got = pairingConfig(cfg, "tcp://other:1883")
+	if *got.server != "tcp://other:1883" || *got.user != "" || *got.password != "" || got.cert != nil || *got.p2p {
+		t.Errorf("pairingConfig with a pairing server: server %q, user %q, p2p %v", *got.server, *got.user, *got.p2p)
+	}
+	if !*cfg.p2p || *cfg.server != server {
+		t.Error("pairingConfig changed the original configuration")
+	}
+}
@@ -4,37 +4,85 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-
-	mqtt "github.com/eclipse/paho.mqtt.golang"
-	log "github.com/romana/rlog"
+	"os"
+	"time"
 )
 
 // pastecmd prints the first message from the server (all messages are sent
-// with persist).
-func pastecmd(cfg globalConfig, instanceID string, cryptPassword []byte) error {
-	ch := make(chan string)
+// with persist) in the requested mime type.
+func pastecmd(cfg globalConfig, instanceID string, crypt crypter, sig *signer, mimetype string) error {
+	// The handler must not block: send the first result only.
+	ch := make(chan clipContents, 1)
+	send := func(c clipContents) {
+		select {
+		case ch <- c:
+		default:
+		}
+	}
+	chunks := newReassembler()
+
+	broker, err := newTransport(cfg)
+	if err != nil {
+		return fmt.Errorf("unable to connect to broker: %v", err)
+	}
+	defer broker.close()
 
-	broker, err := newBroker(cfg, func(client mqtt.Client, msg mqtt.Message) {
-		data := string(msg.Payload())
+	err = broker.subscribe(clientFilters(*cfg.topic), 1, func(msg message) {
+		data := string(msg.payload)
 
-		mqttmsg, err := decodeMQTT(data, cryptPassword)
+		env, err := decodeMQTT(data, msg.topic, crypt, sig, chunks)
+		if errors.Is(err, errChunkPending) {
+			return
+		}
 		if err != nil {
-			log.Debug(err)
-			ch <- ""
+			// Stale chunks from older transfers are not fatal.
+			if msg.topic != *cfg.topic {
+				log.Debug("Ignoring message", "topic", msg.topic, "error", err)
+				return
+			}
+			log.Error("Unable to decode message", "error", err)
+			send(nil)
+			return
+		}
+		if env.isKeyRotation() {
 			return
 		}
-		log.Debugf("Received from server [%s]: %s", mqttmsg.InstanceID, redact.redact(mqttmsg.Message))
-		ch <- mqttmsg.Message
+		reportPeerVersion(env)
+		contents := env.contents()
+		log.Debugf("Received from server [%s]: %s", env.sender(), redact.redactContents(contents))
+		send(contents)
 	})
 	if err != nil {
-		return fmt.Errorf("unable to connect to broker: %v", err)
+		return fmt.Errorf("unable to subscribe to topic %s: %v", *cfg.topic, err)
 	}
 
 	// Wait for read return
-	spub := <-ch
-	fmt.Print(spub)
-	broker.Disconnect(1)
+	var contents clipContents
+	select {
+	case contents = <-ch:
+	case <-time.After(chunkTimeout):
+		return errors.New("timeout waiting for clipboard contents from server")
+	}
+
+	data, ok := contents[canonicalMimeType(mimetype)]
+	if !ok && !contents.empty() {
+		return fmt.Errorf("clipboard has no data of type %s (available: %v)", mimetype, contents.types())
+	}
+	os.Stdout.Write(data)
 
 	return nil
 }
+
+// controlpastecmd prints the clipboard of the client listening on the
+// control socket in the requested mime type. Returns errNoClient if there's
+// no client.
+func controlpastecmd(socket, mimetype string) error {
+	resp, err := controlCall(socket, controlRequest{Op: controlPaste, Type: mimetype})
+	if err != nil {
+		return err
+	}
+	os.Stdout.Write(resp.Data)
+	return nil
+}
@@ -0,0 +1,170 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+// Redis transport
+//
+// Messages are sent with PUBLISH to a channel named after the topic, and
+// topic filters are mapped to PSUBSCRIBE patterns (matches are checked again
+// with the MQTT rules). Retained messages are also stored under the key
+// redisRetainedPrefix + topic, and read by new subscribers.
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// Prefix of the keys holding retained messages.
+	redisRetainedPrefix = "clipsync:retained:"
+
+	// Timeout for the connection check.
+	redisPingTimeout = 2 * time.Second
+)
+
+// redisTransport sends and receives messages through a Redis server.
+type redisTransport struct {
+	client *redis.Client
+}
+
+// newRedisTransport connects to the Redis server.
+func newRedisTransport(cfg globalConfig) (*redisTransport, error) {
+	opts, err := redis.ParseURL(*cfg.server)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis URL: %v", err)
+	}
+	if opts.Username == "" {
+		opts.Username = *cfg.user
+	}
+	if opts.Password == "" {
+		opts.Password = *cfg.password
+	}
+	if opts.TLSConfig != nil && len(cfg.cert) != 0 {
+		opts.TLSConfig.RootCAs = x509.NewCertPool()
+		opts.TLSConfig.RootCAs.AppendCertsFromPEM(cfg.cert)
+	}
+
+	t := &redisTransport{client: redis.NewClient(opts)}
+	ctx, cancel := context.WithTimeout(context.Background(), redisPingTimeout)
+	defer cancel()
+	if err := t.client.Ping(ctx).Err(); err != nil {
+		t.client.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *redisTransport) publish(topic string, _ byte, retained bool, payload []byte) error {
+	ctx := context.Background()
+	_, err := t.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if retained {
+			if len(payload) == 0 {
+				pipe.Del(ctx, redisRetainedPrefix+topic)
+			} else {
+				pipe.Set(ctx, redisRetainedPrefix+topic, payload, 0)
+			}
+		}
+		pipe.Publish(ctx, topic, payload)
+		return nil
+	})
+	return err
+}
+
+func (t *redisTransport) subscribe(filters []string, _ byte, handler func(message)) error {
+	ctx := context.Background()
+
+	var patterns []string
+	for _, f := range expandFilters(filters) {
+		patterns = append(patterns, redisPattern(f))
+	}
+	pubsub := t.client.PSubscribe(ctx, patterns...)
+	// Wait for the confirmation, so no messages are lost between reading the
+	// retained messages and the subscription.
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return fmt.Errorf("unable to subscribe to %v: %v", filters, err)
+	}
+
+	// Deliver the retained messages, then the live ones (buffered by
+	// pubsub meanwhile).
+	go func() {
+		t.sendRetained(ctx, filters, patterns, handler)
+		for msg := range pubsub.Channel() {
+			if matchesAny(filters, msg.Channel) {
+				handler(message{topic: msg.Channel, payload: []byte(msg.Payload)})
+			}
+		}
+	}()
+	return nil
+}
+
+// sendRetained calls handler for the retained messages matching the filters.
+func (t *redisTransport) sendRetained(ctx context.Context, filters, patterns []string, handler func(message)) {
+	for _, p := range patterns {
+		iter := t.client.Scan(ctx, 0, redisRetainedPrefix+p, 100).Iterator()
+		for iter.Next(ctx) {
+			topic := strings.TrimPrefix(iter.Val(), redisRetainedPrefix)
+			if !matchesAny(filters, topic) {
+				continue
+			}
+			payload, err := t.client.Get(ctx, iter.Val()).Bytes()
+			if err != nil {
+				log.Debugf("Unable to read retained message for %s: %v", topic, err)
+				continue
+			}
+			handler(message{topic: topic, payload: payload, retained: true})
+		}
+		if err := iter.Err(); err != nil {
+			log.Errorf("Unable to read retained messages: %v", err)
+		}
+	}
+}
+
+func (t *redisTransport) connected() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), redisPingTimeout)
+	defer cancel()
+	return t.client.Ping(ctx).Err() == nil
+}
+
+func (t *redisTransport) close() {
+	t.client.Close()
+}
+
+// redisPattern returns the PSUBSCRIBE (and SCAN) pattern for an MQTT topic
+// filter. Redis wildcards also match "/", so the pattern may match topics
+// outside the filter.
+func redisPattern(filter string) string {
+	var b strings.Builder
+	for i, l := range strings.Split(filter, "/") {
+		if i > 0 {
+			b.WriteByte('/')
+		}
+		if l == "+" || l == "#" {
+			b.WriteByte('*')
+			continue
+		}
+		for _, c := range l {
+			if strings.ContainsRune(`*?[]\`, c) {
+				b.WriteByte('\\')
+			}
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// matchesAny returns true if the topic matches one of the filters.
+func matchesAny(filters []string, topic string) bool {
+	for _, f := range filters {
+		if topicMatch(f, topic) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,232 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+// Replay protection
+//
+// Every envelope carries a timestamp and a sequence number that increases
+// with every message sent from a device (across restarts and instances, see
+// nextSequence). Both are encrypted and authenticated with the rest of the
+// envelope. The client rejects messages older (or newer) than the replay
+// window, and messages with a sequence number not higher than the last one
+// seen from the same sender. Senders are identified by their signer (if
+// signed) and random device ID, which don't change when the sender restarts,
+// or by their instance ID if they have no device ID.
+//
+// The last sequence numbers seen are kept in the replay state file, so they
+// survive restarts. The file is saved every replaySaveInterval (if anything
+// changed) and when the client exits. It holds one sender per line (with the
+// sender identity escaped):
+//
+//	<sender> <sequence> <timestamp>
+//
+// Key rotations are exempt from the window (offline machines must still
+// adopt them), but not from the sequence check. Messages from older clients
+// and JSON messages carry no sequence, and can't be checked. Messages from
+// older clients are rejected with --legacy-messages=reject, or (by default)
+// once a message from another device speaking the current protocol has been
+// seen.
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Default replay state file, under configDir.
+	replayStateFile = "replay-state"
+
+	// Minimum time to remember instances. Key rotations are exempt from the
+	// window, but older ones can't be decrypted once the grace period of the
+	// previous key ends (one week by default).
+	replayMinAge = 7 * 24 * time.Hour
+
+	// Time between saves of the replay state.
+	replaySaveInterval = time.Minute
+)
+
+// Handling of messages from older clients (--legacy-messages).
+const (
+	legacyAuto   = "auto"
+	legacyAccept = "accept"
+	legacyReject = "reject"
+)
+
+// errReplay indicates a stale or replayed message.
+var errReplay = errors.New("replayed or stale message")
+
+// seenSender holds the last message seen from a sender.
+type seenSender struct {
+	seq  uint64
+	time time.Time
+}
+
+// replayGuard tracks the last message seen from each sender.
+type replayGuard struct {
+	sync.Mutex
+	fname  string
+	window time.Duration
+	seen   map[string]seenSender
+	dirty  bool
+	// Handling of messages from older clients, and the ID of this device.
+	legacy string
+	self   string
+}
+
+// newReplayGuard returns a replayGuard using the state in fname. Messages
+// older than window are rejected (0 = accept any age). Messages from older
+// clients are accepted according to legacy. self is the ID of this device.
+func newReplayGuard(fname string, window time.Duration, legacy, self string) (*replayGuard, error) {
+	r := &replayGuard{fname: fname, window: window, seen: map[string]seenSender{}, legacy: legacy, self: self}
+
+	f, err := os.Open(tildeExpand(fname))
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s, line %d: expected <sender> <sequence> <timestamp>", fname, n)
+		}
+		id, err := url.QueryUnescape(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s, line %d: %v", fname, n, err)
+		}
+		seq, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s, line %d: %v", fname, n, err)
+		}
+		ms, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s, line %d: %v", fname, n, err)
+		}
+		r.seen[id] = seenSender{seq: seq, time: time.UnixMilli(ms)}
+	}
+	return r, scanner.Err()
+}
+
+// check returns errReplay if the envelope is stale or was already seen, and
+// records it otherwise.
+func (r *replayGuard) check(e *Envelope) error {
+	r.Lock()
+	defer r.Unlock()
+
+	if e.version == legacyProtocolVersion {
+		if r.rejectLegacy() {
+			return fmt.Errorf("%w: message from %s uses the legacy protocol", errReplay, e.sender())
+		}
+		log.Debugf("Unable to check message from %s for replays (legacy protocol)", e.sender())
+		return nil
+	}
+	if e.plain {
+		log.Debugf("Unable to check message from %s for replays (JSON)", e.sender())
+		return nil
+	}
+
+	sent := time.UnixMilli(e.Timestamp)
+	if age := time.Since(sent); r.window > 0 && !e.isKeyRotation() && (age > r.window || age < -r.window) {
+		return fmt.Errorf("%w: message from %s sent at %s is outside the replay window", errReplay, e.sender(), sent.Format(time.RFC3339))
+	}
+	id := replayIdentity(e)
+	if last, ok := r.seen[id]; ok && e.Sequence <= last.seq {
+		return fmt.Errorf("%w: message from %s with sequence %d already seen", errReplay, e.sender(), e.Sequence)
+	}
+	r.seen[id] = seenSender{seq: e.Sequence, time: sent}
+	r.dirty = true
+	return nil
+}
+
+// rejectLegacy returns true if messages from older clients are rejected:
+// always with legacyReject, and with legacyAuto once a message from another
+// device was seen. Must be called with the lock held.
+func (r *replayGuard) rejectLegacy() bool {
+	switch r.legacy {
+	case legacyReject:
+		return true
+	case legacyAccept:
+		return false
+	}
+	for id := range r.seen {
+		if id != r.self && !strings.HasSuffix(id, "/"+r.self) {
+			return true
+		}
+	}
+	return false
+}
+
+// replayIdentity returns the identity of the sender of an envelope, used to
+// track its sequence numbers.
+func replayIdentity(e *Envelope) string {
+	id := e.DeviceID
+	if id == "" {
+		id = e.InstanceID
+	}
+	if e.signer != "" {
+		return e.signer + "/" + id
+	}
+	return id
+}
+
+// persist saves the replay state every replaySaveInterval, if it changed.
+// Never returns.
+func (r *replayGuard) persist() {
+	for {
+		time.Sleep(replaySaveInterval)
+		r.flush()
+	}
+}
+
+// flush saves the replay state if it changed since the last save.
+func (r *replayGuard) flush() {
+	r.Lock()
+	defer r.Unlock()
+	if !r.dirty {
+		return
+	}
+	if err := r.save(); err != nil {
+		log.Error(err.Error())
+		return
+	}
+	r.dirty = false
+}
+
+// save writes the replay state file. Senders not seen for a long time are
+// dropped, since their messages would be rejected anyway. Must be called with
+// the lock held.
+func (r *replayGuard) save() error {
+	maxAge := replayMinAge
+	if r.window > maxAge {
+		maxAge = r.window
+	}
+
+	var buf bytes.Buffer
+	for id, s := range r.seen {
+		if time.Since(s.time) > maxAge {
+			delete(r.seen, id)
+			continue
+		}
+		fmt.Fprintf(&buf, "%s %d %d\n", url.QueryEscape(id), s.seq, s.time.UnixMilli())
+	}
+	if err := os.WriteFile(tildeExpand(r.fname), buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("unable to save replay state: %v", err)
+	}
+	return nil
+}
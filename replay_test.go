@@ -0,0 +1,189 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testEnvelope returns an envelope from the device, sent at the given time
+// with the given sequence.
+func testEnvelope(device string, sent time.Time, seq uint64) *Envelope {
+	return &Envelope{
+		InstanceID: "instance-" + device,
+		DeviceID:   device,
+		Timestamp:  sent.UnixMilli(),
+		Sequence:   seq,
+		version:    protocolVersion,
+	}
+}
+
+func TestReplayGuardCheck(t *testing.T) {
+	now := time.Now()
+	rotation := testEnvelope("a", now.Add(-30*24*time.Hour), 100)
+	rotation.Metadata = map[string]string{metaRotateKey: ""}
+	signed := testEnvelope("a", now, 1)
+	signed.signer = "alice"
+	plain := testEnvelope("b", now, 0)
+	plain.plain = true
+
+	tests := []struct {
+		name   string
+		e      *Envelope
+		replay bool
+	}{
+		{"first", testEnvelope("a", now, 10), false},
+		{"same sequence", testEnvelope("a", now, 10), true},
+		{"older sequence", testEnvelope("a", now, 9), true},
+		{"newer sequence", testEnvelope("a", now, 11), false},
+		{"other device", testEnvelope("b", now, 1), false},
+		{"other signer", signed, false},
+		{"too old", testEnvelope("a", now.Add(-2*time.Hour), 20), true},
+		{"too new", testEnvelope("a", now.Add(2*time.Hour), 21), true},
+		{"old key rotation", rotation, false},
+		{"replayed key rotation", rotation, true},
+		{"JSON", plain, false},
+		{"replayed JSON", plain, false},
+	}
+
+	r, err := newReplayGuard(filepath.Join(t.TempDir(), replayStateFile), time.Hour, legacyAccept, "self")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		err := r.check(tt.e)
+		if got := errors.Is(err, errReplay); got != tt.replay {
+			t.Errorf("%s: check = %v, want replay = %v", tt.name, err, tt.replay)
+		}
+	}
+}
+
+func TestReplayGuardNoWindow(t *testing.T) {
+	r, err := newReplayGuard(filepath.Join(t.TempDir(), replayStateFile), 0, legacyAccept, "self")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.check(testEnvelope("a", time.Now().Add(-48*time.Hour), 1)); err != nil {
+		t.Errorf("check: %v", err)
+	}
+}
+
+func TestReplayGuardLegacy(t *testing.T) {
+	legacy := &Envelope{InstanceID: "old", version: legacyProtocolVersion}
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		legacy string
+		seen   []*Envelope
+		reject bool
+	}{
+		{"accept", legacyAccept, []*Envelope{testEnvelope("peer", now, 1)}, false},
+		{"reject", legacyReject, nil, true},
+		{"auto, nothing seen", legacyAuto, nil, false},
+		{"auto, only this device", legacyAuto, []*Envelope{testEnvelope("self", now, 1)}, false},
+		{"auto, other device", legacyAuto, []*Envelope{testEnvelope("peer", now, 1)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := newReplayGuard(filepath.Join(t.TempDir(), replayStateFile), time.Hour, tt.legacy, "self")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range tt.seen {
+				if err := r.check(e); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = r.check(legacy)
+			if got := errors.Is(err, errReplay); got != tt.reject {
+				t.Errorf("check = %v, want rejected = %v", err, tt.reject)
+			}
+		})
+	}
+}
+
+func TestReplayGuardPersistence(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), replayStateFile)
+	now := time.Now()
+	signed := testEnvelope("b", now, 20)
+	signed.signer = "bob / laptop"
+
+	r, err := newReplayGuard(fname, time.Hour, legacyAuto, "self")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []*Envelope{testEnvelope("a", now, 10), signed} {
+		if err := r.check(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Long gone senders are not saved.
+	r.seen["gone"] = seenSender{seq: 1, time: now.Add(-2 * replayMinAge)}
+	r.flush()
+	if r.dirty {
+		t.Error("replay state still dirty after flush")
+	}
+
+	r, err = newReplayGuard(fname, time.Hour, legacyAuto, "self")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.seen) != 2 {
+		t.Errorf("reloaded %d senders, want 2: %v", len(r.seen), r.seen)
+	}
+	if _, ok := r.seen["gone"]; ok {
+		t.Error("expired sender was saved")
+	}
+	if s := r.seen["a"]; s.seq != 10 || s.time.UnixMilli() != now.UnixMilli() {
+		t.Errorf("reloaded sender a = %+v, want sequence 10 at %v", s, now)
+	}
+
+	replayed := testEnvelope("b", now, 20)
+	replayed.signer = "bob / laptop"
+	tests := []struct {
+		name   string
+		e      *Envelope
+		replay bool
+	}{
+		{"replayed", testEnvelope("a", now, 10), true},
+		{"replayed signed", replayed, true},
+		{"newer", testEnvelope("a", now, 11), false},
+	}
+	for _, tt := range tests {
+		err := r.check(tt.e)
+		if got := errors.Is(err, errReplay); got != tt.replay {
+			t.Errorf("%s: check = %v, want replay = %v", tt.name, err, tt.replay)
+		}
+	}
+}
+
+func TestNewReplayGuardInvalid(t *testing.T) {
+	tests := []string{
+		"sender 1\n",
+		"sender x 1\n",
+		"sender 1 x\n",
+		"%zz 1 1\n",
+	}
+	for _, contents := range tests {
+		fname := writeTestFile(t, replayStateFile, contents)
+		if _, err := newReplayGuard(fname, time.Hour, legacyAuto, "self"); err == nil {
+			t.Errorf("newReplayGuard accepted %q", contents)
+		}
+	}
+}
+
+func TestNextSequence(t *testing.T) {
+	last := nextSequence()
+	for i := 0; i < 1000; i++ {
+		seq := nextSequence()
+		if seq <= last {
+			t.Fatalf("nextSequence = %d after %d", seq, last)
+		}
+		last = seq
+	}
+}
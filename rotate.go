@@ -0,0 +1,145 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+// Key rotation
+//
+// "clipsync rotate-key" creates a new key and publishes it (retained) to
+// "<topic>/keys", in an envelope encrypted with the current key. Peers
+// holding the current key adopt the new one automatically and keep the old
+// one for decryption until the end of the grace period.
+//
+// To revoke a key (E.g. a lost laptop), use --revoke. The new key is not
+// published, the old keys are discarded immediately, and the new crypt file
+// must be copied manually to the other machines.
+//
+// Any holder of a valid key could announce a rotation, so peers only adopt
+// rotations encrypted with their current key (never with a key being phased
+// out), signed by a trusted signer if there are any, pinning the topic they
+// were published to. The grace period announced is kept within
+// [minRotationGrace, maxRotationGrace], so a rotation can't revoke keys.
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Envelope metadata used by key rotation messages.
+const (
+	metaRotateKey   = "rotate-key"
+	metaRotateUntil = "rotate-until"
+	metaRotateTopic = "rotate-topic"
+)
+
+// Limits of the grace period in key rotations announced by peers.
+const (
+	minRotationGrace = time.Hour
+	maxRotationGrace = 30 * 24 * time.Hour
+)
+
+// keysTopic returns the topic used to announce key rotations.
+func keysTopic(topic string) string {
+	return topic + "/keys"
+}
+
+// isKeyRotation returns true if the envelope announces a new key.
+func (e *Envelope) isKeyRotation() bool {
+	_, ok := e.Metadata[metaRotateKey]
+	return ok
+}
+
+// rotatekeycmd replaces the current key with a new random key.
+func rotatekeycmd(cfg globalConfig, keys *keyring, sig *signer, instanceID string, grace time.Duration, revoke bool) error {
+	if keys.fname == "" {
+		return errors.New("keys derived from a passphrase cannot be rotated. Use set-passphrase on all machines instead")
+	}
+	encoded, err := createKey()
+	if err != nil {
+		return err
+	}
+	newKey, _ := decodeKey(string(encoded))
+
+	if !revoke && (grace < minRotationGrace || grace > maxRotationGrace) {
+		return fmt.Errorf("grace period must be between %v and %v", minRotationGrace, maxRotationGrace)
+	}
+	until := time.Now().Add(grace)
+	if revoke {
+		until = time.Now()
+	}
+
+	// Pin the random topic, since it's derived from the key.
+	topic := ""
+	if *cfg.randomtopic {
+		topic = *cfg.topic
+	}
+
+	if !revoke {
+		broker, err := newTransport(cfg)
+		if err != nil {
+			return fmt.Errorf("unable to connect to broker: %v", err)
+		}
+		defer broker.close()
+
+		env := newEnvelope(instanceID, *cfg.device, nil)
+		env.Metadata = map[string]string{
+			metaRotateKey:   hex.EncodeToString(newKey),
+			metaRotateUntil: until.Format(time.RFC3339),
+			metaRotateTopic: topic,
+		}
+		data, err := env.marshal()
+		if err != nil {
+			return err
+		}
+		// Encrypted with the current (old) key.
+		if err := publishMessage(broker, keysTopic(*cfg.topic), 1, sig.sign(data), keys); err != nil {
+			return err
+		}
+	}
+
+	keys.rotate(newKey, until)
+	if keys.topic == "" {
+		keys.topic = topic
+	}
+	if err := keys.save(); err != nil {
+		return fmt.Errorf("unable to save new key to %s: %v", keys.fname, err)
+	}
+
+	log.Infof("New key %x saved to %s", keyID(newKey), keys.fname)
+	if revoke {
+		log.Infof("Previous keys revoked. Copy %s to all other machines.", keys.fname)
+	} else {
+		log.Infof("Online peers will adopt the new key. Previous keys remain valid until %s.", until.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// adoptRotation adopts the key announced in a key rotation envelope received
+// on the keys topic of topic, encrypted with the key with the given ID.
+func adoptRotation(e *Envelope, keys *keyring, sig *signer, id []byte, topic string) error {
+	if sig.enforcing() && e.signer == "" {
+		return fmt.Errorf("unsigned key rotation from %s", e.sender())
+	}
+	newKey, err := hex.DecodeString(e.Metadata[metaRotateKey])
+	if err != nil || len(newKey) != cryptKeyLen {
+		return fmt.Errorf("invalid key in key rotation from %s", e.sender())
+	}
+	until, err := time.Parse(time.RFC3339, e.Metadata[metaRotateUntil])
+	if err != nil {
+		return fmt.Errorf("invalid grace period in key rotation from %s: %v", e.sender(), err)
+	}
+	now := time.Now()
+	switch {
+	case until.Before(now.Add(minRotationGrace)):
+		until = now.Add(minRotationGrace)
+	case until.After(now.Add(maxRotationGrace)):
+		until = now.Add(maxRotationGrace)
+	}
+	pin := e.Metadata[metaRotateTopic]
+	if pin != "" && pin != topic {
+		return fmt.Errorf("key rotation from %s pins topic %q, but was sent to %q", e.sender(), pin, topic)
+	}
+	return keys.adoptKey(newKey, until, pin, id)
+}
@@ -0,0 +1,195 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testKeyring returns a keyring holding the key, saved to a crypt file in a
+// temporary directory.
+func testKeyring(t *testing.T, key []byte) *keyring {
+	t.Helper()
+	k := newKeyring(key)
+	k.fname = filepath.Join(t.TempDir(), "crypt")
+	if err := k.save(); err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// rotationEnvelope returns a key rotation announcing the key, with the given
+// grace period and pinned topic.
+func rotationEnvelope(key []byte, until time.Time, topic string) *Envelope {
+	return &Envelope{
+		InstanceID: "peer",
+		Metadata: map[string]string{
+			metaRotateKey:   hex.EncodeToString(key),
+			metaRotateUntil: until.Format(time.RFC3339),
+			metaRotateTopic: topic,
+		},
+		version: protocolVersion,
+	}
+}
+
+func TestAdoptRotation(t *testing.T) {
+	oldKey, newKey := testKey(1), testKey(2)
+	enforcing := &signer{requireTrusted: true}
+	now := time.Now()
+
+	signed := rotationEnvelope(newKey, now.Add(24*time.Hour), "topic")
+	signed.signer = "peer"
+	invalid := rotationEnvelope(newKey, now, "topic")
+	invalid.Metadata[metaRotateKey] = "1234"
+	invalidTime := rotationEnvelope(newKey, now, "topic")
+	invalidTime.Metadata[metaRotateUntil] = "tomorrow"
+
+	tests := []struct {
+		name      string
+		e         *Envelope
+		sig       *signer
+		id        []byte
+		topic     string
+		ok        bool
+		wantUntil time.Time
+		wantTopic string
+	}{
+		{"adopted", rotationEnvelope(newKey, now.Add(24*time.Hour), "topic"), nil, keyID(oldKey), "topic", true, now.Add(24 * time.Hour), "topic"},
+		{"no pinned topic", rotationEnvelope(newKey, now.Add(24*time.Hour), ""), nil, keyID(oldKey), "topic", true, now.Add(24 * time.Hour), ""},
+		{"signed, enforcing", signed, enforcing, keyID(oldKey), "topic", true, now.Add(24 * time.Hour), "topic"},
+		{"grace too short", rotationEnvelope(newKey, now.Add(-time.Hour), "topic"), nil, keyID(oldKey), "topic", true, now.Add(minRotationGrace), "topic"},
+		{"grace too long", rotationEnvelope(newKey, now.Add(365*24*time.Hour), "topic"), nil, keyID(oldKey), "topic", true, now.Add(maxRotationGrace), "topic"},
+		{"unsigned, enforcing", rotationEnvelope(newKey, now.Add(24*time.Hour), "topic"), enforcing, keyID(oldKey), "topic", false, time.Time{}, ""},
+		{"not the current key", rotationEnvelope(newKey, now.Add(24*time.Hour), "topic"), nil, keyID(testKey(3)), "topic", false, time.Time{}, ""},
+		{"no key ID", rotationEnvelope(newKey, now.Add(24*time.Hour), "topic"), nil, nil, "topic", false, time.Time{}, ""},
+		{"other topic", rotationEnvelope(newKey, now.Add(24*time.Hour), "other"), nil, keyID(oldKey), "topic", false, time.Time{}, ""},
+		{"invalid key", invalid, nil, keyID(oldKey), "topic", false, time.Time{}, ""},
+		{"invalid grace period", invalidTime, nil, keyID(oldKey), "topic", false, time.Time{}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := testKeyring(t, oldKey)
+			err := adoptRotation(tt.e, k, tt.sig, tt.id, tt.topic)
+			current, _ := k.current()
+			if !tt.ok {
+				if err == nil {
+					t.Error("adoptRotation succeeded")
+				}
+				if !bytes.Equal(current, oldKey) {
+					t.Error("current key replaced")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("adoptRotation: %v", err)
+			}
+			if !bytes.Equal(current, newKey) {
+				t.Error("current key not replaced")
+			}
+
+			// The saved keyring keeps the previous key until the end of the
+			// (clamped) grace period.
+			saved, err := readKeyring(k.fname)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(saved.keys) != 2 || !bytes.Equal(saved.keys[0].key, newKey) || !bytes.Equal(saved.keys[1].key, oldKey) {
+				t.Fatalf("saved keyring holds %d keys, want the new and the old key", len(saved.keys))
+			}
+			if d := saved.keys[1].until.Sub(tt.wantUntil); d < -time.Minute || d > time.Minute {
+				t.Errorf("previous key valid until %v, want %v", saved.keys[1].until, tt.wantUntil)
+			}
+			if saved.topic != tt.wantTopic {
+				t.Errorf("pinned topic %q, want %q", saved.topic, tt.wantTopic)
+			}
+		})
+	}
+}
+
+func TestAdoptRotationOlderKey(t *testing.T) {
+	oldKey, newKey := testKey(1), testKey(2)
+	now := time.Now()
+	k := testKeyring(t, oldKey)
+	if err := adoptRotation(rotationEnvelope(newKey, now.Add(24*time.Hour), ""), k, nil, keyID(oldKey), "topic"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A rotation encrypted with the previous key can neither replace the
+	// new key nor shorten the grace period.
+	if err := adoptRotation(rotationEnvelope(testKey(3), now.Add(time.Hour), ""), k, nil, keyID(oldKey), "topic"); err == nil {
+		t.Error("adopted a rotation encrypted with the previous key")
+	}
+	if current, _ := k.current(); !bytes.Equal(current, newKey) {
+		t.Error("current key replaced")
+	}
+	if until := k.keys[1].until; until.Before(now.Add(23 * time.Hour)) {
+		t.Errorf("previous key valid until %v, want %v", until, now.Add(24*time.Hour))
+	}
+
+	// Announcing a key already held changes nothing.
+	if err := adoptRotation(rotationEnvelope(newKey, now.Add(time.Hour), ""), k, nil, keyID(newKey), "topic"); err != nil {
+		t.Errorf("adoptRotation: %v", err)
+	}
+	if len(k.keys) != 2 || k.keys[1].until.Before(now.Add(23*time.Hour)) {
+		t.Error("keyring changed by a known key")
+	}
+}
+
+func TestAdoptRotationPassphrase(t *testing.T) {
+	k := newKeyring(testKey(1))
+	if err := adoptRotation(rotationEnvelope(testKey(2), time.Now().Add(24*time.Hour), ""), k, nil, keyID(testKey(1)), "topic"); err == nil {
+		t.Error("adopted a rotation with keys derived from a passphrase")
+	}
+}
+
+func TestKeyringGrace(t *testing.T) {
+	oldKey, newKey := testKey(1), testKey(2)
+
+	// During the grace period, both keys decrypt.
+	k := testKeyring(t, oldKey)
+	c, err := k.encrypt("hello", "topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := ciphertextKeyID(c); !bytes.Equal(id, keyID(oldKey)) {
+		t.Errorf("ciphertextKeyID = %x, want %x", id, keyID(oldKey))
+	}
+	k.rotate(newKey, time.Now().Add(time.Hour))
+	if got, err := k.decrypt(c, "topic"); err != nil || got != "hello" {
+		t.Errorf("decrypt with the previous key = %q, %v", got, err)
+	}
+	if !k.has(oldKey) || !k.has(newKey) {
+		t.Error("keyring is missing a key during the grace period")
+	}
+
+	// Once it ends, the previous key is neither used nor saved.
+	k.keys[1].until = time.Now().Add(-time.Second)
+	if _, err := k.decrypt(c, "topic"); err == nil {
+		t.Error("decrypted with an expired key")
+	}
+	if k.has(oldKey) {
+		t.Error("expired key still valid")
+	}
+	if err := k.save(); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := readKeyring(k.fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.keys) != 1 || !bytes.Equal(saved.keys[0].key, newKey) {
+		t.Errorf("saved keyring holds %d keys, want only the new key", len(saved.keys))
+	}
+
+	// Revocations (a grace period in the past) drop the previous keys.
+	k = testKeyring(t, oldKey)
+	k.rotate(newKey, time.Now().Add(-time.Second))
+	if len(k.keys) != 1 || k.has(oldKey) {
+		t.Error("revoked key still in the keyring")
+	}
+}
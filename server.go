@@ -0,0 +1,243 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+// Server authentication
+//
+// The users file holds one user per line, with a plain text or bcrypt
+// hashed password (E.g. created with "htpasswd -nB <user>"):
+//
+//	<user>:<password or bcrypt hash>
+//
+// The ACL file holds one rule per line. Users can only read and write the
+// topics allowed by their rules. "*" applies a rule to all users, and "%u" in
+// a topic filter is replaced by the user name:
+//
+//	<user> <read|write|readwrite> <topic filter>
+//
+// User names containing wildcards or "/" are rejected, since they would
+// widen "%u" filters. Without a users file, anonymous clients are accepted
+// (and ACL files are refused, since users could choose any name). Without an
+// ACL file, all users can read and write all topics.
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// Default listen addresses.
+	defaultServerListen    = ":1883"
+	defaultServerListenTLS = ":8883"
+
+	// Default maximum message size, in bytes.
+	defaultServerMaxSize = 16 * 1024 * 1024
+)
+
+// serverConfig holds the options for the "server" operation.
+type serverConfig struct {
+	listen    *string
+	certfile  *string
+	keyfile   *string
+	usersfile *string
+	aclfile   *string
+	maxsize   *int
+}
+
+// aclRule holds one rule of the ACL file.
+type aclRule struct {
+	user   string
+	read   bool
+	write  bool
+	filter string
+}
+
+// serverAuth authenticates users and checks their access to topics.
+type serverAuth struct {
+	// nil if there's no users file.
+	users map[string]string
+	// nil if there's no ACL file.
+	acl []aclRule
+}
+
+// servercmd runs the embedded MQTT broker. This function only returns in
+// case of error.
+func servercmd(srvcfg serverConfig) error {
+	auth, err := newServerAuth(*srvcfg.usersfile, *srvcfg.aclfile)
+	if err != nil {
+		return err
+	}
+
+	listen := *srvcfg.listen
+	tlsEnabled := *srvcfg.certfile != "" || *srvcfg.keyfile != ""
+	if listen == "" {
+		listen = defaultServerListen
+		if tlsEnabled {
+			listen = defaultServerListenTLS
+		}
+	}
+
+	var l net.Listener
+	if tlsEnabled {
+		cert, err := tls.LoadX509KeyPair(tildeExpand(*srvcfg.certfile), tildeExpand(*srvcfg.keyfile))
+		if err != nil {
+			return fmt.Errorf("unable to load TLS certificate: %v", err)
+		}
+		l, err = tls.Listen("tcp", listen, &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12})
+		if err != nil {
+			return err
+		}
+	} else {
+		if l, err = net.Listen("tcp", listen); err != nil {
+			return err
+		}
+	}
+	defer l.Close()
+
+	if auth.users == nil {
+		log.Warn("No users file (--users-file): accepting anonymous clients.")
+	}
+	scheme := "tcp"
+	if tlsEnabled {
+		scheme = "ssl"
+	}
+	log.Infof("MQTT server listening on %s://%s", scheme, l.Addr())
+	return newMQTTServer(auth, *srvcfg.maxsize).serve(l)
+}
+
+// newServerAuth reads the users and ACL files. Blank file names disable
+// authentication and ACLs, respectively.
+func newServerAuth(usersFile, aclFile string) (*serverAuth, error) {
+	auth := &serverAuth{}
+	if usersFile != "" {
+		auth.users = map[string]string{}
+		err := readLines(usersFile, func(line string) error {
+			user, password, ok := strings.Cut(line, ":")
+			if !ok || user == "" {
+				return fmt.Errorf("expected <user>:<password>")
+			}
+			if !validUser(user) {
+				return fmt.Errorf("invalid user name %q", user)
+			}
+			auth.users[user] = password
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if aclFile != "" {
+		if usersFile == "" {
+			return nil, fmt.Errorf("an ACL file (--acl-file) requires a users file (--users-file)")
+		}
+		auth.acl = []aclRule{}
+		err := readLines(aclFile, func(line string) error {
+			fields := strings.Fields(line)
+			if len(fields) != 3 || !validFilter(fields[2]) {
+				return fmt.Errorf("expected <user> <read|write|readwrite> <topic filter>")
+			}
+			r := aclRule{user: fields[0], filter: fields[2]}
+			switch fields[1] {
+			case "read":
+				r.read = true
+			case "write":
+				r.write = true
+			case "readwrite":
+				r.read, r.write = true, true
+			default:
+				return fmt.Errorf("invalid access %q", fields[1])
+			}
+			auth.acl = append(auth.acl, r)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return auth, nil
+}
+
+// readLines calls fn for each non-blank, non-comment line in the file.
+func readLines(fname string, fn func(line string) error) error {
+	f, err := os.Open(tildeExpand(fname))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := fn(line); err != nil {
+			return fmt.Errorf("%s, line %d: %v", fname, n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// validUser returns true if the user name contains no wildcards or "/".
+func validUser(user string) bool {
+	return !strings.ContainsAny(user, "+#/")
+}
+
+// login returns true if the user and password are valid.
+func (a *serverAuth) login(user, password string) bool {
+	if !validUser(user) {
+		return false
+	}
+	if a.users == nil {
+		return true
+	}
+	stored, ok := a.users[user]
+	if !ok {
+		return false
+	}
+	if strings.HasPrefix(stored, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+}
+
+// allowed returns true if the user can read (or write) the topic.
+func (a *serverAuth) allowed(user, topic string, write bool) bool {
+	if a.acl == nil {
+		return true
+	}
+	for _, r := range a.acl {
+		if r.user != "*" && r.user != user {
+			continue
+		}
+		if (write && !r.write) || (!write && !r.read) {
+			continue
+		}
+		// Rules for "%u" never match users without a valid name.
+		if strings.Contains(r.filter, "%u") && (user == "" || !validUser(user)) {
+			continue
+		}
+		if topicMatch(strings.ReplaceAll(r.filter, "%u", user), topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// canRead returns true if the user can receive messages from the topic.
+func (a *serverAuth) canRead(user, topic string) bool {
+	return a.allowed(user, topic, false)
+}
+
+// canWrite returns true if the user can publish to the topic.
+func (a *serverAuth) canWrite(user, topic string) bool {
+	return a.allowed(user, topic, true)
+}
@@ -0,0 +1,134 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// writeTestFile writes the lines to a file in a temporary directory and
+// returns its name.
+func writeTestFile(t *testing.T, name, contents string) string {
+	t.Helper()
+	fname := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(fname, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fname
+}
+
+func TestServerLogin(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := writeTestFile(t, "users", "# comment\nplain:secret\nhashed:"+string(hash)+"\n")
+	auth, err := newServerAuth(users, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user     string
+		password string
+		want     bool
+	}{
+		{"plain", "secret", true},
+		{"plain", "wrong", false},
+		{"plain", "", false},
+		{"hashed", "secret", true},
+		{"hashed", "wrong", false},
+		{"hashed", string(hash), false},
+		{"unknown", "secret", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		if got := auth.login(tt.user, tt.password); got != tt.want {
+			t.Errorf("login(%q, %q) = %v, want %v", tt.user, tt.password, got, tt.want)
+		}
+	}
+
+	// Without a users file, anyone can log in, but never with a user name
+	// containing wildcards.
+	anon := &serverAuth{}
+	for user, want := range map[string]bool{"": true, "anyone": true, "#": false, "a+b": false, "a/b": false} {
+		if got := anon.login(user, ""); got != want {
+			t.Errorf("anonymous login(%q) = %v, want %v", user, got, want)
+		}
+	}
+}
+
+func TestServerACL(t *testing.T) {
+	users := writeTestFile(t, "users", "alice:x\nbob:x\n")
+	acl := writeTestFile(t, "acl", "* readwrite users/%u/#\n* read public\nbob write public\n")
+	auth, err := newServerAuth(users, acl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user     string
+		topic    string
+		canRead  bool
+		canWrite bool
+	}{
+		{"alice", "users/alice", true, true},
+		{"alice", "users/alice/chunks/1", true, true},
+		{"alice", "users/bob", false, false},
+		{"alice", "users/alice2", false, false},
+		{"alice", "public", true, false},
+		{"bob", "public", true, true},
+		{"bob", "other", false, false},
+		{"", "users//x", false, false},
+		{"#", "users/alice", false, false},
+		{"+", "users/alice", false, false},
+	}
+	for _, tt := range tests {
+		if got := auth.canRead(tt.user, tt.topic); got != tt.canRead {
+			t.Errorf("canRead(%q, %q) = %v, want %v", tt.user, tt.topic, got, tt.canRead)
+		}
+		if got := auth.canWrite(tt.user, tt.topic); got != tt.canWrite {
+			t.Errorf("canWrite(%q, %q) = %v, want %v", tt.user, tt.topic, got, tt.canWrite)
+		}
+	}
+
+	// Without an ACL file, everything is allowed.
+	if !(&serverAuth{}).canWrite("anyone", "any/topic") {
+		t.Error("canWrite = false without an ACL file")
+	}
+}
+
+func TestNewServerAuthInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		users string
+		acl   string
+	}{
+		{"ACL without users", "", "* readwrite #\n"},
+		{"user without password", "alice\n", ""},
+		{"user with wildcard", "a+b:x\n", ""},
+		{"user with slash", "a/b:x\n", ""},
+		{"invalid access", "alice:x\n", "alice all #\n"},
+		{"invalid filter", "alice:x\n", "alice read a/#/b\n"},
+		{"missing filter", "alice:x\n", "alice read\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var users, acl string
+			if tt.users != "" {
+				users = writeTestFile(t, "users", tt.users)
+			}
+			if tt.acl != "" {
+				acl = writeTestFile(t, "acl", tt.acl)
+			}
+			if _, err := newServerAuth(users, acl); err == nil {
+				t.Error("newServerAuth succeeded")
+			}
+		})
+	}
+}
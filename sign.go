@@ -0,0 +1,232 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+// Signatures
+//
+// With --sign, every envelope is signed with the Ed25519 key of this device
+// (stored in the signing key file, created automatically). Signed messages
+// have the format (before compression, chunking and encryption):
+//
+//	magic      4 bytes, "CSYG"
+//	public key 32 bytes, Ed25519 public key of the signer
+//	signature  64 bytes, Ed25519 signature of magic + envelope
+//	envelope   encoded envelope (see envelope.go)
+//
+// If the trusted signers file lists any signers (or with per-device
+// encryption), only messages signed by one of them (or by this device) are
+// accepted. Otherwise, unsigned messages are accepted, but signed messages
+// must still carry a valid signature. The
+// trusted signers file holds one signer per line:
+//
+//	<name> <base64 public key>
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	signedMagic     = "CSYG"
+	signedHeaderLen = len(signedMagic) + ed25519.PublicKeySize + ed25519.SignatureSize
+
+	// Default signing key and trusted signers files, under configDir.
+	signingKeyFile     = "signing-key"
+	trustedSignersFile = "trusted-signers"
+)
+
+// errUntrusted indicates a message rejected by the trusted signers policy.
+var errUntrusted = errors.New("message rejected")
+
+// signer signs outgoing messages and verifies incoming ones.
+type signer struct {
+	// Signing key of this device (nil if not signing).
+	key         ed25519.PrivateKey
+	trustedFile string
+	// Only accept messages from trusted signers (or this device), even if
+	// there are no trusted signers.
+	requireTrusted bool
+}
+
+// trustedSigner holds one entry of the trusted signers file.
+type trustedSigner struct {
+	name string
+	key  ed25519.PublicKey
+}
+
+// newSigner returns a new signer. If sign is set, outgoing messages are
+// signed with the key in keyFile (created if it does not exist).
+func newSigner(sign bool, keyFile, trustedFile string) (*signer, error) {
+	s := &signer{trustedFile: trustedFile}
+	if sign {
+		key, err := loadSigningKey(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		s.key = key
+	}
+	return s, nil
+}
+
+// sign returns a signed message containing the data, or the data unchanged
+// if this device does not sign messages.
+func (s *signer) sign(data []byte) []byte {
+	if s == nil || s.key == nil {
+		return data
+	}
+	ret := make([]byte, signedHeaderLen, signedHeaderLen+len(data))
+	copy(ret, signedMagic)
+	copy(ret[len(signedMagic):], s.key.Public().(ed25519.PublicKey))
+	signature := ed25519.Sign(s.key, append([]byte(signedMagic), data...))
+	copy(ret[len(signedMagic)+ed25519.PublicKeySize:], signature)
+	return append(ret, data...)
+}
+
+// verify checks the signature of a signed message. Returns the signed data
+// and the name of the signer ("" for unsigned messages). Unsigned messages
+// and messages signed by unknown keys are only accepted if there are no
+// trusted signers. Rejected messages return errUntrusted, along with the
+// (untrusted) data so the claimed sender can be logged.
+func (s *signer) verify(data []byte) ([]byte, string, error) {
+	var (
+		trusted []trustedSigner
+		err     error
+	)
+	if s != nil {
+		if trusted, err = readTrustedSigners(s.trustedFile); err != nil {
+			return nil, "", err
+		}
+	}
+	enforce := len(trusted) > 0 || (s != nil && s.requireTrusted)
+	if s != nil && s.key != nil {
+		trusted = append(trusted, trustedSigner{name: "self", key: s.key.Public().(ed25519.PublicKey)})
+	}
+
+	if !bytes.HasPrefix(data, []byte(signedMagic)) {
+		if enforce {
+			return data, "", fmt.Errorf("%w: unsigned message", errUntrusted)
+		}
+		return data, "", nil
+	}
+	if len(data) < signedHeaderLen {
+		return nil, "", errors.New("signed message too short")
+	}
+	pub := ed25519.PublicKey(data[len(signedMagic) : len(signedMagic)+ed25519.PublicKeySize])
+	signature := data[len(signedMagic)+ed25519.PublicKeySize : signedHeaderLen]
+	payload := data[signedHeaderLen:]
+	if !ed25519.Verify(pub, append([]byte(signedMagic), payload...), signature) {
+		return payload, "", fmt.Errorf("%w: invalid signature from key %s", errUntrusted, base64.StdEncoding.EncodeToString(pub))
+	}
+
+	for _, t := range trusted {
+		if t.key.Equal(pub) {
+			return payload, t.name, nil
+		}
+	}
+	if enforce {
+		return payload, "", fmt.Errorf("%w: unknown signer %s", errUntrusted, base64.StdEncoding.EncodeToString(pub))
+	}
+	return payload, base64.StdEncoding.EncodeToString(pub), nil
+}
+
+// enforcing returns true if only messages from trusted signers are accepted.
+func (s *signer) enforcing() bool {
+	if s == nil {
+		return false
+	}
+	if s.requireTrusted {
+		return true
+	}
+	trusted, err := readTrustedSigners(s.trustedFile)
+	return err != nil || len(trusted) > 0
+}
+
+// publicKey returns the base64 encoded public key of this device.
+func (s *signer) publicKey() string {
+	return base64.StdEncoding.EncodeToString(s.key.Public().(ed25519.PublicKey))
+}
+
+// loadSigningKey reads the signing key from the file, creating a new key if
+// the file does not exist.
+func loadSigningKey(fname string) (ed25519.PrivateKey, error) {
+	fname = tildeExpand(fname)
+	if !fileExists(fname) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("error creating signing key: %v", err)
+		}
+		if err := os.WriteFile(fname, []byte(base64.StdEncoding.EncodeToString(key.Seed())+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		log.Infof("Created a new signing key at %s", fname)
+		return key, nil
+	}
+
+	p, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(p)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s: invalid signing key", fname)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// parseSigningPublicKey decodes a base64 encoded Ed25519 public key.
+func parseSigningPublicKey(s string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key: %q", s)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// readTrustedSigners returns the signers in the trusted signers file. A
+// missing file is the same as an empty file.
+func readTrustedSigners(fname string) ([]trustedSigner, error) {
+	f, err := os.Open(tildeExpand(fname))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ret []trustedSigner
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s, line %d: expected <name> <public key>", fname, n)
+		}
+		key, err := parseSigningPublicKey(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s, line %d: %v", fname, n, err)
+		}
+		ret = append(ret, trustedSigner{name: fields[0], key: key})
+	}
+	return ret, scanner.Err()
+}
+
+// writeTrustedSigners writes the signers to the trusted signers file.
+func writeTrustedSigners(fname string, signers []trustedSigner) error {
+	var buf bytes.Buffer
+	for _, t := range signers {
+		fmt.Fprintf(&buf, "%s %s\n", t.name, base64.StdEncoding.EncodeToString(t.key))
+	}
+	return os.WriteFile(tildeExpand(fname), buf.Bytes(), 0600)
+}
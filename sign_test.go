@@ -0,0 +1,114 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// testSigner returns a signer with a new signing key (if sign is set) and the
+// given trusted signers, in a temporary directory.
+func testSigner(t *testing.T, sign bool, trusted ...*signer) *signer {
+	t.Helper()
+	dir := t.TempDir()
+	s, err := newSigner(sign, filepath.Join(dir, signingKeyFile), filepath.Join(dir, trustedSignersFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trusted) > 0 {
+		var signers []trustedSigner
+		for _, tr := range trusted {
+			signers = append(signers, trustedSigner{name: "peer", key: tr.key.Public().(ed25519.PublicKey)})
+		}
+		if err := writeTrustedSigners(s.trustedFile, signers); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+func TestSignerVerify(t *testing.T) {
+	data := []byte("envelope")
+	peer := testSigner(t, true)
+	stranger := testSigner(t, true)
+	open := testSigner(t, true)
+	trusting := testSigner(t, true, peer)
+	required := testSigner(t, false)
+	required.requireTrusted = true
+
+	tampered := peer.sign(data)
+	tampered[len(tampered)-1] ^= 1
+
+	tests := []struct {
+		name       string
+		verifier   *signer
+		msg        []byte
+		wantSigner string
+		untrusted  bool
+	}{
+		{"unsigned, no trusted signers", open, data, "", false},
+		{"signed, no trusted signers", open, peer.sign(data), peer.publicKey(), false},
+		{"self, no trusted signers", open, open.sign(data), "self", false},
+		{"nil signer", nil, data, "", false},
+		{"invalid signature, no trusted signers", open, tampered, "", true},
+		{"trusted", trusting, peer.sign(data), "peer", false},
+		{"self, trusted signers", trusting, trusting.sign(data), "self", false},
+		{"unsigned, trusted signers", trusting, data, "", true},
+		{"untrusted", trusting, stranger.sign(data), "", true},
+		{"invalid signature, trusted signers", trusting, tampered, "", true},
+		{"unsigned, required", required, data, "", true},
+		{"untrusted, required", required, peer.sign(data), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, name, err := tt.verifier.verify(tt.msg)
+			if tt.untrusted {
+				if !errors.Is(err, errUntrusted) {
+					t.Errorf("verify: got error %v, want errUntrusted", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("verify: %v", err)
+			}
+			if !bytes.Equal(got, data) || name != tt.wantSigner {
+				t.Errorf("verify = %q, %q, want %q, %q", got, name, data, tt.wantSigner)
+			}
+		})
+	}
+}
+
+func TestSignerVerifyTruncated(t *testing.T) {
+	s := testSigner(t, true)
+	msg := s.sign([]byte("envelope"))
+	if _, _, err := s.verify(msg[:signedHeaderLen-1]); err == nil {
+		t.Error("verify accepted a truncated message")
+	}
+}
+
+func TestSignerEnforcing(t *testing.T) {
+	peer := testSigner(t, true)
+	required := testSigner(t, false)
+	required.requireTrusted = true
+
+	tests := []struct {
+		name string
+		s    *signer
+		want bool
+	}{
+		{"nil", nil, false},
+		{"no trusted signers", testSigner(t, true), false},
+		{"trusted signers", testSigner(t, false, peer), true},
+		{"required", required, true},
+	}
+	for _, tt := range tests {
+		if got := tt.s.enforcing(); got != tt.want {
+			t.Errorf("%s: enforcing = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
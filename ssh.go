@@ -0,0 +1,60 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+// Clip forwarding over SSH
+//
+// The control socket of the desktop client can be forwarded to remote hosts
+// with "ssh -R" (or RemoteForward in ~/.ssh/config). On the remote host,
+// "clipsync copy" and "clipsync paste" talk to the desktop client through the
+// forwarded socket, so the remote host needs no keys or server credentials.
+//
+// The socket is found in $CLIPSYNC_SOCK or, in SSH sessions, at the default
+// path returned by sshRemoteSocket. Since that path is in /tmp, the socket is
+// only used if owned by the current user (sshd creates it as the user), so
+// other users can't plant a socket there to capture copies or feed pastes.
+// Note that anyone able to connect to the forwarded socket on the remote host
+// (E.g. root) can read and change the clipboard while the session is open.
+
+import (
+	"fmt"
+	"os/user"
+	"path/filepath"
+)
+
+// sshRemoteSocket returns the default path of the forwarded control socket
+// for a user on the remote host.
+func sshRemoteSocket(username string) string {
+	return filepath.Join("/tmp", "clipsync-"+username+".sock")
+}
+
+// sshconfigcmd prints the ssh configuration to forward the control socket of
+// the client for the current display to a remote host, at remote (if set) or
+// the default path for the remote user.
+func sshconfigcmd(host, remoteUser, remote string) error {
+	local, err := displayControlSocket()
+	if err != nil {
+		return fmt.Errorf("unable to find the client for this display: %v", err)
+	}
+	fmt.Printf("# Add to ~/.ssh/config. The remote sshd needs \"StreamLocalBindUnlink yes\"\n")
+	fmt.Printf("# to replace the socket left by previous sessions.\n")
+	if remote != "" {
+		fmt.Printf("# Set %s=%s on the remote host.\n", controlSocketEnv, remote)
+	} else {
+		if remoteUser == "" {
+			u, err := user.Current()
+			if err != nil {
+				return fmt.Errorf("unable to find the current user: %v", err)
+			}
+			remoteUser = u.Username
+		}
+		remote = sshRemoteSocket(remoteUser)
+		fmt.Printf("# The socket is only used if owned by you. Use --remote-socket to forward\n")
+		fmt.Printf("# it to a private directory instead.\n")
+	}
+	fmt.Printf("Host %s\n", host)
+	fmt.Printf("    RemoteForward %s %s\n", remote, local)
+	fmt.Printf("    StreamLocalBindUnlink yes\n")
+	return nil
+}
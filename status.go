@@ -0,0 +1,186 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fredli74/lockfile"
+)
+
+// statusReport is the output of the status command.
+type statusReport struct {
+	Running bool          `json:"running"`
+	Client  *clientStatus `json:"client,omitempty"`
+}
+
+// clientLockFile returns the lockfile of the client for the display.
+func clientLockFile(display string) string {
+	return fmt.Sprintf("%s/clipsync-lock-%s.lock", syncerLockDir, display)
+}
+
+// displayLockFile returns the lockfile of the client for the current display,
+// or blank if there's no display.
+func displayLockFile() string {
+	backend, err := detectBackend(backendAuto)
+	if err != nil {
+		return ""
+	}
+	display, err := displayName(backend)
+	if err != nil {
+		return ""
+	}
+	return clientLockFile(display)
+}
+
+// lockHeld returns true if a running process holds the lockfile. The lock is
+// not taken, so a client starting at the same time is not disturbed.
+func lockHeld(lckfile string) bool {
+	data, err := os.ReadFile(lckfile)
+	if err != nil {
+		return false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid == os.Getpid() {
+		return false
+	}
+	if !lockfile.ProcessRunning(pid) {
+		return false
+	}
+	log.Debugf("Lockfile %s is held by pid %d", lckfile, pid)
+	return true
+}
+
+// keyFingerprint returns a fingerprint of the key used to encrypt messages,
+// which reveals nothing about the key itself.
+func keyFingerprint(crypt crypter) string {
+	switch c := crypt.(type) {
+	case nil:
+		return "none (unencrypted)"
+	case *keyring:
+		_, id := c.current()
+		return hex.EncodeToString(id)
+	case *ageCrypter:
+		return c.identity.Recipient().String()
+	}
+	return "unknown"
+}
+
+// statuscmd shows the status of the client for this display (using the
+// lockfile to find whether it is running) in the chosen format.
+func statuscmd(socket, lckfile string, asJSON, short bool) error {
+	report := statusReport{Running: lckfile != "" && lockHeld(lckfile)}
+	resp, err := controlCall(socket, controlRequest{Op: controlStatus})
+	switch {
+	case err == nil:
+		report.Running = true
+		report.Client = resp.Status
+	case errors.Is(err, errNoClient):
+		log.Debugf("Unable to query the client: %v", err)
+	default:
+		return err
+	}
+
+	switch {
+	case asJSON:
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	case short:
+		fmt.Println(shortStatus(report))
+		return nil
+	}
+
+	if !report.Running {
+		return errNoClient
+	}
+	st := report.Client
+	if st == nil {
+		fmt.Println("Client:        running (status not available)")
+		return nil
+	}
+	conn := "disconnected"
+	if st.Connected {
+		conn = "connected"
+	}
+	syncing := "active"
+	if st.Paused {
+		syncing = "paused"
+	}
+	fmt.Printf("Client:        running (version %s)\n", st.Version)
+	fmt.Printf("Server:        %s (%s)\n", st.Server, conn)
+	fmt.Printf("Syncing:       %s\n", syncing)
+	fmt.Printf("Topic:         %s\n", st.Topic)
+	fmt.Printf("Key:           %s\n", st.KeyFingerprint)
+	fmt.Printf("Device:        %s (%s)\n", st.Device, st.InstanceID)
+	fmt.Printf("Last sent:     %s\n", formatMessageInfo(st.LastSent))
+	fmt.Printf("Last received: %s\n", formatMessageInfo(st.LastReceived))
+	if len(st.Peers) == 0 {
+		fmt.Println("Peers:         none seen recently")
+	}
+	for i, p := range st.Peers {
+		label := ""
+		if i == 0 {
+			label = "Peers:"
+		}
+		fmt.Printf("%-14s %s (%s)\n", label, p.Name, ago(p.LastSeen))
+	}
+	return nil
+}
+
+// shortStatus returns the status in one line (E.g. for status bars).
+func shortStatus(report statusReport) string {
+	st := report.Client
+	switch {
+	case !report.Running:
+		return "clipsync: off"
+	case st == nil:
+		return "clipsync: running"
+	case st.Paused:
+		return "clipsync: paused"
+	case !st.Connected:
+		return "clipsync: disconnected"
+	}
+	ret := []string{fmt.Sprintf("%d peers", len(st.Peers))}
+	if st.LastReceived != nil {
+		ret = append(ret, "received "+ago(st.LastReceived.Time))
+	}
+	if st.LastSent != nil {
+		ret = append(ret, "sent "+ago(st.LastSent.Time))
+	}
+	return fmt.Sprintf("clipsync: ok (%s)", strings.Join(ret, ", "))
+}
+
+// formatMessageInfo returns a description of a message sent or received.
+func formatMessageInfo(m *messageInfo) string {
+	if m == nil {
+		return "never"
+	}
+	ret := fmt.Sprintf("%s (%s), %d bytes", m.Time.Format(time.RFC3339), ago(m.Time), m.Size)
+	if m.Sender != "" {
+		ret += ", from " + m.Sender
+	}
+	return ret
+}
+
+// ago returns the time elapsed since t, in a short format (E.g. "2m ago").
+func ago(t time.Time) string {
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds ago", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d.Minutes()))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d.Hours()))
+	}
+	return fmt.Sprintf("%dd ago", int(d.Hours()/24))
+}
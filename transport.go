@@ -0,0 +1,109 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+// Transports
+//
+// Messages are sent and received through a transport, selected by the scheme
+// of the server URL:
+//
+//	tcp://, ssl://, ws://, wss://   MQTT (default, see mqtt.go)
+//	nats://                         NATS (see nats.go)
+//	redis://, rediss://             Redis pub/sub (see redis.go)
+//
+// With --p2p, messages are exchanged directly with peers on the local
+// network, using the transport above only as a fallback (see p2p.go).
+//
+// Topics and topic filters always use the MQTT syntax ("/" separated levels,
+// with "+" and "#" wildcards), and are translated by each transport. Like
+// MQTT, all transports keep the last retained message sent to each topic, and
+// deliver it to new subscribers.
+
+import (
+	"net/url"
+	"strings"
+)
+
+// message is a message received from the server.
+type message struct {
+	topic    string
+	payload  []byte
+	retained bool
+}
+
+// retainedMessage holds a retained message kept by the transport, and the
+// time it was sent (in milliseconds since the epoch).
+type retainedMessage struct {
+	payload []byte
+	time    int64
+}
+
+// transport sends and receives messages through a server.
+type transport interface {
+	// publish sends the payload to the topic. The server keeps the last
+	// retained message sent to each topic (an empty payload clears it).
+	publish(topic string, qos byte, retained bool, payload []byte) error
+
+	// subscribe calls handler for every message sent to a topic matching
+	// the filters, starting with the retained messages. Subscriptions are
+	// restored after reconnections. The handler is called from the
+	// transport's goroutines (never from subscribe itself) and must not
+	// block.
+	subscribe(filters []string, qos byte, handler func(message)) error
+
+	// connected returns true if the connection to the server is up.
+	connected() bool
+
+	// close disconnects from the server.
+	close()
+}
+
+// newTransport returns the transport for the configuration.
+func newTransport(cfg globalConfig) (transport, error) {
+	if *cfg.p2p {
+		return newP2PTransport(cfg)
+	}
+	return newServerTransport(cfg)
+}
+
+// newServerTransport connects to the configured server, using the transport
+// selected by the URL scheme.
+func newServerTransport(cfg globalConfig) (transport, error) {
+	switch serverScheme(*cfg.server) {
+	case "nats":
+		return newNATSTransport(cfg)
+	case "redis", "rediss":
+		return newRedisTransport(cfg)
+	}
+	return newMQTTTransport(cfg)
+}
+
+// serverScheme returns the (lowercase) scheme of the server URL.
+func serverScheme(server string) string {
+	u, err := url.Parse(server)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Scheme)
+}
+
+// clientFilters returns the topic filters used by clients: the topic itself,
+// its chunks and key rotations.
+func clientFilters(topic string) []string {
+	return []string{topic, chunkSubscription(topic), keysTopic(topic)}
+}
+
+// expandFilters returns the filters, adding the parent of filters ending in
+// "/#" (which also matches the parent in MQTT) for transports that lack
+// this rule.
+func expandFilters(filters []string) []string {
+	var ret []string
+	for _, f := range filters {
+		ret = append(ret, f)
+		if parent := strings.TrimSuffix(f, "/#"); parent != f {
+			ret = append(ret, parent)
+		}
+	}
+	return ret
+}
@@ -4,6 +4,8 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -11,7 +13,6 @@ import (
 	"strings"
 
 	"github.com/fredli74/lockfile"
-	log "github.com/romana/rlog"
 )
 
 // Show at most this number of characters on a redacted string
@@ -38,6 +39,12 @@ func (x redactType) redact(s string) string {
 	return ret
 }
 
+// redactContents returns a redacted version of the text in the contents,
+// followed by the list of mime types and total size.
+func (x redactType) redactContents(c clipContents) string {
+	return fmt.Sprintf("%s types=%v size=%d", x.redact(c.text()), c.types(), c.size())
+}
+
 // strquote returns a quoted string, but removes the external quotes and
 // replaces \" for " inside the string.
 func strquote(s string) string {
@@ -69,6 +76,16 @@ func tildeExpand(path string) string {
 	return filepath.Join(dirname, path[2:])
 }
 
+// stringInSlice returns true if the string is present in the slice.
+func stringInSlice(s string, list []string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
 // fileExists if the given file exists and is a file (not a directory).
 func fileExists(filename string) bool {
 	info, err := os.Stat(filename)
@@ -78,6 +95,32 @@ func fileExists(filename string) bool {
 	return !info.IsDir()
 }
 
+// Default device ID file, under configDir.
+const deviceIDFile = "device-id"
+
+// loadDeviceID reads the random ID of this device from the file, creating a
+// new ID if the file does not exist. Unlike the device name (usually the
+// hostname), the ID is unique.
+func loadDeviceID(fname string) (string, error) {
+	fname = tildeExpand(fname)
+	if p, err := os.ReadFile(fname); err == nil {
+		if id := strings.TrimSpace(string(p)); id != "" {
+			return id, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error creating device ID: %v", err)
+	}
+	id := hex.EncodeToString(b)
+	if err := os.WriteFile(fname, []byte(id+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
 // instanceID  generates a unique instance ID based on the machine name,
 // display, and a random number unique for this run.
 func instanceID() (string, error) {
@@ -85,5 +128,9 @@ func instanceID() (string, error) {
 	if err != nil {
 		return "", err
 	}
-	return fmt.Sprintf("%s%s-%d", host, os.Getenv("DISPLAY"), os.Getpid()), nil
+	display := os.Getenv("DISPLAY")
+	if display == "" && os.Getenv("WAYLAND_DISPLAY") != "" {
+		display = ":" + filepath.Base(os.Getenv("WAYLAND_DISPLAY"))
+	}
+	return fmt.Sprintf("%s%s-%d", host, display, os.Getpid()), nil
 }
@@ -0,0 +1,434 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// Timeout when reading a selection from another Wayland client, in ms.
+	waylandTimeout = 1500
+
+	// Data control protocol interfaces, in order of preference. Both have
+	// identical requests and events for our purposes.
+	extDataControlManager = "ext_data_control_manager_v1"
+	wlrDataControlManager = "zwlr_data_control_manager_v1"
+
+	// Private mime type added to the sources we create. It allows us to
+	// recognize our own selections when the compositor announces them.
+	waylandSourceMimeType = "application/x-clipsync-source"
+)
+
+// Request and event opcodes used by the backend.
+const (
+	// wl_display
+	wlDisplaySync        = 0
+	wlDisplayGetRegistry = 1
+	wlDisplayError       = 0
+
+	// wl_registry
+	wlRegistryBind   = 0
+	wlRegistryGlobal = 0
+
+	// wl_callback
+	wlCallbackDone = 0
+
+	// data_control_manager
+	dcManagerCreateDataSource = 0
+	dcManagerGetDataDevice    = 1
+
+	// data_control_device
+	dcDeviceSetSelection        = 0
+	dcDeviceSetPrimarySelection = 2
+	dcDeviceDataOffer           = 0
+	dcDeviceSelection           = 1
+	dcDeviceFinished            = 2
+	dcDevicePrimarySelection    = 3
+
+	// data_control_source
+	dcSourceOffer     = 0
+	dcSourceDestroy   = 1
+	dcSourceSend      = 0
+	dcSourceCancelled = 1
+
+	// data_control_offer
+	dcOfferReceive = 0
+	dcOfferDestroy = 1
+	dcOfferOffer   = 0
+)
+
+// wlGlobal holds one global object announced by the compositor.
+type wlGlobal struct {
+	name    uint32
+	iface   string
+	version uint32
+}
+
+// waylandBackend implements the clipboardBackend interface for Wayland
+// compositors supporting the ext-data-control or wlr-data-control protocols.
+type waylandBackend struct {
+	sync.Mutex
+	conn *wlConn
+
+	registry uint32
+	globals  []wlGlobal
+	manager  uint32
+	device   uint32
+
+	// Mime types announced by each live offer, the current offer for each
+	// selection, and the contents of the sources we own.
+	offers    map[uint32][]string
+	selection map[string]uint32
+	sources   map[uint32]clipContents
+
+	// ready is set once the initial state has been received. Changes are
+	// only signaled after that.
+	ready bool
+
+	// Selection changes, consumed by the client. Closed when the event
+	// loop exits.
+	selEvents chan selectionEvent
+}
+
+// newWaylandBackend connects to the Wayland compositor and binds the data
+// control device for the first seat.
+func newWaylandBackend() (*waylandBackend, error) {
+	conn, err := newWlConn()
+	if err != nil {
+		return nil, err
+	}
+	w := &waylandBackend{
+		conn:      conn,
+		offers:    map[uint32][]string{},
+		selection: map[string]uint32{},
+		sources:   map[uint32]clipContents{},
+		selEvents: make(chan selectionEvent, selectionEventBuffer),
+	}
+	if err := w.setup(); err != nil {
+		conn.close()
+		return nil, err
+	}
+	go w.dispatch()
+	return w, nil
+}
+
+// setup binds the globals we need and creates the data control device.
+func (w *waylandBackend) setup() error {
+	w.registry = w.conn.newID()
+	if err := w.conn.request(wlDisplayID, wlDisplayGetRegistry, wlUint(w.registry)); err != nil {
+		return err
+	}
+	if err := w.roundtrip(); err != nil {
+		return err
+	}
+
+	var seat, manager *wlGlobal
+	for i := range w.globals {
+		g := &w.globals[i]
+		switch {
+		case g.iface == "wl_seat" && seat == nil:
+			seat = g
+		case g.iface == extDataControlManager:
+			manager = g
+		case g.iface == wlrDataControlManager && g.version >= 2 && (manager == nil || manager.iface != extDataControlManager):
+			manager = g
+		}
+	}
+	if seat == nil {
+		return errors.New("wayland compositor did not announce a seat")
+	}
+	if manager == nil {
+		return errors.New("wayland compositor does not support the data-control protocol")
+	}
+	log.Debugf("Using wayland protocol %s version %d", manager.iface, manager.version)
+
+	seatID, err := w.bind(seat, 1)
+	if err != nil {
+		return err
+	}
+	version := uint32(1)
+	if manager.iface == wlrDataControlManager {
+		version = 2
+	}
+	if w.manager, err = w.bind(manager, version); err != nil {
+		return err
+	}
+	w.device = w.conn.newID()
+	if err := w.conn.request(w.manager, dcManagerGetDataDevice, wlUint(w.device), wlUint(seatID)); err != nil {
+		return err
+	}
+
+	// The compositor sends the current selections right after the device
+	// is created. Those are not changes, so we only flag ready afterwards.
+	if err := w.roundtrip(); err != nil {
+		return err
+	}
+	w.ready = true
+	return nil
+}
+
+// bind binds a global object and returns the new object ID.
+func (w *waylandBackend) bind(g *wlGlobal, version uint32) (uint32, error) {
+	id := w.conn.newID()
+	err := w.conn.request(w.registry, wlRegistryBind, wlUint(g.name), wlString(g.iface), wlUint(version), wlUint(id))
+	return id, err
+}
+
+// roundtrip processes events until the compositor has handled all requests
+// sent so far. Must only be called before the event loop starts.
+func (w *waylandBackend) roundtrip() error {
+	callback := w.conn.newID()
+	if err := w.conn.request(wlDisplayID, wlDisplaySync, wlUint(callback)); err != nil {
+		return err
+	}
+	for {
+		ev, err := w.conn.readEvent()
+		if err != nil {
+			return err
+		}
+		if ev.sender == callback && ev.opcode == wlCallbackDone {
+			return nil
+		}
+		if err := w.handleEvent(ev); err != nil {
+			return err
+		}
+	}
+}
+
+// dispatch runs as a goroutine, reading and processing events from the
+// compositor until an error happens.
+func (w *waylandBackend) dispatch() {
+	defer close(w.selEvents)
+	for {
+		ev, err := w.conn.readEvent()
+		if err == nil {
+			err = w.handleEvent(ev)
+		}
+		if err != nil {
+			log.Errorf("Wayland connection error: %v", err)
+			w.conn.close()
+			return
+		}
+	}
+}
+
+// handleEvent processes a single event from the compositor.
+func (w *waylandBackend) handleEvent(ev *wlEvent) error {
+	w.Lock()
+	defer w.Unlock()
+
+	switch {
+	case ev.sender == wlDisplayID && ev.opcode == wlDisplayError:
+		id, _ := ev.uint()
+		code, _ := ev.uint()
+		msg, _ := ev.string()
+		return fmt.Errorf("wayland protocol error on object %d (code %d): %s", id, code, msg)
+
+	case ev.sender == w.registry && ev.opcode == wlRegistryGlobal:
+		name, err := ev.uint()
+		if err != nil {
+			return err
+		}
+		iface, err := ev.string()
+		if err != nil {
+			return err
+		}
+		version, err := ev.uint()
+		if err != nil {
+			return err
+		}
+		w.globals = append(w.globals, wlGlobal{name: name, iface: iface, version: version})
+
+	case ev.sender == w.device && w.device != 0:
+		switch ev.opcode {
+		case dcDeviceDataOffer:
+			id, err := ev.uint()
+			if err != nil {
+				return err
+			}
+			w.offers[id] = nil
+		case dcDeviceSelection, dcDevicePrimarySelection:
+			id, err := ev.uint()
+			if err != nil {
+				return err
+			}
+			sel := selClipboard
+			if ev.opcode == dcDevicePrimarySelection {
+				sel = selPrimary
+			}
+			w.setOffer(sel, id)
+		case dcDeviceFinished:
+			return errors.New("wayland data control device is no longer valid")
+		}
+
+	default:
+		if _, ok := w.offers[ev.sender]; ok && ev.opcode == dcOfferOffer {
+			mime, err := ev.string()
+			if err != nil {
+				return err
+			}
+			w.offers[ev.sender] = append(w.offers[ev.sender], mime)
+			return nil
+		}
+		if contents, ok := w.sources[ev.sender]; ok {
+			switch ev.opcode {
+			case dcSourceSend:
+				mime, err := ev.string()
+				if err != nil {
+					return err
+				}
+				fd, err := ev.fd()
+				if err != nil {
+					return err
+				}
+				// Write asynchronously so a slow reader won't block the event loop.
+				go writeSource(fd, contents[canonicalMimeType(mime)])
+			case dcSourceCancelled:
+				delete(w.sources, ev.sender)
+				return w.conn.request(ev.sender, dcSourceDestroy)
+			}
+		}
+	}
+	return nil
+}
+
+// setOffer records the new offer for a selection, destroying the previous
+// one. Must be called with the lock held.
+func (w *waylandBackend) setOffer(sel string, id uint32) {
+	other := selPrimary
+	if sel == selPrimary {
+		other = selClipboard
+	}
+	old := w.selection[sel]
+	w.selection[sel] = id
+	if old != 0 && old != id && old != w.selection[other] {
+		delete(w.offers, old)
+		if err := w.conn.request(old, dcOfferDestroy); err != nil {
+			log.Debugf("Error destroying wayland offer: %v", err)
+		}
+	}
+	if w.ready {
+		sendSelectionEvent(w.selEvents, selectionEvent{
+			selection: sel,
+			local:     pickMimeType(w.offers[id], waylandSourceMimeType) != "",
+		})
+	}
+}
+
+// targets returns the mime types offered for the chosen selection.
+func (w *waylandBackend) targets(sel string) ([]string, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	offer := w.selection[sel]
+	if offer == 0 {
+		return nil, errNoSelection
+	}
+	return append([]string{}, w.offers[offer]...), nil
+}
+
+// getSelection returns the contents of the chosen selection.
+func (w *waylandBackend) getSelection(sel, mimetype string) ([]byte, error) {
+	r, wr, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create pipe: %v", err)
+	}
+	defer r.Close()
+
+	w.Lock()
+	offer := w.selection[sel]
+	mime := pickMimeType(w.offers[offer], mimetype)
+	if offer == 0 || mime == "" {
+		w.Unlock()
+		wr.Close()
+		return nil, errNoSelection
+	}
+	err = w.conn.request(offer, dcOfferReceive, wlString(mime), wlFd(int(wr.Fd())))
+	w.Unlock()
+
+	// Close our copy of the write end, or we'll never see EOF.
+	wr.Close()
+	if err != nil {
+		return nil, fmt.Errorf("error requesting wayland selection: %v", err)
+	}
+
+	r.SetReadDeadline(time.Now().Add(waylandTimeout * time.Millisecond))
+	out, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("error reading wayland selection: %v", err)
+	}
+	return out, nil
+}
+
+// setSelection sets the contents of the chosen selection.
+func (w *waylandBackend) setSelection(sel string, contents clipContents) error {
+	w.Lock()
+	defer w.Unlock()
+
+	// Text is offered in all the usual text types.
+	var offers []string
+	for _, mime := range contents.types() {
+		if mime == mimeTextPlain {
+			offers = append(offers, textMimeTypes...)
+			continue
+		}
+		offers = append(offers, mime)
+	}
+	offers = append(offers, waylandSourceMimeType)
+
+	src := w.conn.newID()
+	if err := w.conn.request(w.manager, dcManagerCreateDataSource, wlUint(src)); err != nil {
+		return err
+	}
+	for _, mime := range offers {
+		if err := w.conn.request(src, dcSourceOffer, wlString(mime)); err != nil {
+			return err
+		}
+	}
+	w.sources[src] = contents
+
+	opcode := uint16(dcDeviceSetSelection)
+	if sel == selPrimary {
+		opcode = dcDeviceSetPrimarySelection
+	}
+	return w.conn.request(w.device, opcode, wlUint(src))
+}
+
+// events returns the channel of selection changes.
+func (w *waylandBackend) events() <-chan selectionEvent {
+	return w.selEvents
+}
+
+// writeSource writes data into the file descriptor sent by the compositor
+// and closes it.
+func writeSource(fd int, data []byte) {
+	f := os.NewFile(uintptr(fd), "wayland-source")
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		log.Debugf("Error writing selection to wayland client: %v", err)
+	}
+}
+
+// pickMimeType returns the mime type to request from a list of offered
+// types. A blank mimetype or mimeTextPlain accepts any text type.
+func pickMimeType(offered []string, mimetype string) string {
+	want := []string{mimetype}
+	if mimetype == "" || mimetype == mimeTextPlain {
+		want = textMimeTypes
+	}
+	for _, m := range want {
+		for _, o := range offered {
+			if m == o {
+				return m
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,251 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+// wlproto.go - Minimal Wayland wire protocol client.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+const (
+	// Object ID of wl_display, always present.
+	wlDisplayID = 1
+
+	// Maximum size of a Wayland message (header included).
+	wlMaxMessageSize = 4096
+)
+
+// The Wayland wire protocol uses the host byte order. All platforms with a
+// Wayland compositor that we care about are little-endian.
+var wlEndian = binary.LittleEndian
+
+// wlConn is a minimal Wayland client connection. It implements just enough of
+// the wire protocol to bind globals and talk to the data-control protocols.
+type wlConn struct {
+	conn *net.UnixConn
+
+	// Serializes writes to the socket and object ID allocation.
+	wmu    sync.Mutex
+	nextID uint32
+
+	// Read buffer and file descriptors received but not yet consumed.
+	rbuf []byte
+	fds  []int
+}
+
+// wlEvent represents one event read from the Wayland socket.
+type wlEvent struct {
+	sender uint32
+	opcode uint16
+	body   []byte
+	conn   *wlConn
+}
+
+// waylandSocket returns the path to the Wayland socket, following the same
+// rules used by libwayland-client.
+func waylandSocket() string {
+	display := os.Getenv("WAYLAND_DISPLAY")
+	if display == "" {
+		display = "wayland-0"
+	}
+	if filepath.IsAbs(display) {
+		return display
+	}
+	return filepath.Join(os.Getenv("XDG_RUNTIME_DIR"), display)
+}
+
+// newWlConn opens a new connection to the Wayland compositor.
+func newWlConn() (*wlConn, error) {
+	path := waylandSocket()
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to wayland socket %s: %v", path, err)
+	}
+	// Client object IDs start right after wl_display.
+	return &wlConn{conn: conn, nextID: wlDisplayID + 1}, nil
+}
+
+// close closes the connection to the compositor.
+func (c *wlConn) close() error {
+	return c.conn.Close()
+}
+
+// newID allocates a new client side object ID.
+func (c *wlConn) newID() uint32 {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	id := c.nextID
+	c.nextID++
+	return id
+}
+
+// wlRequest holds the arguments of a request being marshaled.
+type wlRequest struct {
+	buf []byte
+	fds []int
+}
+
+func (r *wlRequest) putUint(v uint32) {
+	var b [4]byte
+	wlEndian.PutUint32(b[:], v)
+	r.buf = append(r.buf, b[:]...)
+}
+
+// putString appends a string argument: length (including the terminating
+// NUL), contents, and padding to a 32-bit boundary.
+func (r *wlRequest) putString(s string) {
+	r.putUint(uint32(len(s) + 1))
+	r.buf = append(r.buf, s...)
+	r.buf = append(r.buf, 0)
+	for len(r.buf)%4 != 0 {
+		r.buf = append(r.buf, 0)
+	}
+}
+
+// putFd adds a file descriptor to the request. File descriptors travel as
+// ancillary data and take no space in the message body.
+func (r *wlRequest) putFd(fd int) {
+	r.fds = append(r.fds, fd)
+}
+
+// request sends a request with the given opcode to object id.
+func (c *wlConn) request(id uint32, opcode uint16, args ...func(*wlRequest)) error {
+	r := &wlRequest{buf: make([]byte, 8, 64)}
+	for _, arg := range args {
+		arg(r)
+	}
+	size := len(r.buf)
+	if size > wlMaxMessageSize {
+		return fmt.Errorf("wayland request too large: %d bytes", size)
+	}
+	wlEndian.PutUint32(r.buf[0:], id)
+	wlEndian.PutUint32(r.buf[4:], uint32(size)<<16|uint32(opcode))
+
+	var oob []byte
+	if len(r.fds) > 0 {
+		oob = syscall.UnixRights(r.fds...)
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if _, _, err := c.conn.WriteMsgUnix(r.buf, oob, nil); err != nil {
+		return fmt.Errorf("error writing to wayland socket: %v", err)
+	}
+	return nil
+}
+
+// Argument helpers for request().
+
+func wlUint(v uint32) func(*wlRequest) {
+	return func(r *wlRequest) { r.putUint(v) }
+}
+
+func wlString(s string) func(*wlRequest) {
+	return func(r *wlRequest) { r.putString(s) }
+}
+
+func wlFd(fd int) func(*wlRequest) {
+	return func(r *wlRequest) { r.putFd(fd) }
+}
+
+// readEvent reads the next event from the socket. Only one goroutine may
+// read from the connection at any given time.
+func (c *wlConn) readEvent() (*wlEvent, error) {
+	if err := c.fill(8); err != nil {
+		return nil, err
+	}
+	sender := wlEndian.Uint32(c.rbuf[0:])
+	word := wlEndian.Uint32(c.rbuf[4:])
+	size := int(word >> 16)
+	if size < 8 {
+		return nil, fmt.Errorf("invalid wayland message size: %d", size)
+	}
+	if err := c.fill(size); err != nil {
+		return nil, err
+	}
+	body := make([]byte, size-8)
+	copy(body, c.rbuf[8:size])
+	c.rbuf = c.rbuf[size:]
+
+	return &wlEvent{
+		sender: sender,
+		opcode: uint16(word & 0xffff),
+		body:   body,
+		conn:   c,
+	}, nil
+}
+
+// fill reads from the socket until at least n bytes are buffered.
+func (c *wlConn) fill(n int) error {
+	buf := make([]byte, wlMaxMessageSize)
+	oob := make([]byte, syscall.CmsgSpace(28*4))
+
+	for len(c.rbuf) < n {
+		nbytes, noob, _, _, err := c.conn.ReadMsgUnix(buf, oob)
+		if err != nil {
+			return fmt.Errorf("error reading from wayland socket: %v", err)
+		}
+		if nbytes == 0 {
+			return errors.New("wayland compositor closed the connection")
+		}
+		c.rbuf = append(c.rbuf, buf[:nbytes]...)
+
+		if noob > 0 {
+			msgs, err := syscall.ParseSocketControlMessage(oob[:noob])
+			if err != nil {
+				return fmt.Errorf("error parsing wayland control message: %v", err)
+			}
+			for _, msg := range msgs {
+				fds, err := syscall.ParseUnixRights(&msg)
+				if err != nil {
+					continue
+				}
+				c.fds = append(c.fds, fds...)
+			}
+		}
+	}
+	return nil
+}
+
+// uint consumes and returns an uint (or object ID) argument from the event.
+func (e *wlEvent) uint() (uint32, error) {
+	if len(e.body) < 4 {
+		return 0, errors.New("short wayland event")
+	}
+	v := wlEndian.Uint32(e.body)
+	e.body = e.body[4:]
+	return v, nil
+}
+
+// string consumes and returns a string argument from the event.
+func (e *wlEvent) string() (string, error) {
+	n, err := e.uint()
+	if err != nil {
+		return "", err
+	}
+	padded := int((n + 3) &^ 3)
+	if n == 0 || len(e.body) < padded {
+		return "", errors.New("short wayland event")
+	}
+	s := string(e.body[:n-1])
+	e.body = e.body[padded:]
+	return s, nil
+}
+
+// fd consumes and returns a file descriptor argument from the event.
+func (e *wlEvent) fd() (int, error) {
+	if len(e.conn.fds) == 0 {
+		return -1, errors.New("wayland event is missing a file descriptor")
+	}
+	fd := e.conn.fds[0]
+	e.conn.fds = e.conn.fds[1:]
+	return fd, nil
+}
@@ -0,0 +1,655 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jezek/xgb"
+	"github.com/jezek/xgb/xfixes"
+	"github.com/jezek/xgb/xproto"
+)
+
+const (
+	// Timeout waiting for the selection owner to answer, in ms.
+	x11Timeout = 1500
+
+	// Maximum size of a selection we're willing to read.
+	x11MaxSelectionSize = 64 * 1024 * 1024
+
+	// Property on our window used to receive selection contents and
+	// to obtain timestamps from the server.
+	x11SelectionProperty = "CLIPSYNC_SELECTION"
+	x11TimestampProperty = "CLIPSYNC_TIMESTAMP"
+)
+
+// Targets used to read plain text from other clients, in order of preference.
+var x11TextTargets = []string{"UTF8_STRING", "text/plain;charset=utf-8", "text/plain", "STRING"}
+
+// x11Transfer holds the state of an INCR transfer to another client.
+type x11Transfer struct {
+	requestor xproto.Window
+	property  xproto.Atom
+	target    xproto.Atom
+	data      []byte
+	offset    int
+}
+
+// x11Target maps one of the targets we offer to a mime type in our contents.
+type x11Target struct {
+	atom     xproto.Atom
+	mimetype string
+}
+
+// x11Owned holds the contents of a selection we own.
+type x11Owned struct {
+	contents clipContents
+	targets  []x11Target
+	time     xproto.Timestamp
+}
+
+// x11Backend implements the clipboardBackend interface for X11. It speaks the
+// X selection protocol directly: it owns PRIMARY/CLIPBOARD when setting them
+// and answers the conversion requests from other clients. Changes of owner
+// are detected using the XFixes extension on the same connection.
+type x11Backend struct {
+	sync.Mutex
+	conn   *xgb.Conn
+	window xproto.Window
+
+	// Largest chunk of data we can send in a single ChangeProperty request.
+	// Anything larger than this is sent using INCR.
+	maxChunk int
+
+	atoms     map[string]xproto.Atom
+	names     map[xproto.Atom]string
+	owned     map[xproto.Atom]*x11Owned
+	transfers map[[2]uint32]*x11Transfer
+
+	// Serializes readers of the selection.
+	rmu sync.Mutex
+
+	// Events for our window, consumed by readers.
+	selNotify  chan xproto.SelectionNotifyEvent
+	propNotify chan xproto.PropertyNotifyEvent
+	timeNotify chan xproto.Timestamp
+
+	// Selection owner changes, consumed by the client.
+	selEvents chan selectionEvent
+}
+
+// newX11Backend connects to the X server and creates the (invisible) window
+// used to own and request selections.
+func newX11Backend() (*x11Backend, error) {
+	conn, err := xgb.NewConn()
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to X server: %v", err)
+	}
+	setup := xproto.Setup(conn)
+	screen := setup.DefaultScreen(conn)
+
+	wid, err := xproto.NewWindowId(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to allocate X window ID: %v", err)
+	}
+	err = xproto.CreateWindowChecked(conn, 0, wid, screen.Root, 0, 0, 1, 1, 0,
+		xproto.WindowClassInputOnly, 0, xproto.CwEventMask, []uint32{xproto.EventMaskPropertyChange}).Check()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to create X window: %v", err)
+	}
+
+	x := &x11Backend{
+		conn:       conn,
+		window:     wid,
+		maxChunk:   int(setup.MaximumRequestLength)*4 - 64,
+		atoms:      map[string]xproto.Atom{"PRIMARY": xproto.AtomPrimary, "STRING": xproto.AtomString},
+		names:      map[xproto.Atom]string{xproto.AtomPrimary: "PRIMARY", xproto.AtomString: "STRING"},
+		owned:      map[xproto.Atom]*x11Owned{},
+		transfers:  map[[2]uint32]*x11Transfer{},
+		selNotify:  make(chan xproto.SelectionNotifyEvent, 1),
+		propNotify: make(chan xproto.PropertyNotifyEvent, 16),
+		timeNotify: make(chan xproto.Timestamp, 1),
+		selEvents:  make(chan selectionEvent, selectionEventBuffer),
+	}
+	if err := x.watchSelections(screen.Root); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go x.eventLoop()
+	return x, nil
+}
+
+// watchSelections asks the X server (via XFixes) to notify us every time
+// the owner of the primary selection or the clipboard changes.
+func (x *x11Backend) watchSelections(root xproto.Window) error {
+	if err := xfixes.Init(x.conn); err != nil {
+		return fmt.Errorf("XFixes extension not available: %v", err)
+	}
+	// XFixes requires the client to announce its version before use.
+	if _, err := xfixes.QueryVersion(x.conn, 5, 0).Reply(); err != nil {
+		return fmt.Errorf("unable to query XFixes version: %v", err)
+	}
+	for _, sel := range []string{selPrimary, selClipboard} {
+		atom, err := x.selectionAtom(sel)
+		if err != nil {
+			return err
+		}
+		err = xfixes.SelectSelectionInputChecked(x.conn, root, atom, xfixes.SelectionEventMaskSetSelectionOwner).Check()
+		if err != nil {
+			return fmt.Errorf("unable to watch %s selection: %v", sel, err)
+		}
+	}
+	return nil
+}
+
+// atom returns the atom for the given name, interning it if needed.
+func (x *x11Backend) atom(name string) (xproto.Atom, error) {
+	x.Lock()
+	a, ok := x.atoms[name]
+	x.Unlock()
+	if ok {
+		return a, nil
+	}
+	reply, err := xproto.InternAtom(x.conn, false, uint16(len(name)), name).Reply()
+	if err != nil {
+		return 0, fmt.Errorf("unable to intern atom %s: %v", name, err)
+	}
+	x.Lock()
+	x.atoms[name] = reply.Atom
+	x.names[reply.Atom] = name
+	x.Unlock()
+	return reply.Atom, nil
+}
+
+// atomName returns the name of an atom, asking the server if needed.
+func (x *x11Backend) atomName(atom xproto.Atom) (string, error) {
+	x.Lock()
+	name, ok := x.names[atom]
+	x.Unlock()
+	if ok {
+		return name, nil
+	}
+	reply, err := xproto.GetAtomName(x.conn, atom).Reply()
+	if err != nil {
+		return "", fmt.Errorf("unable to get name of atom %d: %v", atom, err)
+	}
+	x.Lock()
+	x.atoms[reply.Name] = atom
+	x.names[atom] = reply.Name
+	x.Unlock()
+	return reply.Name, nil
+}
+
+// mustAtom is like atom but logs the error and returns None on failure.
+func (x *x11Backend) mustAtom(name string) xproto.Atom {
+	a, err := x.atom(name)
+	if err != nil {
+		log.Error("Unable to get atom", "name", name, "error", err)
+		return xproto.AtomNone
+	}
+	return a
+}
+
+// selectionAtom returns the atom for one of our selection names.
+func (x *x11Backend) selectionAtom(sel string) (xproto.Atom, error) {
+	if sel == selPrimary {
+		return xproto.AtomPrimary, nil
+	}
+	return x.atom("CLIPBOARD")
+}
+
+// eventLoop runs as a goroutine and processes all events sent to our window.
+// The selection events channel is closed when the connection to the X server
+// is lost.
+func (x *x11Backend) eventLoop() {
+	defer close(x.selEvents)
+	for {
+		ev, err := x.conn.WaitForEvent()
+		if ev == nil && err == nil {
+			log.Error("Connection to X server closed")
+			return
+		}
+		if err != nil {
+			log.Debugf("X error: %v", err)
+			continue
+		}
+
+		switch e := ev.(type) {
+		case xproto.SelectionRequestEvent:
+			x.handleSelectionRequest(e)
+
+		case xproto.SelectionClearEvent:
+			x.Lock()
+			delete(x.owned, e.Selection)
+			x.Unlock()
+
+		case xproto.SelectionNotifyEvent:
+			select {
+			case x.selNotify <- e:
+			default:
+			}
+
+		case xproto.PropertyNotifyEvent:
+			x.handlePropertyNotify(e)
+
+		case xfixes.SelectionNotifyEvent:
+			x.handleOwnerChange(e)
+		}
+	}
+}
+
+// handleOwnerChange sends a selectionEvent for an XFixes owner change.
+func (x *x11Backend) handleOwnerChange(e xfixes.SelectionNotifyEvent) {
+	sel := selClipboard
+	if e.Selection == xproto.AtomPrimary {
+		sel = selPrimary
+	}
+	sendSelectionEvent(x.selEvents, selectionEvent{
+		selection: sel,
+		owner:     uint32(e.Owner),
+		timestamp: uint32(e.SelectionTimestamp),
+		local:     e.Owner == x.window,
+	})
+}
+
+// handlePropertyNotify routes property change notifications: changes to our
+// window go to readers (INCR reads, timestamps) and deletions on other
+// windows drive our INCR writes.
+func (x *x11Backend) handlePropertyNotify(e xproto.PropertyNotifyEvent) {
+	if e.Window == x.window {
+		switch {
+		case e.Atom == x.mustAtom(x11TimestampProperty):
+			select {
+			case x.timeNotify <- e.Time:
+			default:
+			}
+		default:
+			select {
+			case x.propNotify <- e:
+			default:
+			}
+		}
+		return
+	}
+
+	if e.State != xproto.PropertyDelete {
+		return
+	}
+	x.Lock()
+	defer x.Unlock()
+	key := [2]uint32{uint32(e.Window), uint32(e.Atom)}
+	t, ok := x.transfers[key]
+	if !ok {
+		return
+	}
+	end := t.offset + x.maxChunk
+	if end > len(t.data) {
+		end = len(t.data)
+	}
+	chunk := t.data[t.offset:end]
+	xproto.ChangeProperty(x.conn, xproto.PropModeReplace, t.requestor, t.property, t.target, 8, uint32(len(chunk)), chunk)
+
+	// A zero-length chunk marks the end of the transfer.
+	if len(chunk) == 0 {
+		delete(x.transfers, key)
+		xproto.ChangeWindowAttributes(x.conn, t.requestor, xproto.CwEventMask, []uint32{xproto.EventMaskNoEvent})
+	}
+	t.offset = end
+}
+
+// handleSelectionRequest answers a request from another client to convert a
+// selection we own.
+func (x *x11Backend) handleSelectionRequest(e xproto.SelectionRequestEvent) {
+	// Obsolete clients use None as the property.
+	property := e.Property
+	if property == xproto.AtomNone {
+		property = e.Target
+	}
+	if !x.convert(e.Requestor, e.Selection, e.Target, property) {
+		property = xproto.AtomNone
+	}
+
+	notify := xproto.SelectionNotifyEvent{
+		Time:      e.Time,
+		Requestor: e.Requestor,
+		Selection: e.Selection,
+		Target:    e.Target,
+		Property:  property,
+	}
+	xproto.SendEvent(x.conn, false, e.Requestor, xproto.EventMaskNoEvent, string(notify.Bytes()))
+}
+
+// convert stores the selection converted to target into the requestor's
+// property. Returns false if the conversion is not possible.
+func (x *x11Backend) convert(requestor xproto.Window, selection, target, property xproto.Atom) bool {
+	x.Lock()
+	owned, ok := x.owned[selection]
+	x.Unlock()
+	if !ok {
+		return false
+	}
+
+	switch target {
+	case x.mustAtom("TARGETS"):
+		targets := []xproto.Atom{x.mustAtom("TARGETS"), x.mustAtom("TIMESTAMP")}
+		for _, t := range owned.targets {
+			targets = append(targets, t.atom)
+		}
+		buf := make([]byte, 4*len(targets))
+		for i, a := range targets {
+			xgb.Put32(buf[i*4:], uint32(a))
+		}
+		xproto.ChangeProperty(x.conn, xproto.PropModeReplace, requestor, property, xproto.AtomAtom, 32, uint32(len(targets)), buf)
+		return true
+
+	case x.mustAtom("TIMESTAMP"):
+		buf := make([]byte, 4)
+		xgb.Put32(buf, uint32(owned.time))
+		xproto.ChangeProperty(x.conn, xproto.PropModeReplace, requestor, property, xproto.AtomInteger, 32, 1, buf)
+		return true
+	}
+
+	for _, t := range owned.targets {
+		if target != t.atom {
+			continue
+		}
+		data := owned.contents[t.mimetype]
+
+		// Small selections go in a single property change.
+		if len(data) <= x.maxChunk {
+			xproto.ChangeProperty(x.conn, xproto.PropModeReplace, requestor, property, target, 8, uint32(len(data)), data)
+			return true
+		}
+
+		// Large selections use INCR: we announce the total size and send
+		// the data in chunks, each time the requestor deletes the property.
+		log.Debugf("Starting INCR transfer of %d bytes to window 0x%x", len(data), requestor)
+		x.Lock()
+		x.transfers[[2]uint32{uint32(requestor), uint32(property)}] = &x11Transfer{
+			requestor: requestor,
+			property:  property,
+			target:    target,
+			data:      data,
+		}
+		x.Unlock()
+		xproto.ChangeWindowAttributes(x.conn, requestor, xproto.CwEventMask, []uint32{xproto.EventMaskPropertyChange})
+		buf := make([]byte, 4)
+		xgb.Put32(buf, uint32(len(data)))
+		xproto.ChangeProperty(x.conn, xproto.PropModeReplace, requestor, property, x.mustAtom("INCR"), 32, 1, buf)
+		return true
+	}
+	return false
+}
+
+// serverTime returns the current X server time, obtained by appending zero
+// bytes to a property on our window and waiting for the notification.
+func (x *x11Backend) serverTime() (xproto.Timestamp, error) {
+	prop, err := x.atom(x11TimestampProperty)
+	if err != nil {
+		return 0, err
+	}
+	xproto.ChangeProperty(x.conn, xproto.PropModeAppend, x.window, prop, xproto.AtomInteger, 32, 0, nil)
+	select {
+	case t := <-x.timeNotify:
+		return t, nil
+	case <-time.After(x11Timeout * time.Millisecond):
+		return 0, errors.New("timeout waiting for X server timestamp")
+	}
+}
+
+// targets returns the list of targets offered by the owner of the chosen
+// X selection.
+func (x *x11Backend) targets(sel string) ([]string, error) {
+	selAtom, err := x.selectionAtom(sel)
+	if err != nil {
+		return nil, err
+	}
+
+	x.Lock()
+	owned, ok := x.owned[selAtom]
+	x.Unlock()
+	if ok {
+		var ret []string
+		for _, t := range owned.targets {
+			name, _ := x.atomName(t.atom)
+			ret = append(ret, name)
+		}
+		return ret, nil
+	}
+
+	data, err := x.readSelection(selAtom, "TARGETS")
+	if err != nil {
+		return nil, err
+	}
+	var ret []string
+	for i := 0; i+4 <= len(data); i += 4 {
+		name, err := x.atomName(xproto.Atom(xgb.Get32(data[i:])))
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, name)
+	}
+	return ret, nil
+}
+
+// getSelection returns the contents of the chosen X selection converted to
+// the requested mime type. A blank mimetype or mimeTextPlain try all the usual
+// text targets.
+func (x *x11Backend) getSelection(sel, mimetype string) ([]byte, error) {
+	selAtom, err := x.selectionAtom(sel)
+	if err != nil {
+		return nil, err
+	}
+	if mimetype == "" {
+		mimetype = mimeTextPlain
+	}
+
+	// No need to ask the server if we own the selection.
+	x.Lock()
+	owned, ok := x.owned[selAtom]
+	x.Unlock()
+	if ok {
+		data, ok := owned.contents[canonicalMimeType(mimetype)]
+		if !ok {
+			return nil, errNoSelection
+		}
+		return data, nil
+	}
+
+	targets := []string{mimetype}
+	if mimetype == mimeTextPlain {
+		targets = x11TextTargets
+	}
+	for _, target := range targets {
+		data, err := x.readSelection(selAtom, target)
+		if errors.Is(err, errNoSelection) {
+			continue
+		}
+		return data, err
+	}
+	return nil, errNoSelection
+}
+
+// readSelection asks the owner of selection to convert it to target and
+// returns the result.
+func (x *x11Backend) readSelection(selection xproto.Atom, target string) ([]byte, error) {
+	x.rmu.Lock()
+	defer x.rmu.Unlock()
+
+	targetAtom, err := x.atom(target)
+	if err != nil {
+		return nil, err
+	}
+	prop, err := x.atom(x11SelectionProperty)
+	if err != nil {
+		return nil, err
+	}
+
+	// Discard stale notifications from previous (timed out) requests.
+	x.drain()
+
+	xproto.ConvertSelection(x.conn, x.window, selection, targetAtom, prop, xproto.TimeCurrentTime)
+
+	// Wait for the notification answering this request, discarding others
+	// (E.g. late answers to requests for other selections or targets).
+	var notify xproto.SelectionNotifyEvent
+	timeout := time.After(x11Timeout * time.Millisecond)
+	for {
+		select {
+		case notify = <-x.selNotify:
+		case <-timeout:
+			return nil, errors.New("timeout waiting for X selection owner")
+		}
+		if notify.Selection == selection && notify.Target == targetAtom {
+			break
+		}
+		log.Debugf("Ignoring X selection notification for selection %d, target %d", notify.Selection, notify.Target)
+	}
+	// Property None means the owner could not convert (or there's no owner).
+	if notify.Property == xproto.AtomNone {
+		return nil, errNoSelection
+	}
+
+	reply, err := x.getProperty(prop)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Type != x.mustAtom("INCR") {
+		return reply.Value, nil
+	}
+
+	return readIncr(x.propNotify, prop, func() ([]byte, error) {
+		reply, err := x.getProperty(prop)
+		if err != nil {
+			return nil, err
+		}
+		return reply.Value, nil
+	})
+}
+
+// readIncr reads an INCR transfer into prop, after the property holding the
+// INCR type has been read and deleted by get. The owner sends chunks every
+// time we delete the property, ending with a zero-length chunk. get reads
+// and deletes the property.
+//
+// Only a new value notified after the deletion of the previous one holds a
+// new chunk: the owner writes the INCR property before sending the selection
+// notification, so its new value notification is usually still pending.
+func readIncr(events <-chan xproto.PropertyNotifyEvent, prop xproto.Atom, get func() ([]byte, error)) ([]byte, error) {
+	var data []byte
+	deleted := false
+	for {
+		var e xproto.PropertyNotifyEvent
+		select {
+		case e = <-events:
+		case <-time.After(x11Timeout * time.Millisecond):
+			return nil, errors.New("timeout during INCR transfer from X selection owner")
+		}
+		if e.Atom != prop {
+			continue
+		}
+		if e.State == xproto.PropertyDelete {
+			deleted = true
+			continue
+		}
+		if !deleted {
+			continue
+		}
+		value, err := get()
+		if err != nil {
+			return nil, err
+		}
+		deleted = false
+		if len(value) == 0 {
+			return data, nil
+		}
+		data = append(data, value...)
+		if len(data) > x11MaxSelectionSize {
+			return nil, fmt.Errorf("X selection larger than %d bytes", x11MaxSelectionSize)
+		}
+	}
+}
+
+// getProperty reads and deletes a property from our window.
+func (x *x11Backend) getProperty(prop xproto.Atom) (*xproto.GetPropertyReply, error) {
+	reply, err := xproto.GetProperty(x.conn, true, x.window, prop, xproto.GetPropertyTypeAny, 0, x11MaxSelectionSize/4).Reply()
+	if err != nil {
+		return nil, fmt.Errorf("error reading X property: %v", err)
+	}
+	return reply, nil
+}
+
+// drain discards any pending notifications for our window.
+func (x *x11Backend) drain() {
+	for {
+		select {
+		case <-x.selNotify:
+		case <-x.propNotify:
+		default:
+			return
+		}
+	}
+}
+
+// setSelection sets the contents of the chosen X selection by becoming its
+// owner. Contents are served to other clients by the event loop.
+func (x *x11Backend) setSelection(sel string, contents clipContents) error {
+	selAtom, err := x.selectionAtom(sel)
+	if err != nil {
+		return err
+	}
+	// Intern all atoms we'll need before any requests come in, so the event
+	// loop won't have to wait on the server.
+	for _, name := range []string{"TARGETS", "TIMESTAMP", "INCR"} {
+		if _, err := x.atom(name); err != nil {
+			return err
+		}
+	}
+	// Text is offered in all the usual text targets.
+	var targets []x11Target
+	for _, mimetype := range contents.types() {
+		names := []string{mimetype}
+		if mimetype == mimeTextPlain {
+			names = textMimeTypes
+		}
+		for _, name := range names {
+			atom, err := x.atom(name)
+			if err != nil {
+				return err
+			}
+			targets = append(targets, x11Target{atom: atom, mimetype: mimetype})
+		}
+	}
+
+	ts, err := x.serverTime()
+	if err != nil {
+		return err
+	}
+	x.Lock()
+	x.owned[selAtom] = &x11Owned{contents: contents, targets: targets, time: ts}
+	x.Unlock()
+
+	xproto.SetSelectionOwner(x.conn, x.window, selAtom, ts)
+	reply, err := xproto.GetSelectionOwner(x.conn, selAtom).Reply()
+	if err != nil {
+		return fmt.Errorf("error verifying X selection owner: %v", err)
+	}
+	if reply.Owner != x.window {
+		x.Lock()
+		delete(x.owned, selAtom)
+		x.Unlock()
+		return fmt.Errorf("unable to become owner of the %s selection", sel)
+	}
+	return nil
+}
+
+// events returns the channel of selection owner changes.
+func (x *x11Backend) events() <-chan selectionEvent {
+	return x.selEvents
+}
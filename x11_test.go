@@ -0,0 +1,102 @@
+// This file is part of clipsync (C)2023 by Marco Paganini
+// Please see http://github.com/marcopaganini/clipsync for details.
+
+package main
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jezek/xgb/xproto"
+)
+
+// incrOwner simulates the owner of a selection sending an INCR transfer into
+// a property of our window. Like a real owner, it writes the next chunk some
+// time after the property is deleted.
+type incrOwner struct {
+	sync.Mutex
+	prop   xproto.Atom
+	chunks [][]byte
+	value  []byte
+	events chan xproto.PropertyNotifyEvent
+}
+
+func newIncrOwner(prop xproto.Atom, chunks [][]byte) *incrOwner {
+	o := &incrOwner{
+		prop:   prop,
+		chunks: chunks,
+		events: make(chan xproto.PropertyNotifyEvent, 16),
+	}
+	// The INCR property is written before the selection notification.
+	o.write([]byte{0, 0, 0, 0})
+	return o
+}
+
+// write sets the property, notifying the new value.
+func (o *incrOwner) write(value []byte) {
+	o.Lock()
+	o.value = value
+	o.Unlock()
+	o.events <- xproto.PropertyNotifyEvent{Atom: o.prop, State: xproto.PropertyNewValue}
+}
+
+// get reads and deletes the property, like getProperty.
+func (o *incrOwner) get() ([]byte, error) {
+	o.Lock()
+	defer o.Unlock()
+	value := o.value
+	o.value = nil
+	o.events <- xproto.PropertyNotifyEvent{Atom: o.prop, State: xproto.PropertyDelete}
+	if len(o.chunks) > 0 {
+		next := o.chunks[0]
+		o.chunks = o.chunks[1:]
+		time.AfterFunc(10*time.Millisecond, func() { o.write(next) })
+	}
+	return value, nil
+}
+
+func TestReadIncr(t *testing.T) {
+	const prop = xproto.Atom(100)
+	tests := []struct {
+		name   string
+		chunks [][]byte
+		want   []byte
+	}{
+		{"empty", [][]byte{{}}, nil},
+		{"one chunk", [][]byte{[]byte("hello"), {}}, []byte("hello")},
+		{"many chunks", [][]byte{[]byte("hello"), []byte(", "), []byte("world"), {}}, []byte("hello, world")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newIncrOwner(prop, tt.chunks)
+			// Notifications for other properties are ignored.
+			o.events <- xproto.PropertyNotifyEvent{Atom: prop + 1, State: xproto.PropertyNewValue}
+
+			// Read and delete the INCR property, starting the transfer.
+			if _, err := o.get(); err != nil {
+				t.Fatal(err)
+			}
+			got, err := readIncr(o.events, prop, o.get)
+			if err != nil {
+				t.Fatalf("readIncr: %v", err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadIncrTimeout(t *testing.T) {
+	const prop = xproto.Atom(100)
+	// The owner never sends the first chunk.
+	o := newIncrOwner(prop, nil)
+	if _, err := o.get(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readIncr(o.events, prop, o.get); err == nil {
+		t.Errorf("readIncr succeeded: %q", got)
+	}
+}
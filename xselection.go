@@ -4,9 +4,7 @@
 package main
 
 import (
-	"context"
-	"fmt"
-	"os/exec"
+	"errors"
 	"sync"
 	"time"
 )
@@ -15,110 +13,117 @@ const (
 	// Clipboard Selection Types.
 	selPrimary   = "primary"
 	selClipboard = "clipboard"
-	// Timeout when running xclip, in ms.
-	xclipTimeout = 1500
 )
 
-// client contains a representation of a MQTT client.
+// xselection holds the in-memory copies of the selections and the clipboard
+// backend used to access the real ones.
 type xselection struct {
 	sync.RWMutex
-	primary   string
-	clipboard string
+	backend   clipboardBackend
+	mimetypes []string
+	primary   clipContents
+	clipboard clipContents
 }
 
-func (x *xselection) setMemPrimary(value string) {
+// newXSelection returns a new xselection using the given clipboard backend.
+// Only the given mime types are read from the selections.
+func newXSelection(backend clipboardBackend, mimetypes []string) *xselection {
+	return &xselection{backend: backend, mimetypes: mimetypes}
+}
+
+func (x *xselection) setMemPrimary(value clipContents) {
 	x.Lock()
 	x.primary = value
 	x.Unlock()
 }
 
-func (x *xselection) setMemClipboard(value string) {
+func (x *xselection) setMemClipboard(value clipContents) {
 	x.Lock()
 	x.clipboard = value
 	x.Unlock()
 }
 
-func (x *xselection) getMemPrimary() string {
+func (x *xselection) getMemPrimary() clipContents {
 	x.Lock()
 	v := x.primary
 	x.Unlock()
 	return v
 }
-func (x *xselection) getMemClipboard() string {
+func (x *xselection) getMemClipboard() clipContents {
 	x.Lock()
 	v := x.clipboard
 	x.Unlock()
 	return v
 }
 
-// getXSelection returns the contents of the chosen X selection.
-func (x *xselection) getXSelection(sel, mimetype string) string {
+// getXSelection returns the contents of the chosen selection in all the
+// configured mime types offered by the current owner. Errors are logged and
+// result in empty contents. An empty selection is not an error.
+func (x *xselection) getXSelection(sel string) clipContents {
 	x.Lock()
 	defer x.Unlock()
+	defer observeBackendCall("get", sel, time.Now())
 
-	// xclip will return an error on an empty clipboard, but
-	// there's no portable way to fetch the return code. Being
-	// that the case, we'll just ignore those (TODO: Fix this).
-	args := []string{"-selection", sel, "-o"}
-	if mimetype != "" {
-		args = append(args, "-t", mimetype)
+	targets, err := x.backend.targets(sel)
+	if err != nil {
+		if !errors.Is(err, errNoSelection) {
+			log.Errorf("Unable to read %s selection targets: %v", sel, err)
+		}
+		return nil
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), xclipTimeout*time.Millisecond)
-	defer cancel()
 
-	xclip := exec.CommandContext(ctx, "xclip", args...)
-	out, err := xclip.Output()
-	if err != nil {
-		// Don't log anything here, as running xclip on an empty clipboard will
-		// return an error. This is a common and harmless occurrence.
-		return ""
+	ret := clipContents{}
+	for _, mimetype := range x.mimetypes {
+		// Text can be offered in many different types. Let the backend choose.
+		if mimetype != mimeTextPlain && !stringInSlice(mimetype, targets) {
+			continue
+		}
+		data, err := x.backend.getSelection(sel, mimetype)
+		if err != nil {
+			if !errors.Is(err, errNoSelection) {
+				log.Errorf("Unable to read %s selection as %s: %v", sel, mimetype, err)
+			}
+			continue
+		}
+		if len(data) > 0 {
+			ret[mimetype] = data
+		}
 	}
-	return string(out)
+	if len(ret) == 0 {
+		return nil
+	}
+	return ret
 }
 
-// setXSelection sets the contents of the chosen X selection.
-func (x *xselection) setXSelection(sel string, contents string) error {
+// setXSelection sets the contents of the chosen selection.
+func (x *xselection) setXSelection(sel string, contents clipContents) error {
 	x.Lock()
 	defer x.Unlock()
+	defer observeBackendCall("set", sel, time.Now())
 
-	ctx, cancel := context.WithTimeout(context.Background(), xclipTimeout*time.Millisecond)
-	defer cancel()
-
-	xclip := exec.CommandContext(ctx, "xclip", "-selection", sel, "-i")
-	stdin, err := xclip.StdinPipe()
-	if err != nil {
-		return fmt.Errorf("error reading xclip stdin: %v", err)
-	}
-	if err := xclip.Start(); err != nil {
-		return fmt.Errorf("error starting xclip: %v", err)
-	}
-
-	if _, err = stdin.Write([]byte(contents)); err != nil {
-		return err
-	}
-	stdin.Close()
-	if err = xclip.Wait(); err != nil {
-		return fmt.Errorf("error waiting for xclip: %v", err)
-	}
+	//log.Debugf("Set selection(%s) to: %s", sel, redact.redactContents(contents))
+	return x.backend.setSelection(sel, contents)
+}
 
-	//log.Debugf("Set selection(%s) to: %s", sel, redact.redact(contents))
-	return nil
+// events returns the channel of selection changes from the backend.
+func (x *xselection) events() <-chan selectionEvent {
+	return x.backend.events()
 }
 
 // Syntactic sugar functions to access the X clipboard.
 
-func (x *xselection) setXClipboard(contents string) error {
+func (x *xselection) setXClipboard(contents clipContents) error {
 	return x.setXSelection(selClipboard, contents)
 }
 
-func (x *xselection) setXPrimary(contents string) error {
+func (x *xselection) setXPrimary(contents clipContents) error {
 	return x.setXSelection(selPrimary, contents)
 }
 
-func (x *xselection) getXPrimary(mimetype string) string {
-	return x.getXSelection(selPrimary, mimetype)
+func (x *xselection) getXPrimary() clipContents {
+	return x.getXSelection(selPrimary)
 }
 
-func (x *xselection) getXClipboard(mimetype string) string {
-	return x.getXSelection(selClipboard, mimetype)
+func (x *xselection) getXClipboard() clipContents {
+	return x.getXSelection(selClipboard)
 }